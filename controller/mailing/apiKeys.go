@@ -0,0 +1,111 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/apiKeys"
+	"mailinglist-backend-go/services/audit"
+	"net/http"
+	"time"
+)
+
+// APIKeyRequest issues an API key.
+type APIKeyRequest struct {
+	Name      string     `json:"name" example:"crm-sync"`
+	Scopes    []string   `json:"scopes" example:"members:write"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" example:"2027-01-01T00:00:00Z"`
+}
+
+// APIKeyResponse is a new API key. Key is only returned once.
+type APIKeyResponse struct {
+	apiKeys.APIKey
+	Key string `json:"key" example:"mlk_3f2a9c0d4b1e7a65_..."`
+}
+
+// APIKeys godoc
+// @Summary      List API keys
+// @Description  Returns the issued API keys, including revoked ones, without their secrets. Admin users only.
+// @Tags         api-keys
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   apiKeys.APIKey
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Router       /v1/api-keys [get]
+func APIKeys(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		keys, err := apiKeys.List()
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list api keys: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, keys)
+	})
+}
+
+// CreateAPIKey godoc
+// @Summary      Issue an API key
+// @Description  Issues a key for a batch job or backend, sent as "Authorization: Bearer <key>" or "X-API-Key: <key>".
+// @Description  Scopes: lists:read, lists:write, members:read, members:write, messages:send and admin. The key is
+// @Description  only returned in this response. Admin users only.
+// @Tags         api-keys
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      APIKeyRequest  true  "Key"
+// @Success      201      {object}  APIKeyResponse
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/api-keys [post]
+func CreateAPIKey(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		var req APIKeyRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		k, key, err := apiKeys.Create(req.Name, req.Scopes, req.ExpiresAt, user.Actor())
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to create api key: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "create_api_key", Details: map[string]string{"api_key": k.ID, "name": k.Name}})
+		writeJSON(w, r, lg, http.StatusCreated, APIKeyResponse{APIKey: k, Key: key})
+	})
+}
+
+// RevokeAPIKey godoc
+// @Summary      Revoke an API key
+// @Description  Invalidates a key immediately. Admin users only.
+// @Tags         api-keys
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Key ID"
+// @Success      200  {object}  apiKeys.APIKey
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/api-keys/{id} [delete]
+func RevokeAPIKey(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		k, err := apiKeys.Revoke(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to revoke api key: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "revoke_api_key", Details: map[string]string{"api_key": k.ID, "name": k.Name}})
+		writeJSON(w, r, lg, http.StatusOK, k)
+	})
+}
@@ -0,0 +1,209 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/rateLimiter"
+	"mailinglist-backend-go/services/subscriptions"
+	"net/http"
+)
+
+// ConsentsResponse are the consent records of a member.
+type ConsentsResponse struct {
+	Policy  consent.Policy   `json:"policy"`
+	Records []consent.Record `json:"records"`
+	// ReconsentRequired are the lists the member has to subscribe to again to consent to
+	// the current policy version.
+	ReconsentRequired []string `json:"reconsent_required"`
+}
+
+// PolicyRequest publishes a privacy policy version.
+type PolicyRequest struct {
+	Version          string `json:"version" example:"2026-10"`
+	RequireReconsent bool   `json:"require_reconsent"`
+}
+
+// MyConsents godoc
+// @Summary      Get my consent records
+// @Description  Returns when and how the current user consented to receive each list, and the lists that need consent
+// @Description  to the current privacy policy version. Subscribing to such a list again records the new consent.
+// @Tags         me
+// @Produce      json
+// @Security     BearerAuth
+// @Param        X-Act-As  header    string  false  "Act as this user (impersonate permission)"
+// @Success      200       {object}  ConsentsResponse
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Router       /v1/me/consents [get]
+func MyConsents(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		writeConsents(w, r, lg, user.Email)
+	})
+}
+
+// MemberConsents godoc
+// @Summary      Get the consent records of an address
+// @Description  Like GET /v1/me/consents for any address. Admin only.
+// @Tags         consents
+// @Produce      json
+// @Security     BearerAuth
+// @Param        address  path      string  true  "Email address"
+// @Success      200      {object}  ConsentsResponse
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/members/{address}/consents [get]
+func MemberConsents(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		writeConsents(w, r, lg, r.PathValue("address"))
+	})
+}
+
+// ConsentPolicy godoc
+// @Summary      Get the privacy policy version
+// @Description  Returns the current privacy policy version consents are recorded for.
+// @Tags         consents
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  consent.Policy
+// @Failure      401  {string}  string  "Unauthorized"
+// @Router       /v1/consents/policy [get]
+func ConsentPolicy(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, err := consent.CurrentPolicy()
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get policy: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, policy)
+	})
+}
+
+// UpdateConsentPolicy godoc
+// @Summary      Publish a privacy policy version
+// @Description  Sets the version new consents are recorded for. With require_reconsent, members whose latest consent
+// @Description  is for another version are reported by GET /v1/consents/pending until they subscribe again. Admin only.
+// @Tags         consents
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      PolicyRequest  true  "Policy version"
+// @Success      200      {object}  consent.Policy
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/consents/policy [put]
+func UpdateConsentPolicy(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		var req PolicyRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		policy, err := consent.SetPolicy(req.Version, req.RequireReconsent, user.Actor())
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to set policy: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, policy)
+	})
+}
+
+// PendingConsents godoc
+// @Summary      List members who need to consent again
+// @Description  Returns the subscribed members whose latest consent is not for the current privacy policy version, if
+// @Description  re-consent is required. Admin only.
+// @Tags         consents
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list  query     string  false  "Only members of this list"
+// @Success      200   {array}   consent.Pending
+// @Failure      401   {string}  string  "Unauthorized"
+// @Failure      403   {string}  string  "Forbidden"
+// @Failure      404   {string}  string  "Not Found"
+// @Router       /v1/consents/pending [get]
+func PendingConsents(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		pending, err := consent.PendingReconsent(r.Context(), r.URL.Query().Get("list"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get pending consents: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, pending)
+	})
+}
+
+func writeConsents(w http.ResponseWriter, r *http.Request, lg *slog.Logger, address string) {
+	policy, err := consent.CurrentPolicy()
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to get policy: %w", err))
+		return
+	}
+	records, err := consent.For(address)
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to get consents: %w", err))
+		return
+	}
+	resp := ConsentsResponse{Policy: policy, Records: records, ReconsentRequired: []string{}}
+	if policy.RequireReconsent {
+		memberships, err := subscriptions.Memberships(r.Context(), address)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get memberships: %w", err))
+			return
+		}
+		for _, m := range memberships {
+			if m.Member.Status == mailgun.StatusUnsubscribed {
+				continue
+			}
+			if pending, _ := consent.NeedsReconsent(policy, records, m.List, address); pending {
+				resp.ReconsentRequired = append(resp.ReconsentRequired, m.List)
+			}
+		}
+	}
+	writeJSON(w, r, lg, http.StatusOK, resp)
+}
+
+// recordConsent records the consent of member to list with the client of the request.
+// It is recorded before subscribing, so that no member is subscribed without a record;
+// if the subscription fails, the record is discarded with [discardConsent].
+func recordConsent(r *http.Request, list, member string, source consent.Source) (consent.Record, error) {
+	trusted, _ := rateLimiter.ParseProxies(configReader.Values("TRUSTED_PROXIES"))
+	return consent.Add(r.Context(), consent.Record{
+		List:      list,
+		Member:    member,
+		Source:    source,
+		IP:        rateLimiter.ClientIP(r, trusted),
+		UserAgent: r.UserAgent(),
+	})
+}
+
+// discardConsent deletes the consent of a subscription that did not happen. A failure
+// is only logged.
+func discardConsent(r *http.Request, lg *slog.Logger, c consent.Record) {
+	if err := consent.Discard(c.ID); err != nil {
+		lg.ErrorContext(r.Context(), "failed to discard consent", "consent", c.ID, "list", c.List, "member", c.Member, "error", err)
+	}
+}
+
+// withdrawConsent marks the consent of member to list as withdrawn. A failure is only logged.
+func withdrawConsent(r *http.Request, lg *slog.Logger, list, member string) {
+	if err := consent.Withdraw(list, member); err != nil {
+		lg.ErrorContext(r.Context(), "failed to withdraw consent", "list", list, "member", member, "error", err)
+	}
+}
@@ -0,0 +1,210 @@
+package mailing
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/dataExport"
+	"mailinglist-backend-go/services/erasure"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/requestValidator"
+	"net/http"
+	"regexp"
+)
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+
+// MyData godoc
+// @Summary      Export my data
+// @Description  Returns everything stored about the current user: list memberships with name and member vars,
+// @Description  suppressions, recent Mailgun events, submissions, consent records and audit log entries. With
+// @Description  format=zip the data is returned as a ZIP archive with one JSON file per section. The email address
+// @Description  of the user must be verified, even with REQUIRE_EMAIL_VERIFIED=false.
+// @Tags         me
+// @Produce      json
+// @Produce      application/zip
+// @Security     BearerAuth
+// @Param        format    query     string  false  "json (default) or zip"
+// @Param        X-Act-As  header    string  false  "Act as this user (impersonate permission)"
+// @Success      200       {object}  dataExport.Export
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Router       /v1/me/data [get]
+func MyData(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		if err := requireOwnEmail(user); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		exportData(w, r, lg, user, user.Email)
+	})
+}
+
+// MemberData godoc
+// @Summary      Export the data of an address
+// @Description  Returns everything stored about an email address, like GET /v1/me/data. Admin only.
+// @Tags         data
+// @Produce      json
+// @Produce      application/zip
+// @Security     BearerAuth
+// @Param        address  path      string  true   "Email address"
+// @Param        format   query     string  false  "json (default) or zip"
+// @Success      200      {object}  dataExport.Export
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/members/{address}/data [get]
+func MemberData(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		exportData(w, r, lg, user, r.PathValue("address"))
+	})
+}
+
+// EraseMe godoc
+// @Summary      Erase my data
+// @Description  Removes the current user from every list and erases or pseudonymizes everything stored about the
+// @Description  address, see DELETE /v1/members/{address}. The erasure runs in the background; the response is its
+// @Description  receipt. The email address of the user must be verified, even with REQUIRE_EMAIL_VERIFIED=false.
+// @Tags         me
+// @Produce      json
+// @Security     BearerAuth
+// @Success      202  {object}  erasure.Erasure
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Router       /v1/me [delete]
+func EraseMe(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		if err := requireOwnEmail(user); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		startErasure(w, r, lg, user, user.Email)
+	})
+}
+
+// EraseMember godoc
+// @Summary      Erase an address
+// @Description  Removes the address from every list (including hidden and blocked ones), removes its suppressions
+// @Description  except those kept by ERASURE_KEEP_SUPPRESSIONS, deletes its pending submissions, cancels its pending
+// @Description  jobs and replaces the address by a pseudonym in decided submissions, consent records, job payloads and
+// @Description  the audit log. The erasure runs in the background and can be followed with GET /v1/erasures/{id}; a
+// @Description  pending erasure of the same address is returned instead of starting another one. Admin only; machine
+// @Description  clients need the admin scope.
+// @Tags         data
+// @Produce      json
+// @Security     BearerAuth
+// @Param        address  path      string  true  "Email address"
+// @Success      202      {object}  erasure.Erasure
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/members/{address} [delete]
+func EraseMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		startErasure(w, r, lg, user, r.PathValue("address"))
+	})
+}
+
+// Erasure godoc
+// @Summary      Get an erasure
+// @Description  Returns the progress of an erasure and, once completed, its receipt. Admin only.
+// @Tags         data
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Erasure ID"
+// @Success      200  {object}  erasure.Erasure
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/erasures/{id} [get]
+func Erasure(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		e, err := erasure.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get erasure: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, e)
+	})
+}
+
+func startErasure(w http.ResponseWriter, r *http.Request, lg *slog.Logger, user requestValidator.User, address string) {
+	e, err := erasure.Start(address, user.Actor())
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to start erasure: %w", err))
+		return
+	}
+	lg.InfoContext(r.Context(), "erasure started", "erasure", e.ID, "pseudonym", e.Pseudonym)
+	writeJSON(w, r, lg, http.StatusAccepted, e)
+}
+
+// exportData answers with the data export of address as attachment.
+func exportData(w http.ResponseWriter, r *http.Request, lg *slog.Logger, user requestValidator.User, address string) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		httpErrorBadRequest(w, r, lg, fmt.Errorf("format must be json or zip"))
+		return
+	}
+	export, err := dataExport.Collect(r.Context(), address)
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to export data: %w", err))
+		return
+	}
+	recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "export_data", Subject: address})
+
+	filename := "data-" + unsafeFilename.ReplaceAllString(address, "_")
+	if format != "zip" {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		writeJSON(w, r, lg, http.StatusOK, export)
+		return
+	}
+	// Built in memory so that a failure still results in an error response
+	var buf bytes.Buffer
+	if err := dataExport.WriteZIP(&buf, export); err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to write archive: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		lg.ErrorContext(r.Context(), "failed to write response", "error", err)
+	}
+}
+
+// publishEvent publishes e. The change itself already happened, so a failure is only
+// logged.
+func publishEvent(r *http.Request, lg *slog.Logger, e events.Event) {
+	if err := events.Publish(r.Context(), e); err != nil {
+		lg.ErrorContext(r.Context(), "failed to publish event", "type", e.Type, "error", err)
+	}
+}
+
+// recordAudit adds e to the audit log. The change itself already happened, so a failure
+// is only logged.
+func recordAudit(r *http.Request, lg *slog.Logger, e audit.Entry) {
+	e.OnBehalfOf = requestValidator.ActingAs(r.Context())
+	if err := audit.Record(e); err != nil {
+		lg.ErrorContext(r.Context(), "failed to record audit entry", "action", e.Action, "subject", e.Subject, "error", err)
+	}
+}
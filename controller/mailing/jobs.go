@@ -0,0 +1,133 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/scheduler"
+	"net/http"
+	"time"
+)
+
+// RescheduleRequest moves a job to a new time.
+type RescheduleRequest struct {
+	RunAt time.Time `json:"run_at" example:"2026-11-01T09:00:00Z"`
+}
+
+// Jobs godoc
+// @Summary      List jobs
+// @Description  Returns scheduled jobs ordered by their run time. Admin only.
+// @Tags         jobs
+// @Produce      json
+// @Security     BearerAuth
+// @Param        status  query     string  false  "Filter by status (pending, running, done, failed, cancelled)"
+// @Success      200     {array}   scheduler.Job
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Router       /v1/jobs [get]
+func Jobs(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		jobs, err := scheduler.List(scheduler.Status(r.URL.Query().Get("status")))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list jobs: %w", err))
+			return
+		}
+		if jobs == nil {
+			jobs = []scheduler.Job{}
+		}
+		writeJSON(w, r, lg, http.StatusOK, jobs)
+	})
+}
+
+// Job godoc
+// @Summary      Get a job
+// @Tags         jobs
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Job ID"
+// @Success      200  {object}  scheduler.Job
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/jobs/{id} [get]
+func Job(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		job, err := scheduler.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get job: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, job)
+	})
+}
+
+// RescheduleJob godoc
+// @Summary      Reschedule a job
+// @Description  Moves a pending or failed job to a new time.
+// @Tags         jobs
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string             true  "Job ID"
+// @Param        request  body      RescheduleRequest  true  "New run time"
+// @Success      200      {object}  scheduler.Job
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Failure      409      {string}  string  "Conflict"
+// @Router       /v1/jobs/{id} [patch]
+func RescheduleJob(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		var req RescheduleRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		if req.RunAt.IsZero() {
+			httpErrorBadRequest(w, r, lg, fmt.Errorf("run_at is required"))
+			return
+		}
+		job, err := scheduler.Reschedule(r.PathValue("id"), req.RunAt)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to reschedule job: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, job)
+	})
+}
+
+// CancelJob godoc
+// @Summary      Cancel a job
+// @Description  Cancels a pending or failed job.
+// @Tags         jobs
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Job ID"
+// @Success      200  {object}  scheduler.Job
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Failure      409  {string}  string  "Conflict"
+// @Router       /v1/jobs/{id} [delete]
+func CancelJob(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		job, err := scheduler.Cancel(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to cancel job: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, job)
+	})
+}
@@ -1,23 +1,48 @@
 package mailing
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"mailinglist-backend-go/services/audit"
 	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/events"
 	"mailinglist-backend-go/services/mailgun"
 	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/subscriptions"
 	"net/http"
+	"strings"
 )
 
+// MembershipResponse is the result of a subscribe or unsubscribe.
+type MembershipResponse struct {
+	List       string `json:"list" example:"news@example.com"`
+	Member     string `json:"member" example:"jane@example.com"`
+	Subscribed bool   `json:"subscribed"`
+	// Status is subscribed or unsubscribed; an explicit change ends a pause.
+	Status mailgun.MemberStatus `json:"status" example:"subscribed"`
+	// Removed is set if the member was deleted from the list instead of being kept unsubscribed.
+	Removed bool `json:"removed,omitempty"`
+	// Warnings explain why a subscribed member may still not receive messages.
+	Warnings     []string              `json:"warnings,omitempty"`
+	Suppressions []mailgun.Suppression `json:"suppressions,omitempty"`
+}
+
 // Lists godoc
 // @Summary      Get mailing lists
 // @Description  Returns all mailing lists available to the system.
 // @Tags         mailing
 // @Produce      json
 // @Security     BearerAuth
+// @Param        If-None-Match  header  string  false  "ETag of a previous response"
 // @Success      200  {array}   mailgun.APIMailingList
+// @Success      304  {string}  string  "Not Modified"
 // @Failure      401  {string}  string  "Unauthorized"
 // @Failure      500  {string}  string  "Internal Server Error"
 // @Router       /lists [get]
@@ -27,125 +52,306 @@ func Lists(lg *slog.Logger) http.Handler {
 		// Authorization is handled by middleware
 
 		// Get the list of mailing lists
-		lists, err := mailgun.Lists(false)
+		lists, err := mailgun.Lists(r.Context(), false)
 
 		if err != nil {
 			httpError(w, r, lg, fmt.Errorf("failed to get lists: %w", err))
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-
 		// Need to do this because the json encoder will not encode an empty array. It is nil instead
 		// Could change with "encoding/json/v2"
 		result := []mailgun.MGMailingList{}
 		if len(lists) > 0 {
 			result = lists
 		}
-		err = json.NewEncoder(w).Encode(result)
+		writeJSONWithETag(w, r, lg, result)
+	})
+}
+
+// List godoc
+// @Summary      Get a mailing list
+// @Description  Returns a single mailing list by its address.
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list  path      string  true  "List address"
+// @Param        If-None-Match  header  string  false  "ETag of a previous response"
+// @Success      200   {object}  mailgun.APIMailingList
+// @Success      304   {string}  string  "Not Modified"
+// @Failure      401   {string}  string  "Unauthorized"
+// @Failure      404   {string}  string  "Not Found"
+// @Failure      500   {string}  string  "Internal Server Error"
+// @Router       /v1/lists/{list} [get]
+// List returns an [http.Handler] that returns the mailing list addressed by the path.
+func List(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, err := mailgun.List(r.Context(), r.PathValue("list"), false)
 		if err != nil {
-			httpError(w, r, lg, fmt.Errorf("failed to get lists: %w", err))
+			httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
 			return
 		}
+		writeJSONWithETag(w, r, lg, list)
 	})
 }
 
 // Subscribe godoc
 // @Summary      Subscribe a member to a list
-// @Description  Subscribes the specified member email to the given list address.
+// @Description  Subscribes the specified member email to the given list address. The response warns if Mailgun
+// @Description  suppresses deliveries to the address.
+// @Description  Deprecated: use PUT /v1/lists/{list}/members/{member}.
 // @Tags         mailing
 // @Accept       application/x-www-form-urlencoded
 // @Produce      json
 // @Security     BearerAuth
 // @Param        list    formData  string  true  "List address"
 // @Param        member  formData  string  true  "Member email"
-// @Success      200     {string}  string  "OK"
+// @Success      200     {object}  MembershipResponse
 // @Failure      400     {string}  string  "Bad Request"
 // @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Deprecated
 // @Router       /subscribe [post]
 func Subscribe(lg *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		// Auth handled by middleware; fetch claims from context
-		claims, err := requestValidator.ClaimsFromRequest(r)
-		if err != nil {
-			httpErrorUnauthorized(w, r, lg, err)
-			return
-		}
-
-		listAddress := r.PostFormValue("list")
-		memberAddress := r.PostFormValue("member")
-
-		if listAddress == "" || memberAddress == "" {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to parse form: %w", err))
-			return
-		}
-
-		user := requestValidator.CurrentUser(claims)
-		// If not admin, you can only subscribe yourself
-		if (user.Admin == false) && (memberAddress != user.Email) {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("only admins can (un)subscribe other users"))
-		}
-
-		// TODO: Check if the list is blocked
-
-		err = mailgun.Subscribe(listAddress, memberAddress)
-		if err != nil {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to subsribe: %w", err))
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		changeMembership(w, r, lg, r.PostFormValue("list"), r.PostFormValue("member"), true)
 	})
 }
 
 // Unsubscribe godoc
 // @Summary      Unsubscribe a member from a list
 // @Description  Unsubscribes the specified member email from the given list address.
+// @Description  Deprecated: use DELETE /v1/lists/{list}/members/{member}.
 // @Tags         mailing
 // @Accept       application/x-www-form-urlencoded
 // @Produce      json
 // @Security     BearerAuth
 // @Param        list    formData  string  true  "List address"
 // @Param        member  formData  string  true  "Member email"
-// @Success      200     {string}  string  "OK"
+// @Success      200     {object}  MembershipResponse
 // @Failure      400     {string}  string  "Bad Request"
 // @Failure      401     {string}  string  "Unauthorized"
+// @Deprecated
 // @Router       /unsubscribe [post]
 func Unsubscribe(lg *slog.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changeMembership(w, r, lg, r.PostFormValue("list"), r.PostFormValue("member"), false)
+	})
+}
 
-		// Auth handled by middleware; fetch claims from context
-		claims, err := requestValidator.ClaimsFromRequest(r)
-		if err != nil {
-			httpErrorUnauthorized(w, r, lg, err)
-			return
-		}
+// AddMember godoc
+// @Summary      Add a member to a list
+// @Description  Subscribes the member email to the list. Only owners of the list may subscribe others; users
+// @Description  subscribing themselves need a verified email address.
+// @Description  If Mailgun suppresses deliveries to the address (bounce, complaint or unsubscribe), the response
+// @Description  contains warnings and the suppression entries. The consent is recorded with the current privacy
+// @Description  policy version; admins may set its source with consent_source (default admin, or self for their own
+// @Description  address).
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list            path      string  true   "List address"
+// @Param        member          path      string  true   "Member email"
+// @Param        consent_source  query     string  false  "self, admin, import or double_opt_in"
+// @Success      200             {object}  MembershipResponse
+// @Failure      400             {string}  string  "Bad Request"
+// @Failure      401             {string}  string  "Unauthorized"
+// @Failure      403             {string}  string  "Forbidden"
+// @Router       /v1/lists/{list}/members/{member} [put]
+func AddMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changeMembership(w, r, lg, r.PathValue("list"), r.PathValue("member"), true)
+	})
+}
+
+// RemoveMember godoc
+// @Summary      Remove a member from a list
+// @Description  Unsubscribes the member email from the list. Only owners of the list may unsubscribe others.
+// @Description  Depending on the unsubscribe mode of the list the member is removed or kept with subscribed=false.
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list    path      string  true  "List address"
+// @Param        member  path      string  true  "Member email"
+// @Success      200     {object}  MembershipResponse
+// @Failure      400     {string}  string  "Bad Request"
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Router       /v1/lists/{list}/members/{member} [delete]
+func RemoveMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changeMembership(w, r, lg, r.PathValue("list"), r.PathValue("member"), false)
+	})
+}
 
-		listAddress := r.PostFormValue("list")
-		memberAddress := r.PostFormValue("member")
+// changeMembership (un)subscribes memberAddress to/from listAddress on behalf of the
+// authenticated user. It is shared by the legacy form based routes and the v1 routes.
+func changeMembership(w http.ResponseWriter, r *http.Request, lg *slog.Logger, listAddress, memberAddress string, subscribe bool) {
+	// Auth handled by middleware; fetch claims from context
+	claims, err := requestValidator.ClaimsFromRequest(r)
+	if err != nil {
+		httpErrorUnauthorized(w, r, lg, err)
+		return
+	}
+
+	if listAddress == "" || memberAddress == "" {
+		httpErrorBadRequest(w, r, lg, fmt.Errorf("list and member are required"))
+		return
+	}
+
+	user, err := requestValidator.CurrentUser(claims)
+	if err != nil {
+		httpErrorUnauthorized(w, r, lg, err)
+		return
+	}
+	// Unless owner of the list, you can only subscribe yourself
+	if !strings.EqualFold(memberAddress, user.Email) && !roles.Can(user, listAddress, roles.ManageMembers) {
+		httpError(w, r, lg, fmt.Errorf("%w: only admins and list owners can (un)subscribe other users", common.ErrForbidden))
+		return
+	}
 
-		if listAddress == "" || memberAddress == "" {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to parse form: %w", err))
+	source := consent.SourceSelf
+	if !strings.EqualFold(memberAddress, user.Email) {
+		source = consent.SourceAdmin
+	}
+	if v := r.URL.Query().Get("consent_source"); v != "" && subscribe {
+		if !roles.Can(user, listAddress, roles.ManageMembers) {
+			httpError(w, r, lg, fmt.Errorf("%w: only admins and list owners can set the consent source", common.ErrForbidden))
 			return
 		}
-
-		user := requestValidator.CurrentUser(claims)
-		// If not admin, you can only subscribe yourself
-		if (user.Admin == false) && (memberAddress != user.Email) {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("only admins can (un)subscribe other users"))
+		if source, err = consent.ParseSource(v); err != nil {
+			httpError(w, r, lg, err)
+			return
 		}
+	}
 
-		// TODO: Check if the list is blocked
+	if subscribe && source == consent.SourceSelf {
+		if err := requireVerifiedEmail(user); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+	}
 
-		err = mailgun.Unsubscribe(listAddress, memberAddress)
+	resp := MembershipResponse{List: listAddress, Member: memberAddress, Subscribed: subscribe, Status: mailgun.StatusUnsubscribed}
+	action := "unsubscribe"
+	if subscribe {
+		action = "subscribe"
+		c, err := recordConsent(r, listAddress, memberAddress, source)
 		if err != nil {
-			httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to unsubsribe: %w", err))
+			httpError(w, r, lg, fmt.Errorf("failed to record consent: %w", err))
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-	})
+		err = addMember(r, listAddress, memberAddress, user)
+		if err != nil {
+			discardConsent(r, lg, c)
+			httpError(w, r, lg, fmt.Errorf("failed to subscribe: %w", err))
+			return
+		}
+		resp.Status = mailgun.StatusSubscribed
+		resp.Suppressions, resp.Warnings = suppressionWarnings(r, lg, listAddress, memberAddress)
+	} else {
+		err = mailgun.Unsubscribe(r.Context(), listAddress, memberAddress)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to unsubscribe: %w", err))
+			return
+		}
+		// Unsubscribe already failed on an invalid mode
+		mode, _ := mailgun.UnsubscribeModeOf(listAddress)
+		resp.Removed = mode == mailgun.UnsubscribeDelete
+		withdrawConsent(r, lg, listAddress, memberAddress)
+	}
+	recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: action, List: listAddress, Subject: memberAddress})
+	if subscribe {
+		publishEvent(r, lg, events.Event{Type: events.MemberSubscribed, Actor: user.Actor(), List: listAddress, Member: memberAddress,
+			Data: map[string]string{"source": string(source)}})
+	} else {
+		publishEvent(r, lg, events.Event{Type: events.MemberUnsubscribed, Actor: user.Actor(), List: listAddress, Member: memberAddress})
+	}
+	if err := subscriptions.Clear(listAddress, memberAddress); err != nil {
+		lg.ErrorContext(r.Context(), "failed to clear pause", "list", listAddress, "member", memberAddress, "error", err)
+	}
+	writeJSON(w, r, lg, http.StatusOK, resp)
+}
+
+// requireVerifiedEmail returns ErrForbidden unless the identity provider verified the
+// email of user or support staff acts for it. REQUIRE_EMAIL_VERIFIED=false turns the
+// check off for providers that do not send email_verified.
+func requireVerifiedEmail(user requestValidator.User) error {
+	if user.Machine() || user.EmailVerified || user.ImpersonatedBy != "" || strings.EqualFold(configReader.Value("REQUIRE_EMAIL_VERIFIED"), "false") {
+		return nil
+	}
+	return fmt.Errorf("%w: verify your email address to subscribe", common.ErrForbidden)
+}
+
+// requireOwnEmail returns ErrForbidden unless the identity provider verified the email of
+// user or support staff acts for it. Unlike [requireVerifiedEmail] it ignores
+// REQUIRE_EMAIL_VERIFIED: everything stored about an address is only handed out to, or
+// erased by, its owner.
+func requireOwnEmail(user requestValidator.User) error {
+	if user.EmailVerified || user.ImpersonatedBy != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: verify your email address to access its data", common.ErrForbidden)
+}
+
+// addMember subscribes the member. Users subscribing themselves are named after their
+// token claims; the name of others is not known.
+func addMember(r *http.Request, listAddress, memberAddress string, user requestValidator.User) error {
+	var name string
+	if strings.EqualFold(memberAddress, user.Email) {
+		name = user.FullName()
+	}
+	return subscriptions.Subscribe(r.Context(), listAddress, memberAddress, name)
+}
+
+// suppressionWarnings checks whether Mailgun suppresses deliveries to a new member. The
+// subscription itself succeeded, so a failing check is only logged.
+func suppressionWarnings(r *http.Request, lg *slog.Logger, listAddress, memberAddress string) ([]mailgun.Suppression, []string) {
+	suppressions, err := mailgun.Suppressed(r.Context(), listAddress, memberAddress)
+	if err != nil {
+		lg.WarnContext(r.Context(), "failed to check suppressions", "member", memberAddress, "error", err)
+		return nil, nil
+	}
+	var warnings []string
+	for _, s := range suppressions {
+		warnings = append(warnings, fmt.Sprintf("%s is on the %s suppression list, Mailgun will not deliver messages to it until it is removed", memberAddress, s.Type))
+	}
+	return suppressions, warnings
+}
+
+// writeJSONWithETag encodes v as JSON and tags it with a strong ETag derived from the body.
+// If the request's If-None-Match matches, 304 Not Modified is sent instead of the body.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, lg *slog.Logger, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to encode response: %w", err))
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(append(body, '\n'))
+	if err != nil {
+		lg.ErrorContext(r.Context(), "failed to write response", "error", err)
+	}
+}
+
+// etagMatches implements the weak comparison of If-None-Match (RFC 9110, 13.1.2).
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 func httpError(w http.ResponseWriter, r *http.Request, lg *slog.Logger, err error) {
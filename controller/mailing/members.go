@@ -0,0 +1,349 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/memberVars"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/subscriptions"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MemberPatch changes the profile of a member. Vars are merged into the existing vars;
+// a null value removes a var.
+type MemberPatch struct {
+	Name *string        `json:"name,omitempty" example:"Jane Doe"`
+	Vars map[string]any `json:"vars,omitempty"`
+}
+
+// Member godoc
+// @Summary      Get a member of a list
+// @Description  Returns the profile, custom vars and status (subscribed, unsubscribed or paused) of a member.
+// @Description  Viewers of the list may read all members, other users only themselves.
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list    path      string  true  "List address"
+// @Param        member  path      string  true  "Member email"
+// @Success      200     {object}  mailgun.Member
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Failure      404     {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/members/{member} [get]
+func Member(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listAddress, memberAddress := r.PathValue("list"), r.PathValue("member")
+		if _, ok := requireSelfOr(w, r, lg, listAddress, memberAddress, roles.ViewMembers); !ok {
+			return
+		}
+		member, err := mailgun.GetMember(r.Context(), listAddress, memberAddress)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get member: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, subscriptions.WithStatus(listAddress, member))
+	})
+}
+
+// UpdateMember godoc
+// @Summary      Update a member of a list
+// @Description  Changes the name and custom vars of a member. Vars are validated against the schema of the list
+// @Description  (see GET /v1/lists/{list}/schema); a null value removes a var. Only owners of the list may update others.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list     path      string       true  "List address"
+// @Param        member   path      string       true  "Member email"
+// @Param        request  body      MemberPatch  true  "Changes"
+// @Success      200      {object}  mailgun.Member
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/members/{member} [patch]
+func UpdateMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listAddress, memberAddress := r.PathValue("list"), r.PathValue("member")
+		user, ok := requireSelfOr(w, r, lg, listAddress, memberAddress, roles.ManageMembers)
+		if !ok {
+			return
+		}
+		var patch MemberPatch
+		if err := decodeJSON(w, r, &patch); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+
+		member, err := mailgun.GetMember(r.Context(), listAddress, memberAddress)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get member: %w", err))
+			return
+		}
+		// Without vars in the patch the vars are left as they are
+		var vars map[string]any
+		if patch.Vars != nil {
+			schema, err := memberVars.Get(listAddress)
+			if err != nil {
+				httpError(w, r, lg, fmt.Errorf("failed to get schema: %w", err))
+				return
+			}
+			if vars, err = schema.Apply(member.Vars, patch.Vars); err != nil {
+				httpError(w, r, lg, err)
+				return
+			}
+		}
+		var name string
+		if patch.Name != nil {
+			if name = strings.TrimSpace(*patch.Name); name == "" {
+				httpErrorBadRequest(w, r, lg, fmt.Errorf("name must not be empty"))
+				return
+			}
+		}
+
+		member, err = mailgun.UpdateMember(r.Context(), listAddress, memberAddress, name, vars)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to update member: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "update_member", List: listAddress, Subject: memberAddress})
+		publishEvent(r, lg, events.Event{Type: events.MemberUpdated, Actor: user.Actor(), List: listAddress, Member: memberAddress})
+		writeJSON(w, r, lg, http.StatusOK, subscriptions.WithStatus(listAddress, member))
+	})
+}
+
+// PauseRequest pauses a membership until a date.
+type PauseRequest struct {
+	Until time.Time `json:"until" example:"2026-12-01T00:00:00Z"`
+}
+
+// PauseMember godoc
+// @Summary      Pause a membership
+// @Description  Stops deliveries to a subscribed member until the given time, when the member is subscribed again
+// @Description  automatically. Pausing a paused member moves the end of the pause. Only owners of the list may pause others.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list     path      string        true  "List address"
+// @Param        member   path      string        true  "Member email"
+// @Param        request  body      PauseRequest  true  "End of the pause"
+// @Success      200      {object}  mailgun.Member
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Failure      409      {string}  string  "Conflict"
+// @Router       /v1/lists/{list}/members/{member}/pause [put]
+func PauseMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listAddress, memberAddress := r.PathValue("list"), r.PathValue("member")
+		user, ok := requireSelfOr(w, r, lg, listAddress, memberAddress, roles.ManageMembers)
+		if !ok {
+			return
+		}
+		var req PauseRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		member, err := subscriptions.PauseUntil(r.Context(), listAddress, memberAddress, req.Until)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to pause member: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "pause", List: listAddress, Subject: memberAddress,
+			Details: map[string]string{"until": req.Until.UTC().Format(time.RFC3339)}})
+		publishEvent(r, lg, events.Event{Type: events.MemberPaused, Actor: user.Actor(), List: listAddress, Member: memberAddress,
+			Data: map[string]string{"until": req.Until.UTC().Format(time.RFC3339)}})
+		writeJSON(w, r, lg, http.StatusOK, member)
+	})
+}
+
+// ResumeMember godoc
+// @Summary      End a pause
+// @Description  Subscribes a paused member again now. Only owners of the list may resume others.
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list    path      string  true  "List address"
+// @Param        member  path      string  true  "Member email"
+// @Success      200     {object}  mailgun.Member
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Failure      404     {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/members/{member}/pause [delete]
+func ResumeMember(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listAddress, memberAddress := r.PathValue("list"), r.PathValue("member")
+		user, ok := requireSelfOr(w, r, lg, listAddress, memberAddress, roles.ManageMembers)
+		if !ok {
+			return
+		}
+		member, err := subscriptions.Resume(r.Context(), listAddress, memberAddress)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to resume member: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "resume", List: listAddress, Subject: memberAddress})
+		publishEvent(r, lg, events.Event{Type: events.MemberResumed, Actor: user.Actor(), List: listAddress, Member: memberAddress})
+		writeJSON(w, r, lg, http.StatusOK, member)
+	})
+}
+
+// DeliveryRequest chooses how a member receives the messages of a list.
+type DeliveryRequest struct {
+	Delivery string `json:"delivery" example:"weekly" enums:"immediate,daily,weekly"`
+}
+
+// SetDelivery godoc
+// @Summary      Choose immediate delivery or digests
+// @Description  Switches a subscribed member between receiving every message (immediate) and a daily or weekly digest
+// @Description  of the messages sent to the list. Only owners of the list may change others.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list     path      string           true  "List address"
+// @Param        member   path      string           true  "Member email"
+// @Param        request  body      DeliveryRequest  true  "Delivery mode"
+// @Success      200      {object}  mailgun.Member
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Failure      409      {string}  string  "Conflict"
+// @Router       /v1/lists/{list}/members/{member}/delivery [put]
+func SetDelivery(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listAddress, memberAddress := r.PathValue("list"), r.PathValue("member")
+		user, ok := requireSelfOr(w, r, lg, listAddress, memberAddress, roles.ManageMembers)
+		if !ok {
+			return
+		}
+		var req DeliveryRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		delivery, err := mailgun.ParseDelivery(req.Delivery)
+		if err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		member, err := mailgun.SetDelivery(r.Context(), listAddress, memberAddress, delivery)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to set delivery: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "set_delivery", List: listAddress, Subject: memberAddress,
+			Details: map[string]string{"delivery": string(delivery)}})
+		publishEvent(r, lg, events.Event{Type: events.MemberDeliveryChanged, Actor: user.Actor(), List: listAddress, Member: memberAddress,
+			Data: map[string]string{"delivery": string(delivery)}})
+		writeJSON(w, r, lg, http.StatusOK, member)
+	})
+}
+
+// MemberSchema godoc
+// @Summary      Get the member vars schema of a list
+// @Description  Returns the custom vars members of the list can set. Lists without a schema have no fields. Hidden
+// @Description  lists are only found for admins and users with a role in them.
+// @Tags         mailing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list  path      string  true  "List address"
+// @Success      200   {object}  memberVars.Schema
+// @Failure      401   {string}  string  "Unauthorized"
+// @Failure      404   {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/schema [get]
+func MemberSchema(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		listAddress := r.PathValue("list")
+		list, err := mailgun.List(r.Context(), listAddress, seesHidden(user, listAddress))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
+			return
+		}
+		schema, err := memberVars.Get(list.Address)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get schema: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, schema)
+	})
+}
+
+// UpdateMemberSchema godoc
+// @Summary      Replace the member vars schema of a list
+// @Description  Defines the custom vars members of the list can set. Existing vars are validated on their next change.
+// @Description  Owners of the list only.
+// @Tags         mailing
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list     path      string             true  "List address"
+// @Param        request  body      memberVars.Schema  true  "Schema"
+// @Success      200      {object}  memberVars.Schema
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/schema [put]
+func UpdateMemberSchema(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authorize(w, r, lg, r.PathValue("list"), roles.ManageList)
+		if !ok {
+			return
+		}
+		var schema memberVars.Schema
+		if err := decodeJSON(w, r, &schema); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		listAddress := r.PathValue("list")
+		list, err := mailgun.List(r.Context(), listAddress, seesHidden(user, listAddress))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
+			return
+		}
+		schema, err = memberVars.Put(list.Address, schema)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to store schema: %w", err))
+			return
+		}
+		publishEvent(r, lg, events.Event{Type: events.ListUpdated, Actor: user.Actor(), List: list.Address,
+			Data: map[string]string{"change": "schema"}})
+		writeJSON(w, r, lg, http.StatusOK, schema)
+	})
+}
+
+// seesHidden reports whether user may see listAddress if it is hidden: admins and users
+// with a role in the list do.
+func seesHidden(user requestValidator.User, listAddress string) bool {
+	return roles.Can(user, listAddress, roles.ViewMembers)
+}
+
+// requireSelfOr answers the request with 401/403 unless the authenticated user is
+// memberAddress or has perm in listAddress.
+func requireSelfOr(w http.ResponseWriter, r *http.Request, lg *slog.Logger, listAddress, memberAddress string, perm roles.Permission) (requestValidator.User, bool) {
+	user, ok := currentUser(w, r, lg)
+	if !ok {
+		return user, false
+	}
+	if !strings.EqualFold(memberAddress, user.Email) && !roles.Can(user, listAddress, perm) {
+		httpError(w, r, lg, fmt.Errorf("%w: only admins and list owners can access other members", common.ErrForbidden))
+		return user, false
+	}
+	return user, true
+}
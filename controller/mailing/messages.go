@@ -0,0 +1,202 @@
+package mailing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/templates"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxMessageSize is the maximum message size accepted by Mailgun.
+const maxMessageSize = 25 << 20
+
+// SendMessageResponse is returned after a message has been queued by Mailgun.
+type SendMessageResponse struct {
+	ID string `json:"id" example:"<20251019120000.1.ABCDEF@mg.example.com>"`
+}
+
+// SendMessage godoc
+// @Summary      Send a message to a list
+// @Description  Sends a message to all members of the list. Only owners of the list may send messages.
+// @Description  If template is given, subject and bodies are rendered from the stored template with variables.
+// @Tags         messages
+// @Accept       multipart/form-data
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list        path      string  true   "List address"
+// @Param        subject     formData  string  false  "Subject, required without template"
+// @Param        text        formData  string  false  "Plain text body"
+// @Param        html        formData  string  false  "HTML body"
+// @Param        reply_to    formData  string  false  "Reply-To address"
+// @Param        tag         formData  []string  false  "Mailgun tags" collectionFormat(multi)
+// @Param        attachment  formData  file    false  "Attachments"
+// @Param        template    formData  string  false  "Template ID"
+// @Param        variables   formData  string  false  "Template variables as JSON object"
+// @Param        send_at     formData  string  false  "Schedule the message for this time (RFC 3339)"
+// @Param        Idempotency-Key  header  string  false  "Deduplicates scheduled messages of the list"
+// @Success      200         {object}  SendMessageResponse
+// @Success      202         {object}  scheduler.Job
+// @Failure      400         {string}  string  "Bad Request"
+// @Failure      401         {string}  string  "Unauthorized"
+// @Failure      403         {string}  string  "Forbidden"
+// @Failure      404         {string}  string  "Not Found"
+// @Failure      409         {string}  string  "Idempotency-Key reused for another message"
+// @Router       /v1/lists/{list}/messages [post]
+func SendMessage(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorize(w, r, lg, r.PathValue("list"), roles.SendMessages); !ok {
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
+		err := r.ParseMultipartForm(maxMessageSize)
+		if errors.Is(err, http.ErrNotMultipart) {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to parse form: %w", err))
+			return
+		}
+
+		msg := mailgun.Message{
+			Subject: r.FormValue("subject"),
+			Text:    r.FormValue("text"),
+			HTML:    r.FormValue("html"),
+			ReplyTo: r.FormValue("reply_to"),
+			Tags:    r.Form["tag"],
+		}
+		if id := r.FormValue("template"); id != "" {
+			rendered, err := renderTemplate(id, r.FormValue("variables"))
+			if err != nil {
+				httpError(w, r, lg, err)
+				return
+			}
+			msg.Subject, msg.Text, msg.HTML = rendered.Subject, rendered.Text, rendered.HTML
+		}
+		if r.MultipartForm != nil {
+			for _, fh := range r.MultipartForm.File["attachment"] {
+				f, err := fh.Open()
+				if err != nil {
+					httpErrorBadRequest(w, r, lg, fmt.Errorf("failed to read attachment: %w", err))
+					return
+				}
+				// Sending closes the attachments too, but not if it fails before
+				defer f.Close()
+				msg.Attachments = append(msg.Attachments, mailgun.Attachment{Filename: fh.Filename, Content: f})
+			}
+		}
+
+		if sendAt := r.FormValue("send_at"); sendAt != "" {
+			scheduleMessage(w, r, lg, sendAt, msg)
+			return
+		}
+
+		id, err := mailgun.SendToList(r.Context(), r.PathValue("list"), msg)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to send message: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, SendMessageResponse{ID: id})
+	})
+}
+
+// scheduleMessage persists msg as scheduler job instead of sending it right away.
+func scheduleMessage(w http.ResponseWriter, r *http.Request, lg *slog.Logger, sendAt string, msg mailgun.Message) {
+	runAt, err := time.Parse(time.RFC3339, sendAt)
+	if err != nil {
+		httpErrorBadRequest(w, r, lg, fmt.Errorf("invalid send_at, expected RFC 3339: %w", err))
+		return
+	}
+	listAddress := r.PathValue("list")
+	// Fail early instead of when the job runs
+	if _, err := mailgun.List(r.Context(), listAddress, true); err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
+		return
+	}
+	scheduled, err := mailgun.NewScheduledMessage(listAddress, msg)
+	if err != nil {
+		httpErrorBadRequest(w, r, lg, err)
+		return
+	}
+	// Keys of clients must not match the jobs of other lists or job types
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		key = fmt.Sprintf("%s:%s:%s", mailgun.SendJob, strings.ToLower(listAddress), key)
+	}
+	job, err := scheduler.Schedule(mailgun.SendJob, runAt, scheduled, key)
+	if err != nil {
+		httpError(w, r, lg, fmt.Errorf("failed to schedule message: %w", err))
+		return
+	}
+	writeJSON(w, r, lg, http.StatusAccepted, job)
+}
+
+// renderTemplate renders the stored template id with the variables given as JSON object.
+func renderTemplate(id, variables string) (templates.Rendered, error) {
+	t, err := templates.Get(id)
+	if err != nil {
+		return templates.Rendered{}, fmt.Errorf("failed to get template: %w", err)
+	}
+	vars := map[string]string{}
+	if variables != "" {
+		if err := json.Unmarshal([]byte(variables), &vars); err != nil {
+			return templates.Rendered{}, fmt.Errorf("%w: invalid variables: %w", common.ErrBadRequest, err)
+		}
+	}
+	rendered, err := templates.Render(t, vars)
+	if err != nil {
+		return templates.Rendered{}, fmt.Errorf("failed to render template: %w", err)
+	}
+	return rendered, nil
+}
+
+// currentUser returns the authenticated user, or the user it impersonates on the /me
+// routes, or answers the request with 401.
+func currentUser(w http.ResponseWriter, r *http.Request, lg *slog.Logger) (requestValidator.User, bool) {
+	claims, err := requestValidator.ClaimsFromRequest(r)
+	if err != nil {
+		httpErrorUnauthorized(w, r, lg, err)
+		return requestValidator.User{}, false
+	}
+	user, err := requestValidator.CurrentUser(claims)
+	if err != nil {
+		httpErrorUnauthorized(w, r, lg, err)
+		return requestValidator.User{}, false
+	}
+	if email := requestValidator.ActingAs(r.Context()); email != "" {
+		user = user.ActAs(email)
+	}
+	return user, true
+}
+
+// requireAdmin answers the request with 401/403 unless the authenticated user is an admin.
+func requireAdmin(w http.ResponseWriter, r *http.Request, lg *slog.Logger) (requestValidator.User, bool) {
+	return authorize(w, r, lg, "", roles.Administer)
+}
+
+// authorize answers the request with 401/403 unless the authenticated user has perm in
+// list.
+func authorize(w http.ResponseWriter, r *http.Request, lg *slog.Logger, list string, perm roles.Permission) (requestValidator.User, bool) {
+	user, ok := currentUser(w, r, lg)
+	if !ok {
+		return user, false
+	}
+	if !roles.Can(user, list, perm) {
+		if list == "" {
+			httpError(w, r, lg, fmt.Errorf("%w: admin permissions required", common.ErrForbidden))
+		} else {
+			httpError(w, r, lg, fmt.Errorf("%w: %s permission on %s required", common.ErrForbidden, perm, list))
+		}
+		return user, false
+	}
+	return user, true
+}
@@ -0,0 +1,140 @@
+package mailing
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/subscriptions"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// PreferencesRequest is the complete set of lists the user wants to be subscribed to.
+type PreferencesRequest struct {
+	Subscribed []string `json:"subscribed" example:"news@example.com,events@example.com"`
+}
+
+// PreferencesResponse reports the outcome of saving the preferences per list.
+type PreferencesResponse struct {
+	Applied bool                       `json:"applied"`
+	Results []subscriptions.ListResult `json:"results"`
+}
+
+// Preferences godoc
+// @Summary      Get my subscriptions
+// @Description  Returns the membership of the current user in every visible list.
+// @Tags         me
+// @Produce      json
+// @Security     BearerAuth
+// @Param        X-Act-As  header    string  false  "Act as this user (impersonate permission)"
+// @Success      200       {array}   subscriptions.ListPreference
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Router       /v1/me/preferences [get]
+func Preferences(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		preferences, err := subscriptions.Preferences(r.Context(), user.Email)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get preferences: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, preferences)
+	})
+}
+
+// SavePreferences godoc
+// @Summary      Save my subscriptions
+// @Description  Subscribes the current user to exactly the given visible lists and unsubscribes from all others.
+// @Description  Memberships of hidden lists are not changed. If a change fails, the changes applied so far are
+// @Description  rolled back and 502 is returned with the outcome of every list. Joining a list requires a verified
+// @Description  email address; its consent is recorded before subscribing, and if that fails nothing is changed.
+// @Tags         me
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request   body      PreferencesRequest  true   "Lists to be subscribed to"
+// @Param        X-Act-As  header    string              false  "Act as this user (impersonate permission)"
+// @Success      200       {object}  PreferencesResponse
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      502       {object}  PreferencesResponse
+// @Router       /v1/me/preferences [put]
+func SavePreferences(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		var req PreferencesRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		if err := requireVerifiedEmail(user); err != nil {
+			// Unverified users may keep and leave their lists but not join new ones
+			current, perr := subscriptions.Preferences(r.Context(), user.Email)
+			if perr != nil {
+				httpError(w, r, lg, fmt.Errorf("failed to get preferences: %w", perr))
+				return
+			}
+			for _, list := range req.Subscribed {
+				if !slices.ContainsFunc(current, func(p subscriptions.ListPreference) bool { return strings.EqualFold(p.List, list) && p.Subscribed }) {
+					httpError(w, r, lg, err)
+					return
+				}
+			}
+		}
+		source := consent.SourceSelf
+		if user.ImpersonatedBy != "" {
+			source = consent.SourceAdmin
+		}
+		// Consents are recorded before subscribing and discarded if the change does not last
+		consents := map[string]consent.Record{}
+		results, err := subscriptions.SavePreferences(r.Context(), user.Email, user.FullName(), req.Subscribed, func(list string) error {
+			c, err := recordConsent(r, list, user.Email, source)
+			if err != nil {
+				return fmt.Errorf("failed to record consent: %w", err)
+			}
+			consents[list] = c
+			return nil
+		})
+		for _, result := range results {
+			if c, ok := consents[result.List]; ok && result.Outcome != subscriptions.OutcomeApplied {
+				discardConsent(r, lg, c)
+			}
+		}
+		if errors.Is(err, subscriptions.ErrNotApplied) {
+			// Mailgun failed; report what was rolled back
+			lg.ErrorContext(r.Context(), "failed to save preferences", "user", user.Email, "error", err)
+			writeJSON(w, r, lg, http.StatusBadGateway, PreferencesResponse{Applied: false, Results: results})
+			return
+		}
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to save preferences: %w", err))
+			return
+		}
+		for _, result := range results {
+			if result.Outcome == subscriptions.OutcomeApplied {
+				recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: result.Action, List: result.List, Subject: user.Email,
+					Details: map[string]string{"source": "preferences"}})
+				e := events.Event{Type: events.MemberSubscribed, Actor: user.Actor(), List: result.List, Member: user.Email,
+					Data: map[string]string{"source": "preferences"}}
+				if result.Action == "unsubscribe" {
+					withdrawConsent(r, lg, result.List, user.Email)
+					e.Type = events.MemberUnsubscribed
+				}
+				publishEvent(r, lg, e)
+			}
+		}
+		writeJSON(w, r, lg, http.StatusOK, PreferencesResponse{Applied: true, Results: results})
+	})
+}
@@ -0,0 +1,149 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/roles"
+	"net/http"
+)
+
+// RoleRequest grants a list role.
+type RoleRequest struct {
+	Role roles.Role `json:"role" example:"list-moderator"`
+}
+
+// MyRolesResponse are the roles of the current user.
+type MyRolesResponse struct {
+	// Admin users have every role in every list.
+	Admin bool `json:"admin"`
+	// Lists maps list addresses to the role of the user, from Keycloak groups and grants.
+	Lists map[string]roles.Role `json:"lists"`
+}
+
+// MyRoles godoc
+// @Summary      Get my roles
+// @Description  Returns whether the current user is an admin and its role in each list it has one in.
+// @Tags         me
+// @Produce      json
+// @Security     BearerAuth
+// @Param        X-Act-As  header    string  false  "Act as this user (impersonate permission)"
+// @Success      200       {object}  MyRolesResponse
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Router       /v1/me/roles [get]
+func MyRoles(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		lists, err := roles.Effective(user)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get roles: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, MyRolesResponse{Admin: user.Admin, Lists: lists})
+	})
+}
+
+// ListRoles godoc
+// @Summary      List the role grants of a list
+// @Description  Returns the roles granted in the list by this service. Roles derived from Keycloak groups are not
+// @Description  included. Admin only.
+// @Tags         roles
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list  path      string  true  "List address"
+// @Success      200   {array}   roles.Grant
+// @Failure      401   {string}  string  "Unauthorized"
+// @Failure      403   {string}  string  "Forbidden"
+// @Router       /v1/lists/{list}/roles [get]
+func ListRoles(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := r.PathValue("list")
+		if _, ok := authorize(w, r, lg, list, roles.ManageRoles); !ok {
+			return
+		}
+		grants, err := roles.ForList(list)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list roles: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, grants)
+	})
+}
+
+// GrantRole godoc
+// @Summary      Grant a list role
+// @Description  Gives the member the role viewer, list-moderator or list-owner in the list, replacing its previous
+// @Description  grant there. Admin only.
+// @Tags         roles
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list     path      string       true  "List address"
+// @Param        member   path      string       true  "Member email"
+// @Param        request  body      RoleRequest  true  "Role"
+// @Success      200      {object}  roles.Grant
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/roles/{member} [put]
+func GrantRole(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authorize(w, r, lg, r.PathValue("list"), roles.ManageRoles)
+		if !ok {
+			return
+		}
+		var req RoleRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		list, err := mailgun.List(r.Context(), r.PathValue("list"), true)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
+			return
+		}
+		g, err := roles.Put(list.Address, r.PathValue("member"), req.Role, user.Actor())
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to grant role: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "grant_role", List: g.List, Subject: g.Member,
+			Details: map[string]string{"role": string(g.Role)}})
+		writeJSON(w, r, lg, http.StatusOK, g)
+	})
+}
+
+// RevokeRole godoc
+// @Summary      Revoke a list role
+// @Description  Removes the role granted to the member in the list. Roles from Keycloak groups are not affected.
+// @Description  Admin only.
+// @Tags         roles
+// @Security     BearerAuth
+// @Param        list    path      string  true  "List address"
+// @Param        member  path      string  true  "Member email"
+// @Success      204
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Failure      404     {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/roles/{member} [delete]
+func RevokeRole(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, member := r.PathValue("list"), r.PathValue("member")
+		user, ok := authorize(w, r, lg, list, roles.ManageRoles)
+		if !ok {
+			return
+		}
+		if err := roles.Delete(list, member); err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to revoke role: %w", err))
+			return
+		}
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "revoke_role", List: list, Subject: member})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
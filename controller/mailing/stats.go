@@ -0,0 +1,77 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/analytics"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/roles"
+	"net/http"
+	"time"
+)
+
+// ListStats godoc
+// @Summary      Get delivery statistics of a list
+// @Description  Returns delivered, opened, clicked, bounced, complained and unsubscribed counts of the messages sent to a list
+// @Description  as totals and as a series of time buckets. The counts come from the periodically synced Mailgun events,
+// @Description  `synced_until` is the time of the latest event included. Viewers of the list only.
+// @Tags         lists
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list      path      string  true   "Mailing list address"
+// @Param        tag       query     string  false  "Only count messages with this tag"
+// @Param        from      query     string  false  "Start (RFC3339), defaults to 30 days ago"
+// @Param        to        query     string  false  "End (RFC3339), defaults to now"
+// @Param        interval  query     string  false  "Bucket size (hour or day), defaults to day"
+// @Success      200       {object}  analytics.Stats
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      404       {string}  string  "Not Found"
+// @Router       /v1/lists/{list}/stats [get]
+func ListStats(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorize(w, r, lg, r.PathValue("list"), roles.ViewMembers); !ok {
+			return
+		}
+		q := r.URL.Query()
+		to, err := timeParam(q.Get("to"), time.Now())
+		if err != nil {
+			httpErrorBadRequest(w, r, lg, err)
+			return
+		}
+		from, err := timeParam(q.Get("from"), to.AddDate(0, 0, -30))
+		if err != nil {
+			httpErrorBadRequest(w, r, lg, err)
+			return
+		}
+		interval := q.Get("interval")
+		if interval == "" {
+			interval = "day"
+		}
+
+		list, err := mailgun.List(r.Context(), r.PathValue("list"), true)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get list: %w", err))
+			return
+		}
+		stats, err := analytics.Query(list.Address, q.Get("tag"), from, to, interval)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to query stats: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, stats)
+	})
+}
+
+// timeParam parses an RFC3339 query parameter, returning def if it is empty.
+func timeParam(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339", v)
+	}
+	return t, nil
+}
@@ -0,0 +1,119 @@
+package mailing
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventStream godoc
+// @Summary      Stream membership and list changes
+// @Description  Pushes events (member.subscribed, member.unsubscribed, list.updated, ...) as Server-Sent Events.
+// @Description  Every message has the event ID as id and the event as JSON data. Admins receive all events, viewers
+// @Description  (and higher roles) those of their lists and other users those about themselves. After a reconnect the
+// @Description  Last-Event-ID header resumes the stream from the buffer of recent events; if events were dropped from
+// @Description  the buffer in between, a "reset" event is sent first and the client should reload its state.
+// @Tags         events
+// @Produce      text/event-stream
+// @Security     BearerAuth
+// @Param        Last-Event-ID  header    string  false  "ID of the last event received"
+// @Success      200            {object}  events.Event
+// @Failure      401            {string}  string  "Unauthorized"
+// @Router       /v1/events/stream [get]
+func EventStream(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		// Listen before reading the buffer, so that no event is missed in between
+		live, stop := events.Listen()
+		defer stop()
+
+		var backlog []events.Event
+		complete := true
+		var last uint64
+		if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+			var err error
+			backlog, complete, err = events.Since(lastID)
+			if err != nil {
+				httpError(w, r, lg, fmt.Errorf("failed to read events: %w", err))
+				return
+			}
+			last, _ = strconv.ParseUint(lastID, 10, 64)
+			if !complete {
+				last = 0
+			}
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 5000\n\n")
+		if !complete {
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+		send := func(e events.Event) error {
+			seq, _ := strconv.ParseUint(e.ID, 10, 64)
+			if seq <= last || !canSee(user, e) {
+				return nil
+			}
+			last = seq
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", e.ID, data)
+			return err
+		}
+		for _, e := range backlog {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			lg.ErrorContext(r.Context(), "streaming is not supported", "error", err)
+			return
+		}
+
+		keepalive := time.NewTicker(configReader.Duration("EVENTS_KEEPALIVE", 25*time.Second))
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-live:
+				if !ok {
+					// Fell behind; the client reconnects with Last-Event-ID
+					return
+				}
+				if err := send(e); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// canSee reports whether user may receive e: admins receive all events, viewers the
+// events of their lists and everybody the events about themselves.
+func canSee(user requestValidator.User, e events.Event) bool {
+	return roles.Can(user, e.List, roles.ViewMembers) || strings.EqualFold(e.Member, user.Email)
+}
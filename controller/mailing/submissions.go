@@ -0,0 +1,209 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/moderation"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// SubmissionRequest is a draft message submitted to a moderated list.
+type SubmissionRequest struct {
+	Subject string `json:"subject" example:"Meetup next week"`
+	Text    string `json:"text,omitempty"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// DecisionRequest carries the reason of a moderation decision.
+type DecisionRequest struct {
+	Reason string `json:"reason" example:"Off topic"`
+}
+
+// Submit godoc
+// @Summary      Submit a message for moderation
+// @Description  Members of a moderated list submit a draft which is sent once a moderator approves it. Users only.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list        path      string             true  "List address"
+// @Param        submission  body      SubmissionRequest  true  "Draft"
+// @Success      201         {object}  moderation.Submission
+// @Failure      400         {string}  string  "Bad Request"
+// @Failure      401         {string}  string  "Unauthorized"
+// @Failure      403         {string}  string  "Forbidden"
+// @Router       /v1/lists/{list}/submissions [post]
+func Submit(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		var req SubmissionRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		s, err := moderation.Submit(r.Context(), moderation.Submission{
+			List:           r.PathValue("list"),
+			SubmitterEmail: user.Email,
+			SubmitterName:  strings.TrimSpace(user.Name + " " + user.LastName),
+			Subject:        req.Subject,
+			Text:           req.Text,
+			HTML:           req.HTML,
+		})
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to submit: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusCreated, s)
+	})
+}
+
+// Submissions godoc
+// @Summary      List submissions
+// @Description  Returns the moderation queue of all lists the caller moderates and the caller's own submissions.
+// @Tags         moderation
+// @Produce      json
+// @Security     BearerAuth
+// @Param        list    query     string  false  "Filter by list address"
+// @Param        status  query     string  false  "Filter by status (pending, approved, rejected)"
+// @Success      200     {array}   moderation.Submission
+// @Failure      401     {string}  string  "Unauthorized"
+// @Router       /v1/submissions [get]
+func Submissions(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		all, err := moderation.List(r.URL.Query().Get("list"), moderation.Status(r.URL.Query().Get("status")))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list submissions: %w", err))
+			return
+		}
+		visible := slices.DeleteFunc(all, func(s moderation.Submission) bool { return !canView(user, s) })
+		if visible == nil {
+			visible = []moderation.Submission{}
+		}
+		writeJSON(w, r, lg, http.StatusOK, visible)
+	})
+}
+
+// Submission godoc
+// @Summary      Get a submission
+// @Tags         moderation
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Submission ID"
+// @Success      200  {object}  moderation.Submission
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/submissions/{id} [get]
+func Submission(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		s, err := moderation.Get(r.PathValue("id"))
+		if err == nil && !canView(user, s) {
+			// Do not reveal submissions of other lists
+			err = common.ErrNotFound
+		}
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get submission: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, s)
+	})
+}
+
+// ApproveSubmission godoc
+// @Summary      Approve a submission
+// @Description  Sends the submission to its list and notifies the submitter. Moderators of the list only.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id        path      string           true   "Submission ID"
+// @Param        decision  body      DecisionRequest  false  "Optional reason"
+// @Success      200       {object}  moderation.Submission
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      404       {string}  string  "Not Found"
+// @Failure      409       {string}  string  "Conflict"
+// @Router       /v1/submissions/{id}/approve [post]
+func ApproveSubmission(lg *slog.Logger) http.Handler {
+	return decideSubmission(lg, moderation.StatusApproved)
+}
+
+// RejectSubmission godoc
+// @Summary      Reject a submission
+// @Description  Rejects the submission with a reason and notifies the submitter. Moderators of the list only.
+// @Tags         moderation
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id        path      string           true  "Submission ID"
+// @Param        decision  body      DecisionRequest  true  "Reason"
+// @Success      200       {object}  moderation.Submission
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      404       {string}  string  "Not Found"
+// @Failure      409       {string}  string  "Conflict"
+// @Router       /v1/submissions/{id}/reject [post]
+func RejectSubmission(lg *slog.Logger) http.Handler {
+	return decideSubmission(lg, moderation.StatusRejected)
+}
+
+func decideSubmission(lg *slog.Logger, status moderation.Status) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, lg)
+		if !ok {
+			return
+		}
+		var req DecisionRequest
+		if r.ContentLength != 0 {
+			if err := decodeJSON(w, r, &req); err != nil {
+				httpError(w, r, lg, err)
+				return
+			}
+		}
+		s, err := moderation.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get submission: %w", err))
+			return
+		}
+		if !roles.Can(user, s.List, roles.Moderate) {
+			httpError(w, r, lg, fmt.Errorf("%w: only moderators of %s can decide", common.ErrForbidden, s.List))
+			return
+		}
+
+		if status == moderation.StatusApproved {
+			s, err = moderation.Approve(r.Context(), s.ID, user.Actor(), req.Reason)
+		} else {
+			s, err = moderation.Reject(s.ID, user.Actor(), req.Reason)
+		}
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to decide submission: %w", err))
+			return
+		}
+
+		// The decision stands even if the submitter cannot be notified
+		if err := moderation.Notify(r.Context(), s); err != nil {
+			lg.ErrorContext(r.Context(), "failed to notify submitter", "submission", s.ID, "error", err)
+		}
+		writeJSON(w, r, lg, http.StatusOK, s)
+	})
+}
+
+func canView(user requestValidator.User, s moderation.Submission) bool {
+	return roles.Can(user, s.List, roles.Moderate) || strings.EqualFold(user.Email, s.SubmitterEmail)
+}
@@ -0,0 +1,90 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/mailgun"
+	"net/http"
+)
+
+// Suppressions godoc
+// @Summary      List suppressed addresses
+// @Description  Returns the entries of Mailgun's bounce, complaint and unsubscribe suppression lists of the sending
+// @Description  domain. Mailgun does not deliver to these addresses, even if they are subscribed. Admin only.
+// @Tags         suppressions
+// @Produce      json
+// @Security     BearerAuth
+// @Param        type  query     string  false  "Only this list (bounces, complaints or unsubscribes)"
+// @Param        q     query     string  false  "Only addresses containing this text"
+// @Success      200   {array}   mailgun.Suppression
+// @Failure      400   {string}  string  "Bad Request"
+// @Failure      401   {string}  string  "Unauthorized"
+// @Failure      403   {string}  string  "Forbidden"
+// @Router       /v1/suppressions [get]
+func Suppressions(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		types := mailgun.SuppressionTypes
+		if t := r.URL.Query().Get("type"); t != "" {
+			st, err := mailgun.ParseSuppressionType(t)
+			if err != nil {
+				httpError(w, r, lg, err)
+				return
+			}
+			types = []mailgun.SuppressionType{st}
+		}
+
+		result := []mailgun.Suppression{}
+		for _, t := range types {
+			suppressions, err := mailgun.Suppressions(r.Context(), t, r.URL.Query().Get("q"))
+			if err != nil {
+				httpError(w, r, lg, fmt.Errorf("failed to get suppressions: %w", err))
+				return
+			}
+			result = append(result, suppressions...)
+		}
+		writeJSON(w, r, lg, http.StatusOK, result)
+	})
+}
+
+// DeleteSuppression godoc
+// @Summary      Remove a suppressed address
+// @Description  Removes the address from a suppression list so that Mailgun delivers to it again. Admin only.
+// @Tags         suppressions
+// @Security     BearerAuth
+// @Param        type     path  string  true  "Suppression list (bounces, complaints or unsubscribes)"
+// @Param        address  path  string  true  "Email address"
+// @Success      204
+// @Failure      400  {string}  string  "Bad Request"
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/suppressions/{type}/{address} [delete]
+func DeleteSuppression(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		t, err := mailgun.ParseSuppressionType(r.PathValue("type"))
+		if err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		address := r.PathValue("address")
+		if err := mailgun.RemoveSuppression(r.Context(), t, address); err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to remove suppression: %w", err))
+			return
+		}
+		lg.InfoContext(r.Context(), "suppression removed", "type", t, "address", address, "by", user.Actor())
+		recordAudit(r, lg, audit.Entry{Actor: user.Actor(), Action: "remove_suppression", Subject: address,
+			Details: map[string]string{"type": string(t)}})
+		publishEvent(r, lg, events.Event{Type: events.SuppressionRemoved, Actor: user.Actor(), Member: address,
+			Data: map[string]string{"type": string(t)}})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
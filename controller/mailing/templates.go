@@ -0,0 +1,218 @@
+package mailing
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/templates"
+	"net/http"
+)
+
+// maxJSONBodySize limits JSON request bodies.
+const maxJSONBodySize = 1 << 20
+
+// PreviewRequest holds the sample data a template is rendered with.
+type PreviewRequest struct {
+	Variables map[string]string `json:"variables"`
+	Recipient map[string]string `json:"recipient"`
+}
+
+// Templates godoc
+// @Summary      List templates
+// @Description  Returns all stored message templates. Admin only.
+// @Tags         templates
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   templates.Template
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Router       /v1/templates [get]
+func Templates(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		list, err := templates.List()
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list templates: %w", err))
+			return
+		}
+		if list == nil {
+			list = []templates.Template{}
+		}
+		writeJSON(w, r, lg, http.StatusOK, list)
+	})
+}
+
+// Template godoc
+// @Summary      Get a template
+// @Tags         templates
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Template ID"
+// @Success      200  {object}  templates.Template
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/templates/{id} [get]
+func Template(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		t, err := templates.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get template: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, t)
+	})
+}
+
+// CreateTemplate godoc
+// @Summary      Create a template
+// @Description  Stores a new template. Subject and text use text/template, html uses html/template syntax.
+// @Tags         templates
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        template  body      templates.Template  true  "Template"
+// @Success      201       {object}  templates.Template
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Router       /v1/templates [post]
+func CreateTemplate(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		var t templates.Template
+		if err := decodeJSON(w, r, &t); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		t, err := templates.Create(t)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to create template: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusCreated, t)
+	})
+}
+
+// UpdateTemplate godoc
+// @Summary      Update a template
+// @Tags         templates
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id        path      string              true  "Template ID"
+// @Param        template  body      templates.Template  true  "Template"
+// @Success      200       {object}  templates.Template
+// @Failure      400       {string}  string  "Bad Request"
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      404       {string}  string  "Not Found"
+// @Router       /v1/templates/{id} [put]
+func UpdateTemplate(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		var t templates.Template
+		if err := decodeJSON(w, r, &t); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		t, err := templates.Update(r.PathValue("id"), t)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to update template: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, t)
+	})
+}
+
+// DeleteTemplate godoc
+// @Summary      Delete a template
+// @Tags         templates
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Template ID"
+// @Success      204  {string}  string  "No Content"
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/templates/{id} [delete]
+func DeleteTemplate(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		if err := templates.Delete(r.PathValue("id")); err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to delete template: %w", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// PreviewTemplate godoc
+// @Summary      Preview a template
+// @Description  Renders the template with the given variables and recipient values. Missing variables fall back to their samples.
+// @Tags         templates
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string          true   "Template ID"
+// @Param        request  body      PreviewRequest  false  "Sample data"
+// @Success      200      {object}  templates.Rendered
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Failure      404      {string}  string  "Not Found"
+// @Router       /v1/templates/{id}/preview [post]
+func PreviewTemplate(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		var req PreviewRequest
+		if r.ContentLength != 0 {
+			if err := decodeJSON(w, r, &req); err != nil {
+				httpError(w, r, lg, err)
+				return
+			}
+		}
+		t, err := templates.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get template: %w", err))
+			return
+		}
+		rendered, err := templates.Preview(t, req.Variables, req.Recipient)
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to render template: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, rendered)
+	})
+}
+
+// decodeJSON decodes the JSON request body into v. Errors wrap [common.ErrBadRequest].
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: invalid json: %w", common.ErrBadRequest, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, lg *slog.Logger, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		lg.ErrorContext(r.Context(), "failed to encode response", "error", err)
+	}
+}
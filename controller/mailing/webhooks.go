@@ -0,0 +1,182 @@
+package mailing
+
+import (
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/webhooks"
+	"net/http"
+)
+
+// WebhookRequest registers a webhook.
+type WebhookRequest struct {
+	URL string `json:"url" example:"https://crm.example.com/hooks/mailinglists"`
+	// Events are the event types to send, all if empty.
+	Events []events.Type `json:"events" example:"member.subscribed"`
+	// Secret signs the payloads; generated if empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Webhooks godoc
+// @Summary      List webhooks
+// @Description  Returns the registered webhooks without their secrets. Admin only.
+// @Tags         webhooks
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   webhooks.Webhook
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Router       /v1/webhooks [get]
+func Webhooks(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		hooks, err := webhooks.List()
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list webhooks: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, hooks)
+	})
+}
+
+// CreateWebhook godoc
+// @Summary      Register a webhook
+// @Description  Registers a URL that receives events (member.subscribed, member.unsubscribed, ...) as signed JSON
+// @Description  POST requests. The response contains the secret of the X-Webhook-Signature header; it is not returned
+// @Description  again. Admin only.
+// @Tags         webhooks
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      WebhookRequest  true  "Webhook"
+// @Success      201      {object}  webhooks.Webhook
+// @Failure      400      {string}  string  "Bad Request"
+// @Failure      401      {string}  string  "Unauthorized"
+// @Failure      403      {string}  string  "Forbidden"
+// @Router       /v1/webhooks [post]
+func CreateWebhook(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := requireAdmin(w, r, lg)
+		if !ok {
+			return
+		}
+		var req WebhookRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			httpError(w, r, lg, err)
+			return
+		}
+		hook, err := webhooks.Create(req.URL, req.Events, req.Secret, user.Actor())
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to create webhook: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusCreated, hook)
+	})
+}
+
+// Webhook godoc
+// @Summary      Get a webhook
+// @Tags         webhooks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Webhook ID"
+// @Success      200  {object}  webhooks.Webhook
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/webhooks/{id} [get]
+func Webhook(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		hook, err := webhooks.Get(r.PathValue("id"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to get webhook: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, hook)
+	})
+}
+
+// DeleteWebhook godoc
+// @Summary      Delete a webhook
+// @Description  Removes a webhook; its pending deliveries are dead-lettered. Admin only.
+// @Tags         webhooks
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Webhook ID"
+// @Success      204
+// @Failure      401  {string}  string  "Unauthorized"
+// @Failure      403  {string}  string  "Forbidden"
+// @Failure      404  {string}  string  "Not Found"
+// @Router       /v1/webhooks/{id} [delete]
+func DeleteWebhook(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		if err := webhooks.Delete(r.PathValue("id")); err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to delete webhook: %w", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// WebhookDeliveries godoc
+// @Summary      List deliveries of a webhook
+// @Description  Returns the deliveries of a webhook, newest first. status=dead lists the dead-lettered deliveries
+// @Description  that failed all attempts. Admin only.
+// @Tags         webhooks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id      path      string  true   "Webhook ID"
+// @Param        status  query     string  false  "Filter by status (pending, delivered, dead)"
+// @Success      200     {array}   webhooks.Delivery
+// @Failure      401     {string}  string  "Unauthorized"
+// @Failure      403     {string}  string  "Forbidden"
+// @Failure      404     {string}  string  "Not Found"
+// @Router       /v1/webhooks/{id}/deliveries [get]
+func WebhookDeliveries(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		deliveries, err := webhooks.Deliveries(r.PathValue("id"), webhooks.Status(r.URL.Query().Get("status")))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to list deliveries: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusOK, deliveries)
+	})
+}
+
+// RedeliverWebhook godoc
+// @Summary      Redeliver an event
+// @Description  Sends a delivered or dead-lettered delivery again, with a fresh set of attempts. Admin only.
+// @Tags         webhooks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id        path      string  true  "Webhook ID"
+// @Param        delivery  path      string  true  "Delivery ID"
+// @Success      202       {object}  webhooks.Delivery
+// @Failure      401       {string}  string  "Unauthorized"
+// @Failure      403       {string}  string  "Forbidden"
+// @Failure      404       {string}  string  "Not Found"
+// @Failure      409       {string}  string  "Conflict"
+// @Router       /v1/webhooks/{id}/deliveries/{delivery}/redeliver [post]
+func RedeliverWebhook(lg *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r, lg); !ok {
+			return
+		}
+		d, err := webhooks.Redeliver(r.PathValue("id"), r.PathValue("delivery"))
+		if err != nil {
+			httpError(w, r, lg, fmt.Errorf("failed to redeliver: %w", err))
+			return
+		}
+		writeJSON(w, r, lg, http.StatusAccepted, d)
+	})
+}
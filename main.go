@@ -22,10 +22,27 @@ import (
 	"log/slog"
 	"mailinglist-backend-go/controller/health"
 	"mailinglist-backend-go/controller/mailing"
+	"mailinglist-backend-go/services/analytics"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/common"
 	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/digest"
+	"mailinglist-backend-go/services/erasure"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/rateLimiter"
 	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"mailinglist-backend-go/services/subscriptions"
+	"mailinglist-backend-go/services/webhooks"
+	"math"
 	"net/http"
+	"net/mail"
+	"net/netip"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -51,41 +68,328 @@ func main() {
 	}
 }
 
-func run(_ context.Context, cfg config) error {
+// Legacy routes are kept as deprecated aliases of the v1 API until legacySunset.
+var (
+	legacyDeprecatedAt = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	legacySunset       = time.Date(2027, time.May, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func run(ctx context.Context, cfg config) error {
+	err := mailgun.Setup(mailgun.ConfigFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to configure mailgun: %w", err)
+	}
+	if err := mailgun.CheckUnsubscribeModes(); err != nil {
+		return fmt.Errorf("failed to configure mailgun: %w", err)
+	}
+
+	storePath := configReader.Value("STORE_PATH")
+	if storePath == "" {
+		cfg.lg.Warn("STORE_PATH is not set, local state is kept in memory only")
+	}
+	err = store.Open(storePath)
+	if err != nil {
+		return fmt.Errorf("failed to open store: %w", err)
+	}
+
+	registerJobs()
+	registerHooks(cfg.lg)
+	err = scheduler.Start(ctx, cfg.lg)
+	if err != nil {
+		return fmt.Errorf("failed to start scheduler: %w", err)
+	}
+	if configReader.Value("MAILGUN_DOMAIN") == "" {
+		cfg.lg.Warn("MAILGUN_DOMAIN is not set, delivery statistics are not collected")
+	} else if err := analytics.ScheduleSync(); err != nil {
+		return fmt.Errorf("failed to schedule analytics sync: %w", err)
+	}
+
+	if err := digest.Schedule(); err != nil {
+		return fmt.Errorf("failed to schedule digests: %w", err)
+	}
+
+	router, err := newRouter(cfg)
+	if err != nil {
+		return err
+	}
+	err = http.ListenAndServe(cfg.http.addr, router)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server closed unexpectedly: %w", err)
+	}
+	return nil
+}
+
+// registerJobs registers the handlers of all scheduler job types.
+func registerJobs() {
+	scheduler.Register(mailgun.SendJob, mailgun.RunSendJob)
+	scheduler.Register(analytics.SyncJob, analytics.RunSyncJob)
+	scheduler.Register(subscriptions.ResumeJob, subscriptions.RunResumeJob)
+	scheduler.Register(digest.Job, digest.RunJob)
+	scheduler.Register(erasure.Job, erasure.RunJob)
+	scheduler.Register(webhooks.Job, webhooks.RunJob)
+}
+
+// registerHooks connects the services reacting to sent messages.
+func registerHooks(lg *slog.Logger) {
+	mailgun.OnSent(func(ctx context.Context, list string, msg mailgun.Message, id string) {
+		if err := digest.Record(list, msg, id); err != nil {
+			lg.ErrorContext(ctx, "failed to record message for digests", "list", list, "message_id", id, "error", err)
+		}
+	})
+	events.Reset()
+	events.Subscribe(func(ctx context.Context, e events.Event) {
+		if err := webhooks.Enqueue(e); err != nil {
+			lg.ErrorContext(ctx, "failed to enqueue webhook deliveries", "event", e.ID, "type", e.Type, "error", err)
+		}
+	})
+}
+
+// newRouter registers all routes and wraps them with the global middlewares.
+func newRouter(cfg config) (http.Handler, error) {
 	mux := http.NewServeMux()
 	// Unprotected health endpoint
 	mux.HandleFunc("/health", health.Ping)
-	// Protected endpoints wrapped by authMiddleware
-	mux.Handle("GET /lists", authMiddleware(mailing.Lists(cfg.lg)))
-	mux.Handle("POST /subscribe", authMiddleware(mailing.Subscribe(cfg.lg)))
-	mux.Handle("POST /unsubscribe", authMiddleware(mailing.Unsubscribe(cfg.lg)))
+
+	// Rate limits are shared between the v1 and legacy routes of the same operation
+	trusted, err := rateLimiter.ParseProxies(configReader.Values("TRUSTED_PROXIES"))
+	if err != nil {
+		cfg.lg.Error("ignoring trusted proxies", "error", err)
+	}
+	readLimit, err := rateLimitMiddleware(cfg.lg, "lists", "60/m", trusted)
+	if err != nil {
+		return nil, err
+	}
+	writeLimit, err := rateLimitMiddleware(cfg.lg, "members", "10/m", trusted)
+	if err != nil {
+		return nil, err
+	}
+	sendLimit, err := rateLimitMiddleware(cfg.lg, "messages", "20/h", trusted)
+	if err != nil {
+		return nil, err
+	}
+	exportLimit, err := rateLimitMiddleware(cfg.lg, "exports", "10/h", trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	// Protected v1 endpoints wrapped by authMiddleware
+	mux.Handle("GET /v1/lists", authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.Lists(cfg.lg))))
+	mux.Handle("GET /v1/lists/{list}", authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.List(cfg.lg))))
+	mux.Handle("GET /v1/lists/{list}/schema", authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.MemberSchema(cfg.lg))))
+	mux.Handle("PUT /v1/lists/{list}/schema", authMiddleware(requestValidator.ScopeListsWrite, writeLimit(mailing.UpdateMemberSchema(cfg.lg))))
+	mux.Handle("GET /v1/lists/{list}/members/{member}", authMiddleware(requestValidator.ScopeMembersRead, readLimit(mailing.Member(cfg.lg))))
+	mux.Handle("PATCH /v1/lists/{list}/members/{member}", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.UpdateMember(cfg.lg))))
+	mux.Handle("PUT /v1/lists/{list}/members/{member}/delivery", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.SetDelivery(cfg.lg))))
+	mux.Handle("PUT /v1/lists/{list}/members/{member}/pause", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.PauseMember(cfg.lg))))
+	mux.Handle("DELETE /v1/lists/{list}/members/{member}/pause", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.ResumeMember(cfg.lg))))
+	mux.Handle("PUT /v1/lists/{list}/members/{member}", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.AddMember(cfg.lg))))
+	mux.Handle("DELETE /v1/lists/{list}/members/{member}", authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.RemoveMember(cfg.lg))))
+	mux.Handle("GET /v1/lists/{list}/roles", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.ListRoles(cfg.lg))))
+	mux.Handle("PUT /v1/lists/{list}/roles/{member}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.GrantRole(cfg.lg))))
+	mux.Handle("DELETE /v1/lists/{list}/roles/{member}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.RevokeRole(cfg.lg))))
+	mux.Handle("GET /v1/lists/{list}/stats", authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.ListStats(cfg.lg))))
+	mux.Handle("POST /v1/lists/{list}/messages", authMiddleware(requestValidator.ScopeMessagesSend, sendLimit(mailing.SendMessage(cfg.lg))))
+	mux.Handle("POST /v1/lists/{list}/submissions", authMiddleware(requestValidator.ScopeUser, sendLimit(mailing.Submit(cfg.lg))))
+	mux.Handle("GET /v1/submissions", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Submissions(cfg.lg))))
+	mux.Handle("GET /v1/submissions/{id}", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Submission(cfg.lg))))
+	mux.Handle("POST /v1/submissions/{id}/approve", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.ApproveSubmission(cfg.lg))))
+	mux.Handle("POST /v1/submissions/{id}/reject", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.RejectSubmission(cfg.lg))))
+	mux.Handle("GET /v1/me/data", authMiddleware(requestValidator.ScopeUser, actAsMiddleware(cfg.lg, exportLimit(mailing.MyData(cfg.lg)))))
+	mux.Handle("GET /v1/members/{address}/data", authMiddleware(requestValidator.ScopeMembersRead, exportLimit(mailing.MemberData(cfg.lg))))
+	mux.Handle("DELETE /v1/me", authMiddleware(requestValidator.ScopeUser, writeLimit(mailing.EraseMe(cfg.lg))))
+	mux.Handle("DELETE /v1/members/{address}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.EraseMember(cfg.lg))))
+	mux.Handle("GET /v1/erasures/{id}", authMiddleware(requestValidator.ScopeMembersRead, readLimit(mailing.Erasure(cfg.lg))))
+	mux.Handle("GET /v1/me/consents", authMiddleware(requestValidator.ScopeUser, actAsMiddleware(cfg.lg, readLimit(mailing.MyConsents(cfg.lg)))))
+	mux.Handle("GET /v1/members/{address}/consents", authMiddleware(requestValidator.ScopeMembersRead, readLimit(mailing.MemberConsents(cfg.lg))))
+	mux.Handle("GET /v1/consents/policy", authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.ConsentPolicy(cfg.lg))))
+	mux.Handle("PUT /v1/consents/policy", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.UpdateConsentPolicy(cfg.lg))))
+	mux.Handle("GET /v1/consents/pending", authMiddleware(requestValidator.ScopeMembersRead, readLimit(mailing.PendingConsents(cfg.lg))))
+	mux.Handle("GET /v1/me/roles", authMiddleware(requestValidator.ScopeUser, actAsMiddleware(cfg.lg, readLimit(mailing.MyRoles(cfg.lg)))))
+	mux.Handle("GET /v1/me/preferences", authMiddleware(requestValidator.ScopeUser, actAsMiddleware(cfg.lg, readLimit(mailing.Preferences(cfg.lg)))))
+	mux.Handle("PUT /v1/me/preferences", authMiddleware(requestValidator.ScopeUser, actAsMiddleware(cfg.lg, writeLimit(mailing.SavePreferences(cfg.lg)))))
+	mux.Handle("GET /v1/suppressions", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Suppressions(cfg.lg))))
+	mux.Handle("DELETE /v1/suppressions/{type}/{address}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.DeleteSuppression(cfg.lg))))
+	mux.Handle("GET /v1/templates", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Templates(cfg.lg))))
+	mux.Handle("POST /v1/templates", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.CreateTemplate(cfg.lg))))
+	mux.Handle("GET /v1/templates/{id}", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Template(cfg.lg))))
+	mux.Handle("PUT /v1/templates/{id}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.UpdateTemplate(cfg.lg))))
+	mux.Handle("DELETE /v1/templates/{id}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.DeleteTemplate(cfg.lg))))
+	mux.Handle("POST /v1/templates/{id}/preview", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.PreviewTemplate(cfg.lg))))
+	mux.Handle("GET /v1/events/stream", authMiddleware(requestValidator.ScopeMembersRead, readLimit(mailing.EventStream(cfg.lg))))
+	mux.Handle("GET /v1/webhooks", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Webhooks(cfg.lg))))
+	mux.Handle("POST /v1/webhooks", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.CreateWebhook(cfg.lg))))
+	mux.Handle("GET /v1/webhooks/{id}", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Webhook(cfg.lg))))
+	mux.Handle("DELETE /v1/webhooks/{id}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.DeleteWebhook(cfg.lg))))
+	mux.Handle("GET /v1/webhooks/{id}/deliveries", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.WebhookDeliveries(cfg.lg))))
+	mux.Handle("POST /v1/webhooks/{id}/deliveries/{delivery}/redeliver", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.RedeliverWebhook(cfg.lg))))
+	mux.Handle("GET /v1/api-keys", authMiddleware(requestValidator.ScopeUser, readLimit(mailing.APIKeys(cfg.lg))))
+	mux.Handle("POST /v1/api-keys", authMiddleware(requestValidator.ScopeUser, writeLimit(mailing.CreateAPIKey(cfg.lg))))
+	mux.Handle("DELETE /v1/api-keys/{id}", authMiddleware(requestValidator.ScopeUser, writeLimit(mailing.RevokeAPIKey(cfg.lg))))
+	mux.Handle("GET /v1/jobs", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Jobs(cfg.lg))))
+	mux.Handle("GET /v1/jobs/{id}", authMiddleware(requestValidator.ScopeAdmin, readLimit(mailing.Job(cfg.lg))))
+	mux.Handle("PATCH /v1/jobs/{id}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.RescheduleJob(cfg.lg))))
+	mux.Handle("DELETE /v1/jobs/{id}", authMiddleware(requestValidator.ScopeAdmin, writeLimit(mailing.CancelJob(cfg.lg))))
+
+	// Deprecated legacy endpoints
+	mux.Handle("GET /lists", deprecated("/v1/lists")(authMiddleware(requestValidator.ScopeListsRead, readLimit(mailing.Lists(cfg.lg)))))
+	mux.Handle("POST /subscribe", deprecated("")(authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.Subscribe(cfg.lg)))))
+	mux.Handle("POST /unsubscribe", deprecated("")(authMiddleware(requestValidator.ScopeMembersWrite, writeLimit(mailing.Unsubscribe(cfg.lg)))))
 
 	// Setup CORS middleware with allowed origins from environment
 	allowed := configReader.Values("CORS_ALLOWED_ORIGINS")
 	handler := corsMiddleware(allowed)(mux)
 	// Add logging middleware to log every request
 	handler = loggingMiddleware(cfg.lg)(handler)
+	return handler, nil
+}
 
-	err := http.ListenAndServe(cfg.http.addr, handler)
-	if !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("server closed unexpectedly: %w", err)
+// deprecated marks responses of legacy routes with the Deprecation (RFC 9745) and
+// Sunset (RFC 8594) headers. If successor is set, it is advertised as a Link.
+func deprecated(successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()))
+			w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+			if successor != "" {
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
-	return nil
 }
 
-// authMiddleware validates JWT from Authorization header and stores claims in context.
-func authMiddleware(next http.Handler) http.Handler {
+// authMiddleware validates the JWT or API key of the request and stores the claims in
+// the context. Machine clients need scope; ScopeUser routes are for users only.
+func authMiddleware(scope requestValidator.Scope, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims, err := requestValidator.ValidateRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		user, err := requestValidator.CurrentUser(claims)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.Machine() && (scope == requestValidator.ScopeUser || !user.HasScope(scope)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 		ctx := requestValidator.WithClaims(r.Context(), claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// actAsMiddleware lets users with the impersonate permission act as the user in the
+// X-Act-As header or act_as query parameter. Responses carry X-Acting-As and every
+// request is recorded in the audit log with both identities. It has to run after
+// authMiddleware.
+func actAsMiddleware(lg *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Act-As")
+		if target == "" {
+			target = r.URL.Query().Get("act_as")
+		}
+		if target == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := requestValidator.ClaimsFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, err := requestValidator.CurrentUser(claims)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !roles.Can(user, "", roles.Impersonate) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		addr, err := mail.ParseAddress(target)
+		if err != nil {
+			http.Error(w, "invalid X-Act-As address", http.StatusBadRequest)
+			return
+		}
+		// Looking at someone else's data is recorded even if nothing is changed
+		err = audit.Record(audit.Entry{Actor: user.Actor(), OnBehalfOf: addr.Address, Action: "impersonate", Subject: addr.Address,
+			Details: map[string]string{"request": r.Method + " " + r.URL.Path}})
+		if err != nil {
+			lg.ErrorContext(r.Context(), "failed to record impersonation", "actor", user.Actor(), "subject", addr.Address, "error", err)
+			http.Error(w, common.ErrInternal.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Acting-As", addr.Address)
+		next.ServeHTTP(w, r.WithContext(requestValidator.WithActAs(r.Context(), addr.Address)))
+	})
+}
+
+// ipRateFactor is the default limit per client IP relative to the limit per user, so that
+// users behind a shared address do not run into each other's limit.
+const ipRateFactor = 10
+
+// rateLimitMiddleware limits requests per JWT subject and per client IP using token buckets.
+// The rate is read from RATE_LIMIT_<NAME> (e.g. RATE_LIMIT_MEMBERS=10/m) and falls back to def.
+// The rate per IP is read from RATE_LIMIT_<NAME>_IP and defaults to ipRateFactor times the
+// rate per user. The bucket of the user is checked first, so that a user over its limit
+// does not use up the limit of its IP. It has to run after authMiddleware so that the
+// claims are available.
+func rateLimitMiddleware(lg *slog.Logger, name, def string, trusted []netip.Prefix) (func(http.Handler) http.Handler, error) {
+	defRate, err := rateLimiter.ParseRate(def)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default rate limit %q: %w", def, err)
+	}
+	key := "RATE_LIMIT_" + strings.ToUpper(name)
+	rate := rateFromEnv(lg, key, defRate)
+	ipRate := rateFromEnv(lg, key+"_IP", rateLimiter.Rate{Requests: rate.Requests * ipRateFactor, Per: rate.Per})
+	byUser := rateLimiter.New(rate)
+	byIP := rateLimiter.New(ipRate)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var res rateLimiter.Result
+			var sub string
+			if claims, ok := requestValidator.ClaimsFromContext(r.Context()); ok {
+				sub, _ = claims.GetSubject()
+			}
+			if sub != "" {
+				res = byUser.Allow(sub)
+			}
+			if sub == "" || res.Allowed {
+				if ipRes := byIP.Allow(rateLimiter.ClientIP(r, trusted)); sub == "" || !ipRes.Allowed {
+					res = ipRes
+				}
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// rateFromEnv reads the rate limit key, def if it is unset or invalid.
+func rateFromEnv(lg *slog.Logger, key string, def rateLimiter.Rate) rateLimiter.Rate {
+	if !configReader.Exists(key) {
+		return def
+	}
+	rate, err := rateLimiter.ParseRate(configReader.Value(key))
+	if err != nil {
+		lg.Error("invalid rate limit, using default", "key", key, "default", def, "error", err)
+		return def
+	}
+	return rate
+}
+
 // corsMiddleware returns a middleware that sets CORS headers based on allowed origins.
 // allowedOrigins is a list of origins (scheme://host[:port]) or "*" to allow any.
 func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
@@ -109,8 +413,9 @@ func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
 				// w.Header().Set("Access-Control-Allow-Credentials", "true")
 			}
 			// Always advertise what methods/headers are accepted for preflight
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match, Idempotency-Key, X-Act-As")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Deprecation, Sunset, Link, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, X-Acting-As")
 
 			if r.Method == http.MethodOptions {
 				if origin == "" || !allowed {
@@ -177,6 +482,11 @@ func (sr *statusRecorder) WriteHeader(code int) {
 	sr.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streams.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func (sr *statusRecorder) Write(b []byte) (int, error) {
 	if sr.status == 0 {
 		sr.status = http.StatusOK
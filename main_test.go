@@ -0,0 +1,1791 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mailinglist-backend-go/controller/mailing"
+	"mailinglist-backend-go/services/analytics"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/dataExport"
+	"mailinglist-backend-go/services/digest"
+	"mailinglist-backend-go/services/erasure"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/introspection"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/mailgunmock"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"mailinglist-backend-go/services/subscriptions"
+	"mailinglist-backend-go/services/webhooks"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+// testEnv runs the real router against a Mailgun mock and signs tokens with a generated key.
+type testEnv struct {
+	t       *testing.T
+	mock    *mailgunmock.Server
+	key     *rsa.PrivateKey
+	handler http.Handler
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KEYCLOAK_PUBLIC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	t.Setenv("MAILGUN_BLOCKED_MAILING_LISTS", "blocked@lists.test")
+	t.Setenv("MAILGUN_HIDDEN_MAILING_LISTS", "hidden@lists.test")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "http://localhost:3000")
+	t.Setenv("RATE_LIMIT_LISTS", "1000/m")
+	t.Setenv("RATE_LIMIT_MEMBERS", "1000/m")
+	t.Setenv("RATE_LIMIT_EXPORTS", "1000/m")
+
+	mock := mailgunmock.StartWithKey("test-key")
+	t.Cleanup(mock.Close)
+	mock.AddList(mtypes.MailingList{Address: "news@lists.test", Name: "News"})
+	mock.AddList(mtypes.MailingList{Address: "blocked@lists.test", Name: "Blocked"})
+	mock.AddList(mtypes.MailingList{Address: "hidden@lists.test", Name: "Hidden"})
+
+	err = mailgun.Setup(mailgun.Config{
+		APIKey:     "test-key",
+		APIBase:    mock.URL(),
+		Domain:     "lists.test",
+		Timeout:    5 * time.Second,
+		MaxRetries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	registerJobs()
+
+	var cfg config
+	cfg.lg = slog.New(slog.NewTextHandler(io.Discard, nil))
+	registerHooks(cfg.lg)
+	handler, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{t: t, mock: mock, key: key, handler: handler}
+}
+
+// breakStore makes writes to the store fail until the returned function is called.
+func (e *testEnv) breakStore() func() {
+	store.InjectFault(errors.New("disk full"))
+	return func() { store.InjectFault(nil) }
+}
+
+// token returns a signed token for a user. Extra claims override the defaults.
+func (e *testEnv) token(email string, admin bool, extra jwt.MapClaims) string {
+	e.t.Helper()
+	groups := []any{"Users"}
+	if admin {
+		groups = append(groups, "Admin")
+	}
+	claims := jwt.MapClaims{
+		"sub":            "sub-" + email,
+		"email":          email,
+		"email_verified": true,
+		"given_name":     "Test",
+		"family_name":    "User",
+		"groups":         groups,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(e.key)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return signed
+}
+
+func (e *testEnv) do(method, path, token string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	req := httptest.NewRequest(method, path, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHealth(t *testing.T) {
+	env := newTestEnv(t)
+	rec := env.do(http.MethodGet, "/health", "", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "OK" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	env := newTestEnv(t)
+	if rec := env.do(http.MethodGet, "/v1/lists", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without token: got %d", rec.Code)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"email": "a@b.test"}).SignedString(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists", forged, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("with foreign signature: got %d", rec.Code)
+	}
+}
+
+func TestListLists(t *testing.T) {
+	env := newTestEnv(t)
+	token := env.token("user@example.test", false, nil)
+
+	rec := env.do(http.MethodGet, "/v1/lists", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var lists []mailgun.APIMailingList
+	if err := json.Unmarshal(rec.Body.Bytes(), &lists); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]mailgun.APIMailingList{}
+	for _, l := range lists {
+		got[l.Address] = l
+	}
+	if len(got) != 2 || !got["blocked@lists.test"].Blocked || got["news@lists.test"].Blocked {
+		t.Fatalf("unexpected lists: %+v", lists)
+	}
+	if _, ok := got["hidden@lists.test"]; ok {
+		t.Fatal("hidden list must not be returned")
+	}
+
+	etag := rec.Header().Get("ETag")
+	if rec := env.do(http.MethodGet, "/v1/lists", token, nil, "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("If-None-Match: got %d", rec.Code)
+	}
+
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test", token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("single list: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/hidden@lists.test", token, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("hidden list: got %d", rec.Code)
+	}
+}
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	env := newTestEnv(t)
+	token := env.token("user@example.test", false, nil)
+
+	rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := env.mock.Member("news@lists.test", "user@example.test"); !ok {
+		t.Fatal("member was not created")
+	}
+
+	rec = env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/user@example.test", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unsubscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := env.mock.Member("news@lists.test", "user@example.test"); ok {
+		t.Fatal("member was not removed")
+	}
+}
+
+func TestSubscribeOthersRequiresAdmin(t *testing.T) {
+	env := newTestEnv(t)
+
+	user := env.token("user@example.test", false, nil)
+	rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test", user, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("user: got %d", rec.Code)
+	}
+	if _, ok := env.mock.Member("news@lists.test", "other@example.test"); ok {
+		t.Fatal("non-admin subscribed another user")
+	}
+	// The own address in another case is not another user
+	rec = env.do(http.MethodPut, "/v1/lists/news@lists.test/members/User@Example.test", user, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("own address in other case: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	admin := env.token("admin@example.test", true, nil)
+	rec = env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test", admin, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin: got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSubscribeBlockedList(t *testing.T) {
+	env := newTestEnv(t)
+	token := env.token("user@example.test", false, nil)
+
+	rec := env.do(http.MethodPut, "/v1/lists/blocked@lists.test/members/user@example.test", token, nil)
+	if rec.Code == http.StatusOK {
+		t.Fatal("subscribing to a blocked list must fail")
+	}
+	if members := env.mock.Members("blocked@lists.test"); len(members) != 0 {
+		t.Fatalf("unexpected members: %+v", members)
+	}
+}
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	env := newTestEnv(t)
+	token := env.token("user@example.test", false, nil)
+
+	form := url.Values{"list": {"news@lists.test"}, "member": {"user@example.test"}}
+	rec := env.do(http.MethodPost, "/subscribe", token, strings.NewReader(form.Encode()),
+		"Content-Type", "application/x-www-form-urlencoded")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Deprecation") == "" || rec.Header().Get("Sunset") == "" {
+		t.Fatalf("missing deprecation headers: %v", rec.Header())
+	}
+	if _, ok := env.mock.Member("news@lists.test", "user@example.test"); !ok {
+		t.Fatal("member was not created")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("RATE_LIMIT_LISTS", "2/m")
+	t.Setenv("RATE_LIMIT_LISTS_IP", "3/m")
+	t.Setenv("RATE_LIMIT_EXPORTS", "1/h")
+	handler, err := newRouter(config{lg: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.handler = handler
+	token := env.token("user@example.test", false, nil)
+
+	for i := 0; i < 2; i++ {
+		if rec := env.do(http.MethodGet, "/v1/lists", token, nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, rec.Code)
+		}
+	}
+	rec := env.do(http.MethodGet, "/v1/lists", token, nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Denied requests of one user do not use up the limit of its IP
+	env.do(http.MethodGet, "/v1/lists", token, nil)
+	other := env.token("other@example.test", false, nil)
+	if rec := env.do(http.MethodGet, "/v1/lists", other, nil); rec.Code != http.StatusOK {
+		t.Fatalf("other user on the same IP: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists", other, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("IP limit: got %d", rec.Code)
+	}
+
+	// Exports have a limit of their own
+	if rec := env.do(http.MethodGet, "/v1/me/data", other, nil); rec.Code != http.StatusOK {
+		t.Fatalf("export: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/data", other, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second export: got %d", rec.Code)
+	}
+}
+
+func TestMailgunRetries(t *testing.T) {
+	env := newTestEnv(t)
+	token := env.token("user@example.test", false, nil)
+
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodGet, Path: "/v3/lists/news@lists.test/members", Status: http.StatusServiceUnavailable, Times: 1})
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists/news@lists.test/members", Status: http.StatusTooManyRequests, Times: 2})
+	rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", token, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A POST failing with 5xx may have been processed and is not repeated
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists/news@lists.test/members", Status: http.StatusServiceUnavailable, Times: 1})
+	rec = env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test", env.token("admin@example.test", true, nil), nil)
+	if rec.Code == http.StatusOK {
+		t.Fatal("failed POST was retried")
+	}
+	if _, ok := env.mock.Member("news@lists.test", "other@example.test"); ok {
+		t.Fatal("failed POST was retried")
+	}
+
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodDelete, Status: http.StatusInternalServerError})
+	rec = env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/user@example.test", token, nil)
+	if rec.Code == http.StatusOK {
+		t.Fatal("persistent failures must be reported")
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	env := newTestEnv(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("subject", "Hello")
+	_ = mw.WriteField("text", "Hello list")
+	_ = mw.WriteField("html", "<p>Hello list</p>")
+	_ = mw.WriteField("reply_to", "office@example.test")
+	_ = mw.WriteField("tag", "newsletter")
+	fw, _ := mw.CreateFormFile("attachment", "agenda.txt")
+	_, _ = fw.Write([]byte("agenda"))
+	_ = mw.Close()
+
+	user := env.token("user@example.test", false, nil)
+	rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", user, bytes.NewReader(body.Bytes()), "Content-Type", mw.FormDataContentType())
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("user: got %d", rec.Code)
+	}
+
+	admin := env.token("admin@example.test", true, nil)
+	rec = env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, bytes.NewReader(body.Bytes()), "Content-Type", mw.FormDataContentType())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("admin: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct{ ID string }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ID == "" {
+		t.Fatalf("missing message id: %s", rec.Body.String())
+	}
+
+	msgs := env.mock.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.To[0] != "news@lists.test" || msg.Subject != "Hello" || msg.Headers["List-Unsubscribe"] == "" ||
+		len(msg.Attachments) != 1 || len(msg.Tags) != 1 || msg.Headers["Reply-To"] != "office@example.test" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+
+	tpl := `{"name": "Newsletter", "subject": "News for {{.month}}",
+		"text": "Hello {{recipient \"name\"}}, news for {{.month}}",
+		"html": "<p>Hello {{recipient \"name\"}}, news for {{.month}}</p>",
+		"variables": [{"name": "month", "required": true, "sample": "October"}]}`
+	rec := env.do(http.MethodPost, "/v1/templates", admin, strings.NewReader(tpl))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct{ ID string }
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+
+	rec = env.do(http.MethodPost, "/v1/templates/"+created.ID+"/preview", admin, strings.NewReader(`{"recipient": {"name": "Ada"}}`))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Hello Ada, news for October") {
+		t.Fatalf("preview: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = env.do(http.MethodPost, "/v1/templates", admin, strings.NewReader(`{"name": "Broken", "subject": "{{.x", "text": "x"}`))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid template: got %d", rec.Code)
+	}
+
+	form := url.Values{"template": {created.ID}, "variables": {`{"month": "November"}`}}
+	rec = env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, strings.NewReader(form.Encode()),
+		"Content-Type", "application/x-www-form-urlencoded")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("send: got %d: %s", rec.Code, rec.Body.String())
+	}
+	msg := env.mock.Messages()[0]
+	if msg.Subject != "News for November" || msg.Text != "Hello %recipient.name%, news for November" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	form.Set("variables", `{}`)
+	rec = env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, strings.NewReader(form.Encode()),
+		"Content-Type", "application/x-www-form-urlencoded")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("missing variable: got %d", rec.Code)
+	}
+}
+
+func TestScheduledSend(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	schedule := func(sendAt time.Time) *httptest.ResponseRecorder {
+		form := url.Values{"subject": {"Later"}, "text": {"Hello"}, "send_at": {sendAt.Format(time.RFC3339)}}
+		return env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, strings.NewReader(form.Encode()),
+			"Content-Type", "application/x-www-form-urlencoded", "Idempotency-Key", "newsletter-1")
+	}
+	rec := schedule(time.Now().Add(time.Hour))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("schedule: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job scheduler.Job
+	_ = json.Unmarshal(rec.Body.Bytes(), &job)
+
+	// Same idempotency key, same job
+	var again scheduler.Job
+	_ = json.Unmarshal(schedule(time.Now()).Body.Bytes(), &again)
+	if again.ID != job.ID {
+		t.Fatalf("duplicate job %s for idempotency key", again.ID)
+	}
+	form := url.Values{"subject": {"Other"}, "text": {"Hello"}, "send_at": {time.Now().Add(time.Hour).Format(time.RFC3339)}}
+	rec = env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, strings.NewReader(form.Encode()),
+		"Content-Type", "application/x-www-form-urlencoded", "Idempotency-Key", "newsletter-1")
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("reused idempotency key: got %d", rec.Code)
+	}
+
+	scheduler.RunDue(context.Background(), lg)
+	if len(env.mock.Messages()) != 0 {
+		t.Fatal("message was sent before its time")
+	}
+
+	body := fmt.Sprintf(`{"run_at": %q}`, time.Now().Add(-time.Second).Format(time.RFC3339))
+	if rec := env.do(http.MethodPatch, "/v1/jobs/"+job.ID, admin, strings.NewReader(body)); rec.Code != http.StatusOK {
+		t.Fatalf("reschedule: got %d: %s", rec.Code, rec.Body.String())
+	}
+	scheduler.RunDue(context.Background(), lg)
+	msgs := env.mock.Messages()
+	if len(msgs) != 1 || msgs[0].Variables["idempotency_key"] == "" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+
+	rec = env.do(http.MethodGet, "/v1/jobs/"+job.ID, admin, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &job)
+	if job.Status != scheduler.StatusDone {
+		t.Fatalf("job is %s", job.Status)
+	}
+	if rec := env.do(http.MethodDelete, "/v1/jobs/"+job.ID, admin, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("cancel done job: got %d", rec.Code)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("MAILGUN_MODERATED_MAILING_LISTS", "news@lists.test")
+	env.mock.AddList(mtypes.MailingList{Address: "other@lists.test"})
+
+	member := env.token("member@example.test", false, nil)
+	outsider := env.token("outsider@example.test", false, nil)
+	moderator := env.token("mod@example.test", false, jwt.MapClaims{"groups": []any{"Moderator:news@lists.test"}})
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/member@example.test", member, nil); rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d", rec.Code)
+	}
+
+	draft := `{"subject": "Meetup", "text": "See you there"}`
+	if rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/submissions", outsider, strings.NewReader(draft)); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-member submit: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPost, "/v1/lists/other@lists.test/submissions", member, strings.NewReader(draft)); rec.Code != http.StatusForbidden {
+		t.Fatalf("unmoderated list: got %d", rec.Code)
+	}
+	client := env.token("", false, jwt.MapClaims{"email": nil, "given_name": nil, "family_name": nil, "groups": nil,
+		"client_id": "batch", "scope": "messages:send"})
+	if rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/submissions", client, strings.NewReader(draft)); rec.Code != http.StatusForbidden {
+		t.Fatalf("machine client submit: got %d", rec.Code)
+	}
+
+	submit := func() string {
+		rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/submissions", member, strings.NewReader(draft))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("submit: got %d: %s", rec.Code, rec.Body.String())
+		}
+		var s struct{ ID string }
+		_ = json.Unmarshal(rec.Body.Bytes(), &s)
+		return s.ID
+	}
+	approved, rejected := submit(), submit()
+
+	rec := env.do(http.MethodGet, "/v1/submissions?status=pending", moderator, nil)
+	var queue []json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &queue); err != nil || len(queue) != 2 {
+		t.Fatalf("queue: %s", rec.Body.String())
+	}
+
+	if rec := env.do(http.MethodPost, "/v1/submissions/"+approved+"/approve", member, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("member approve: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPost, "/v1/submissions/"+approved+"/approve", moderator, nil); rec.Code != http.StatusOK {
+		t.Fatalf("approve: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodPost, "/v1/submissions/"+approved+"/approve", moderator, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("approve twice: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPost, "/v1/submissions/"+rejected+"/reject", moderator, strings.NewReader(`{"reason": "Off topic"}`)); rec.Code != http.StatusOK {
+		t.Fatalf("reject: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var toList, notifications int
+	for _, m := range env.mock.Messages() {
+		switch m.To[0] {
+		case "news@lists.test":
+			toList++
+		case "member@example.test":
+			notifications++
+		}
+	}
+	if toList != 1 || notifications != 2 {
+		t.Fatalf("sent %d list messages and %d notifications", toList, notifications)
+	}
+}
+
+func TestDeliveryStats(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("ANALYTICS_EVENT_LAG", "0s")
+	admin := env.token("admin@example.test", true, nil)
+
+	ts := float64(time.Now().Add(-2*time.Hour).Unix()) + 0.5
+	newsletter := map[string]any{"list": "news@lists.test"}
+	env.mock.AddEvent(map[string]any{"event": "delivered", "recipient": "a@example.test", "timestamp": ts, "tags": []string{"newsletter"}, "user-variables": newsletter})
+	env.mock.AddEvent(map[string]any{"event": "delivered", "recipient": "b@example.test", "timestamp": ts, "tags": []string{"newsletter"}, "user-variables": newsletter})
+	env.mock.AddEvent(map[string]any{"event": "opened", "recipient": "a@example.test", "timestamp": ts + 60, "mailing-list": map[string]any{"address": "news@lists.test"}})
+	env.mock.AddEvent(map[string]any{"event": "failed", "severity": "permanent", "recipient": "c@example.test", "timestamp": ts + 60,
+		"message": map[string]any{"headers": map[string]any{"to": "News <news@lists.test>"}}})
+	env.mock.AddEvent(map[string]any{"event": "failed", "severity": "temporary", "recipient": "d@example.test", "timestamp": ts + 60, "user-variables": newsletter})
+	env.mock.AddEvent(map[string]any{"event": "delivered", "recipient": "e@example.test", "timestamp": ts, "user-variables": map[string]any{"list": "blocked@lists.test"}})
+
+	// A failed sync stores nothing and is repeated completely
+	store.InjectFault(errors.New("disk full"))
+	_, err := analytics.Sync(context.Background())
+	store.InjectFault(nil)
+	if err == nil {
+		t.Fatal("sync did not fail")
+	}
+	if n, err := analytics.Sync(context.Background()); err != nil || n != 5 {
+		t.Fatalf("sync: counted %d, %v", n, err)
+	}
+	// Events already counted are skipped
+	if n, err := analytics.Sync(context.Background()); err != nil || n != 0 {
+		t.Fatalf("second sync: counted %d, %v", n, err)
+	}
+
+	get := func(path string) analytics.Stats {
+		t.Helper()
+		rec := env.do(http.MethodGet, path, admin, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		var stats analytics.Stats
+		_ = json.Unmarshal(rec.Body.Bytes(), &stats)
+		return stats
+	}
+	stats := get("/v1/lists/news@lists.test/stats?interval=hour&from=" + url.QueryEscape(time.Now().Add(-24*time.Hour).Format(time.RFC3339)))
+	if want := (analytics.Counts{Delivered: 2, Opened: 1, Bounced: 1}); stats.Totals != want {
+		t.Fatalf("totals %+v, want %+v", stats.Totals, want)
+	}
+	if len(stats.Series) < 24 || stats.SyncedUntil == nil {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats := get("/v1/lists/news@lists.test/stats?tag=newsletter"); stats.Totals != (analytics.Counts{Delivered: 2}) {
+		t.Fatalf("tag totals %+v", stats.Totals)
+	}
+
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/stats", env.token("user@example.test", false, nil), nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/stats?interval=week", admin, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid interval: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/missing@lists.test/stats", admin, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown list: got %d", rec.Code)
+	}
+}
+
+func TestSuppressions(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	env.mock.AddBounce(mtypes.Bounce{Address: "bounced@example.test", Code: "550", Error: "No such mailbox"})
+	env.mock.AddComplaint(mtypes.Complaint{Address: "angry@example.test"})
+	env.mock.AddUnsubscribe(mtypes.Unsubscribe{Address: "gone@example.test"})
+
+	// Subscribing still succeeds but warns about the bounce
+	user := env.token("bounced@example.test", false, nil)
+	rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/bounced@example.test", user, nil)
+	var resp mailing.MembershipResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(resp.Warnings) != 1 || len(resp.Suppressions) != 1 || resp.Suppressions[0].Type != mailgun.Bounces {
+		t.Fatalf("expected a bounce warning: %+v", resp)
+	}
+	rec = env.do(http.MethodPut, "/v1/lists/news@lists.test/members/admin@example.test", admin, nil)
+	if resp := rec.Body.String(); strings.Contains(resp, "warnings") {
+		t.Fatalf("unexpected warning: %s", resp)
+	}
+
+	list := func(query string) []mailgun.Suppression {
+		t.Helper()
+		rec := env.do(http.MethodGet, "/v1/suppressions"+query, admin, nil)
+		var result []mailgun.Suppression
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("list %s: got %d: %s", query, rec.Code, rec.Body.String())
+		}
+		return result
+	}
+	if all := list(""); len(all) != 3 {
+		t.Fatalf("expected 3 suppressions, got %+v", all)
+	}
+	if found := list("?q=ANGRY"); len(found) != 1 || found[0].Type != mailgun.Complaints {
+		t.Fatalf("search: %+v", found)
+	}
+	if found := list("?type=unsubscribes"); len(found) != 1 || found[0].Tags[0] != "*" {
+		t.Fatalf("by type: %+v", found)
+	}
+	if rec := env.do(http.MethodGet, "/v1/suppressions?type=spam", admin, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid type: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/suppressions", user, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d", rec.Code)
+	}
+
+	if rec := env.do(http.MethodDelete, "/v1/suppressions/bounces/bounced@example.test", admin, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if env.mock.Suppressed("bounces", "bounced@example.test") {
+		t.Fatal("bounce was not removed")
+	}
+	if rec := env.do(http.MethodDelete, "/v1/suppressions/bounces/bounced@example.test", admin, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete again: got %d", rec.Code)
+	}
+}
+
+func TestMemberProfile(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("jane@example.test", false, jwt.MapClaims{"given_name": "Jane", "family_name": "Doe"})
+
+	schema := `{"fields": [
+		{"name": "department", "type": "string", "enum": ["IT", "Sales"], "default": "IT"},
+		{"name": "language", "type": "string", "max_length": 5},
+		{"name": "newsletter_rank", "type": "number"}
+	]}`
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/schema", user, strings.NewReader(schema)); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin schema: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/schema", admin, strings.NewReader(`{"fields": [{"name": "x", "type": "date"}]}`)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid schema: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/schema", admin, strings.NewReader(schema)); rec.Code != http.StatusOK {
+		t.Fatalf("schema: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Whoever can change the schema of a hidden list can read it
+	if rec := env.do(http.MethodPut, "/v1/lists/hidden@lists.test/schema", admin, strings.NewReader(schema)); rec.Code != http.StatusOK {
+		t.Fatalf("hidden schema: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/hidden@lists.test/schema", admin, nil); rec.Code != http.StatusOK {
+		t.Fatalf("read hidden schema: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/hidden@lists.test/schema", user, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("read hidden schema without role: got %d", rec.Code)
+	}
+
+	// Members are named after their claims and get the schema defaults
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", user, nil); rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d", rec.Code)
+	}
+	m, _ := env.mock.Member("news@lists.test", "jane@example.test")
+	if m.Name != "Jane Doe" || m.Vars["department"] != "IT" {
+		t.Fatalf("unexpected member %+v", m)
+	}
+
+	patch := func(token, body string) *httptest.ResponseRecorder {
+		return env.do(http.MethodPatch, "/v1/lists/news@lists.test/members/jane@example.test", token, strings.NewReader(body))
+	}
+	for _, body := range []string{
+		`{"vars": {"department": "HR"}}`,
+		`{"vars": {"language": "english"}}`,
+		`{"vars": {"newsletter_rank": "first"}}`,
+		`{"vars": {"shoe_size": 42}}`,
+	} {
+		if rec := patch(user, body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d", body, rec.Code)
+		}
+	}
+	rec := patch(user, `{"name": "Jane D.", "vars": {"department": "Sales", "language": "de", "newsletter_rank": 1}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = patch(admin, `{"vars": {"language": null}}`)
+	var member mailgun.Member
+	if err := json.Unmarshal(rec.Body.Bytes(), &member); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("admin patch: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if member.Name != "Jane D." || member.Vars["department"] != "Sales" || member.Vars["newsletter_rank"] != 1.0 || member.Vars["language"] != nil {
+		t.Fatalf("unexpected member %+v", member)
+	}
+
+	// Subscribing again keeps the vars
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", user, nil); rec.Code != http.StatusOK {
+		t.Fatalf("resubscribe: got %d", rec.Code)
+	}
+	if m, _ := env.mock.Member("news@lists.test", "jane@example.test"); m.Vars["department"] != "Sales" {
+		t.Fatalf("vars were reset: %+v", m.Vars)
+	}
+
+	other := env.token("other@example.test", false, nil)
+	if rec := patch(other, `{"name": "Mallory"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("other user: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", other, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("other user read: got %d", rec.Code)
+	}
+}
+
+func TestPauseAndUnsubscribeMode(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("MAILGUN_UNSUBSCRIBE_MODES", "news@lists.test=mark")
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	user := env.token("user@example.test", false, nil)
+	admin := env.token("admin@example.test", true, nil)
+	memberPath := "/v1/lists/news@lists.test/members/user@example.test"
+
+	status := func() mailgun.Member {
+		t.Helper()
+		rec := env.do(http.MethodGet, memberPath, user, nil)
+		var m mailgun.Member
+		if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("get member: got %d: %s", rec.Code, rec.Body.String())
+		}
+		return m
+	}
+	pause := func(until time.Time) *httptest.ResponseRecorder {
+		return env.do(http.MethodPut, memberPath+"/pause", user, strings.NewReader(fmt.Sprintf(`{"until": %q}`, until.Format(time.RFC3339))))
+	}
+
+	// Unsubscribing keeps the member
+	env.do(http.MethodPut, memberPath, user, nil)
+	rec := env.do(http.MethodDelete, memberPath, user, nil)
+	var resp mailing.MembershipResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Removed || resp.Status != mailgun.StatusUnsubscribed {
+		t.Fatalf("unsubscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if m := status(); m.Status != mailgun.StatusUnsubscribed {
+		t.Fatalf("status %s", m.Status)
+	}
+	if rec := pause(time.Now().Add(time.Hour)); rec.Code != http.StatusConflict {
+		t.Fatalf("pause unsubscribed: got %d", rec.Code)
+	}
+
+	env.do(http.MethodPut, memberPath, user, nil)
+	if rec := pause(time.Now().Add(-time.Hour)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("pause in the past: got %d", rec.Code)
+	}
+	if rec := pause(time.Now().Add(time.Hour)); rec.Code != http.StatusOK {
+		t.Fatalf("pause: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if m := status(); m.Status != mailgun.StatusPaused || m.PausedUntil == nil || m.Subscribed {
+		t.Fatalf("unexpected member %+v", m)
+	}
+
+	// The resume job subscribes the member again
+	var jobs []scheduler.Job
+	_ = json.Unmarshal(env.do(http.MethodGet, "/v1/jobs?status=pending", admin, nil).Body.Bytes(), &jobs)
+	if len(jobs) != 1 || jobs[0].Type != "resume_member" {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+	body := fmt.Sprintf(`{"run_at": %q}`, time.Now().Add(-time.Second).Format(time.RFC3339))
+	env.do(http.MethodPatch, "/v1/jobs/"+jobs[0].ID, admin, strings.NewReader(body))
+	scheduler.RunDue(context.Background(), lg)
+	if m := status(); m.Status != mailgun.StatusSubscribed {
+		t.Fatalf("not resumed: %+v", m)
+	}
+
+	// Resuming early
+	pause(time.Now().Add(time.Hour))
+	if rec := env.do(http.MethodDelete, memberPath+"/pause", user, nil); rec.Code != http.StatusOK {
+		t.Fatalf("resume: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if m := status(); m.Status != mailgun.StatusSubscribed {
+		t.Fatalf("not resumed: %+v", m)
+	}
+	if rec := env.do(http.MethodDelete, memberPath+"/pause", user, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("resume without pause: got %d", rec.Code)
+	}
+
+	// An explicit unsubscribe ends the pause and cancels its job
+	pause(time.Now().Add(time.Hour))
+	env.do(http.MethodDelete, memberPath, user, nil)
+	if m := status(); m.Status != mailgun.StatusUnsubscribed {
+		t.Fatalf("status %s", m.Status)
+	}
+	_ = json.Unmarshal(env.do(http.MethodGet, "/v1/jobs?status=pending", admin, nil).Body.Bytes(), &jobs)
+	if len(jobs) != 0 {
+		t.Fatalf("resume job was not cancelled: %+v", jobs)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	env := newTestEnv(t)
+	env.mock.AddList(mtypes.MailingList{Address: "events@lists.test", Name: "Events"})
+	user := env.token("user@example.test", false, nil)
+
+	save := func(body string) (*httptest.ResponseRecorder, mailing.PreferencesResponse) {
+		t.Helper()
+		rec := env.do(http.MethodPut, "/v1/me/preferences", user, strings.NewReader(body))
+		var resp mailing.PreferencesResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	outcomes := func(resp mailing.PreferencesResponse) map[string]subscriptions.Outcome {
+		result := map[string]subscriptions.Outcome{}
+		for _, r := range resp.Results {
+			result[r.List] = r.Outcome
+		}
+		return result
+	}
+
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	rec, resp := save(`{"subscribed": ["events@lists.test"]}`)
+	if rec.Code != http.StatusOK || !resp.Applied {
+		t.Fatalf("save: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if o := outcomes(resp); o["events@lists.test"] != subscriptions.OutcomeApplied || o["news@lists.test"] != subscriptions.OutcomeApplied || o["blocked@lists.test"] != subscriptions.OutcomeUnchanged {
+		t.Fatalf("unexpected outcomes %+v", o)
+	}
+
+	rec = env.do(http.MethodGet, "/v1/me/preferences", user, nil)
+	var prefs []subscriptions.ListPreference
+	if err := json.Unmarshal(rec.Body.Bytes(), &prefs); err != nil || len(prefs) != 3 {
+		t.Fatalf("preferences: %s", rec.Body.String())
+	}
+	for _, p := range prefs {
+		if p.Subscribed != (p.List == "events@lists.test") {
+			t.Fatalf("unexpected preference %+v", p)
+		}
+	}
+
+	for _, body := range []string{`{"subscribed": ["hidden@lists.test"]}`, `{"subscribed": ["blocked@lists.test"]}`} {
+		if rec, _ := save(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d", body, rec.Code)
+		}
+	}
+
+	// Subscribing to news fails after events was unsubscribed, which is rolled back
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists/news@lists.test/members", Status: http.StatusInternalServerError})
+	rec, resp = save(`{"subscribed": ["news@lists.test"]}`)
+	env.mock.ClearFaults()
+	if rec.Code != http.StatusBadGateway || resp.Applied {
+		t.Fatalf("failing save: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if o := outcomes(resp); o["events@lists.test"] != subscriptions.OutcomeRolledBack || o["news@lists.test"] != subscriptions.OutcomeFailed {
+		t.Fatalf("unexpected outcomes %+v", o)
+	}
+	if _, ok := env.mock.Member("events@lists.test", "user@example.test"); !ok {
+		t.Fatal("unsubscribe was not rolled back")
+	}
+	if _, ok := env.mock.Member("news@lists.test", "user@example.test"); ok {
+		t.Fatal("failed subscribe created a member")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+	// Weekly digests are not due today
+	t.Setenv("DIGEST_WEEKDAY", time.Now().UTC().Add(24*time.Hour).Weekday().String())
+
+	setDelivery := func(delivery string) (*httptest.ResponseRecorder, mailgun.Member) {
+		t.Helper()
+		rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test/delivery", user, strings.NewReader(`{"delivery": "`+delivery+`"}`))
+		var m mailgun.Member
+		_ = json.Unmarshal(rec.Body.Bytes(), &m)
+		return rec, m
+	}
+	if rec, _ := setDelivery("daily"); rec.Code != http.StatusNotFound {
+		t.Fatalf("delivery of non-member: got %d", rec.Code)
+	}
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	if rec, _ := setDelivery("hourly"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid delivery: got %d", rec.Code)
+	}
+	rec, m := setDelivery("daily")
+	if rec.Code != http.StatusOK || m.Status != mailgun.StatusDigest || m.Delivery != mailgun.DeliveryDaily {
+		t.Fatalf("daily: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if stored, _ := env.mock.Member("news@lists.test", "user@example.test"); *stored.Subscribed || stored.Vars[mailgun.DeliveryVar] != "daily" {
+		t.Fatalf("digest member is not unsubscribed in Mailgun: %+v", stored)
+	}
+	rec = env.do(http.MethodPatch, "/v1/lists/news@lists.test/members/user@example.test", user, strings.NewReader(`{"vars": {"delivery": "weekly"}}`))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("patching the delivery var: got %d", rec.Code)
+	}
+
+	for _, subject := range []string{"First", "Second"} {
+		form := url.Values{"subject": {subject}, "html": {"<p>Body of " + subject + "</p>"}}
+		rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/messages", admin, strings.NewReader(form.Encode()),
+			"Content-Type", "application/x-www-form-urlencoded")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("send: got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	sent, err := digest.Send(context.Background(), time.Now())
+	if err != nil || sent != 1 {
+		t.Fatalf("digests: sent %d, %v", sent, err)
+	}
+	msgs := env.mock.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages", len(msgs))
+	}
+	d := msgs[2]
+	if !slices.Equal(d.To, []string{"user@example.test"}) || d.Subject != "News: your daily digest (2 messages)" {
+		t.Fatalf("unexpected digest: %+v", d)
+	}
+	if !strings.Contains(d.Text, "First") || !strings.Contains(d.Text, "Body of Second") || !strings.Contains(d.Form.Get("recipient-variables"), "Test User") {
+		t.Fatalf("unexpected digest content: %s", d.Text)
+	}
+	if sent, err := digest.Send(context.Background(), time.Now()); err != nil || sent != 0 {
+		t.Fatalf("second run: sent %d, %v", sent, err)
+	}
+
+	// Subscribing again keeps the digest, immediate delivery subscribes the member
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	rec = env.do(http.MethodGet, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	if !strings.Contains(rec.Body.String(), `"status":"digest"`) {
+		t.Fatalf("subscribe ended the digest: %s", rec.Body.String())
+	}
+	if rec, m := setDelivery("immediate"); rec.Code != http.StatusOK || m.Status != mailgun.StatusSubscribed {
+		t.Fatalf("immediate: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if stored, _ := env.mock.Member("news@lists.test", "user@example.test"); !*stored.Subscribed || stored.Vars[mailgun.DeliveryVar] != nil {
+		t.Fatalf("member is not subscribed again: %+v", stored)
+	}
+}
+
+func TestDataExport(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	env.do(http.MethodPut, "/v1/lists/hidden@lists.test/members/user@example.test", admin, nil)
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test", admin, nil)
+	env.mock.AddBounce(mtypes.Bounce{Address: "user@example.test", Code: "550", Error: "mailbox full"})
+	env.mock.AddBounce(mtypes.Bounce{Address: "other-user@example.test", Code: "550"})
+	ts := float64(time.Now().Add(-time.Hour).Unix())
+	env.mock.AddEvent(map[string]any{"event": "delivered", "recipient": "user@example.test", "timestamp": ts, "user-variables": map[string]any{"list": "news@lists.test"}})
+	env.mock.AddEvent(map[string]any{"event": "delivered", "recipient": "other@example.test", "timestamp": ts})
+
+	rec := env.do(http.MethodGet, "/v1/me/data", user, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Disposition"), `filename="data-user@example.test.json"`) {
+		t.Fatalf("export: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var export dataExport.Export
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Memberships) != 2 || len(export.Suppressions) != 1 || len(export.Events) != 1 || export.Events[0].List != "news@lists.test" {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+	if len(export.AuditLog) != 2 || export.AuditLog[0].Action != "subscribe" || export.AuditLog[1].Actor != "admin@example.test" {
+		t.Fatalf("unexpected audit log: %+v", export.AuditLog)
+	}
+
+	if rec := env.do(http.MethodGet, "/v1/members/user@example.test/data", user, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin export of an address: got %d", rec.Code)
+	}
+	rec = env.do(http.MethodGet, "/v1/members/user@example.test/data?format=zip", admin, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("zip export: got %d: %s", rec.Code, rec.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !slices.Equal(names, []string{"manifest.json", "memberships.json", "suppressions.json", "events.json", "submissions.json", "consents.json", "roles.json", "audit_log.json"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+	f, _ := zr.Open("audit_log.json")
+	var entries []map[string]any
+	_ = json.NewDecoder(f).Decode(&entries)
+	// The first export is logged as well
+	if len(entries) != 3 || entries[2]["action"] != "export_data" {
+		t.Fatalf("unexpected audit log in archive: %v", entries)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/data?format=xml", user, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid format: got %d", rec.Code)
+	}
+
+	// A token merely claiming the address gets nothing, even without the subscribe check
+	t.Setenv("REQUIRE_EMAIL_VERIFIED", "false")
+	unverified := env.token("user@example.test", false, jwt.MapClaims{"email_verified": false})
+	if rec := env.do(http.MethodGet, "/v1/me/data", unverified, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified export: got %d", rec.Code)
+	}
+}
+
+func TestErasure(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("MAILGUN_MODERATED_MAILING_LISTS", "news@lists.test")
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	env.do(http.MethodPut, "/v1/lists/hidden@lists.test/members/user@example.test", admin, nil)
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test", admin, nil)
+	env.mock.AddBounce(mtypes.Bounce{Address: "user@example.test", Code: "550"})
+	env.mock.AddComplaint(mtypes.Complaint{Address: "user@example.test"})
+	if rec := env.do(http.MethodPost, "/v1/lists/news@lists.test/submissions", user, strings.NewReader(`{"subject": "Hi", "text": "Hello"}`)); rec.Code != http.StatusCreated {
+		t.Fatalf("submit: got %d", rec.Code)
+	}
+	pause := fmt.Sprintf(`{"until": %q}`, time.Now().Add(24*time.Hour).Format(time.RFC3339))
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test/pause", admin, strings.NewReader(pause)); rec.Code != http.StatusOK {
+		t.Fatalf("pause: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.do(http.MethodDelete, "/v1/members/user@example.test", user, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin erasure: got %d", rec.Code)
+	}
+	client := env.token("", false, jwt.MapClaims{"email": nil, "given_name": nil, "family_name": nil, "groups": nil,
+		"client_id": "batch", "scope": "members:write"})
+	if rec := env.do(http.MethodDelete, "/v1/members/user@example.test", client, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("erasure without admin scope: got %d", rec.Code)
+	}
+	// Only the owner of the address can erase it
+	t.Setenv("REQUIRE_EMAIL_VERIFIED", "false")
+	unverified := env.token("user@example.test", false, jwt.MapClaims{"email_verified": false})
+	if rec := env.do(http.MethodDelete, "/v1/me", unverified, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified erasure: got %d", rec.Code)
+	}
+	rec := env.do(http.MethodDelete, "/v1/me", user, nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("erase: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var e erasure.Erasure
+	_ = json.Unmarshal(rec.Body.Bytes(), &e)
+	if e.Status != erasure.StatusPending || !strings.HasPrefix(e.Pseudonym, "erased:") || e.RequestedBy != e.Pseudonym {
+		t.Fatalf("unexpected erasure: %+v", e)
+	}
+	// A second request returns the pending erasure
+	rec = env.do(http.MethodDelete, "/v1/members/user@example.test", admin, nil)
+	if !strings.Contains(rec.Body.String(), e.ID) {
+		t.Fatalf("second erasure: %s", rec.Body.String())
+	}
+
+	// Removing the bounce fails, the erasure stops after the memberships
+	env.mock.Inject(mailgunmock.Fault{Method: http.MethodDelete, Path: "/v3/lists.test/bounces", Status: http.StatusInternalServerError})
+	scheduler.RunDue(context.Background(), lg)
+	env.mock.ClearFaults()
+	e, _ = erasure.Get(e.ID)
+	if e.Status != erasure.StatusPending || !e.Steps[0].Done || e.Steps[0].Count != 2 || e.Steps[1].Done || e.Steps[1].Error == "" {
+		t.Fatalf("unexpected erasure after failure: %+v", e)
+	}
+	if _, ok := env.mock.Member("hidden@lists.test", "user@example.test"); ok {
+		t.Fatal("member was not removed from the hidden list")
+	}
+
+	// The retry continues with the suppressions
+	payload, _ := json.Marshal(map[string]string{"id": e.ID})
+	if err := erasure.RunJob(context.Background(), scheduler.Job{Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	rec = env.do(http.MethodGet, "/v1/erasures/"+e.ID, admin, nil)
+	e = erasure.Erasure{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &e)
+	if e.Status != erasure.StatusCompleted || e.Address != "" || e.CompletedAt == nil {
+		t.Fatalf("unexpected receipt: %s", rec.Body.String())
+	}
+	if e.Steps[1].Count != 1 || e.Steps[1].Detail != "kept complaints" || e.Steps[2].Count != 1 || e.Steps[3].Count != 2 || e.Steps[6].Count != 1 || e.Steps[7].Count != 3 {
+		t.Fatalf("unexpected steps: %+v", e.Steps)
+	}
+	if env.mock.Suppressed("bounces", "user@example.test") || !env.mock.Suppressed("complaints", "user@example.test") {
+		t.Fatal("unexpected suppressions")
+	}
+	if _, ok := env.mock.Member("news@lists.test", "other@example.test"); !ok {
+		t.Fatal("other member was removed")
+	}
+	jobs, _ := scheduler.List("")
+	for _, job := range jobs {
+		if strings.Contains(string(job.Payload)+job.IdempotencyKey, "user@example.test") {
+			t.Fatalf("job still refers to the address: %+v", job)
+		}
+		if job.Type == subscriptions.ResumeJob && job.Status != scheduler.StatusCancelled {
+			t.Fatalf("pause still ends: %+v", job)
+		}
+	}
+
+	export, err := dataExport.Collect(context.Background(), e.Pseudonym)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The subscribes and the pause of the user and the erasure itself
+	if len(export.AuditLog) != 4 || export.AuditLog[3].Action != "erase" {
+		t.Fatalf("unexpected audit log: %+v", export.AuditLog)
+	}
+	if len(export.Consents) != 2 || export.Consents[0].IP != "" || export.Consents[0].UserAgent != "" {
+		t.Fatalf("unexpected consents: %+v", export.Consents)
+	}
+	if export, _ := dataExport.Collect(context.Background(), "user@example.test"); len(export.AuditLog) != 0 || len(export.Submissions) != 0 {
+		t.Fatalf("address is still stored: %+v", export)
+	}
+}
+
+func TestConsent(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("PRIVACY_POLICY_VERSION", "v1")
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+
+	rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil, "User-Agent", "test-agent")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test?consent_source=paper", admin, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid source: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test?consent_source=import", user, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("source set by non-admin: got %d", rec.Code)
+	}
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/other@example.test?consent_source=import", admin, nil)
+
+	var resp mailing.ConsentsResponse
+	rec = env.do(http.MethodGet, "/v1/me/consents", user, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Records) != 1 {
+		t.Fatalf("unexpected consents: %s", rec.Body.String())
+	}
+	c := resp.Records[0]
+	if c.Source != "self" || c.PolicyVersion != "v1" || c.UserAgent != "test-agent" || c.IP == "" || c.ListName != "News" || c.WithdrawnAt != nil {
+		t.Fatalf("unexpected consent: %+v", c)
+	}
+	rec = env.do(http.MethodGet, "/v1/members/other@example.test/consents", admin, nil)
+	if !strings.Contains(rec.Body.String(), `"source":"import"`) {
+		t.Fatalf("unexpected consents of other: %s", rec.Body.String())
+	}
+
+	// A new policy version requiring re-consent
+	if rec := env.do(http.MethodPut, "/v1/consents/policy", user, strings.NewReader(`{"version": "v2", "require_reconsent": true}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin policy: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/consents/policy", admin, strings.NewReader(`{"version": "v2", "require_reconsent": true}`)); rec.Code != http.StatusOK {
+		t.Fatalf("policy: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var pending []map[string]string
+	rec = env.do(http.MethodGet, "/v1/consents/pending?list=news@lists.test", admin, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &pending)
+	if len(pending) != 2 || pending[0]["policy_version"] != "v1" {
+		t.Fatalf("unexpected pending: %s", rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/consents/pending?list=unknown@lists.test", admin, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown list: got %d", rec.Code)
+	}
+	resp = mailing.ConsentsResponse{}
+	rec = env.do(http.MethodGet, "/v1/me/consents", user, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	if !slices.Equal(resp.ReconsentRequired, []string{"news@lists.test"}) {
+		t.Fatalf("unexpected re-consent: %s", rec.Body.String())
+	}
+
+	// Subscribing again records consent to v2, unsubscribing withdraws consent
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/other@example.test", admin, nil)
+	rec = env.do(http.MethodGet, "/v1/consents/pending", admin, nil)
+	if rec.Body.String() != "[]\n" {
+		t.Fatalf("unexpected pending after re-consent: %s", rec.Body.String())
+	}
+	rec = env.do(http.MethodGet, "/v1/members/other@example.test/consents", admin, nil)
+	if !strings.Contains(rec.Body.String(), `"withdrawn_at"`) {
+		t.Fatalf("consent was not withdrawn: %s", rec.Body.String())
+	}
+
+	// Without a consent record nobody is subscribed
+	restore := env.breakStore()
+	rec = env.do(http.MethodPut, "/v1/lists/news@lists.test/members/new@example.test", env.token("new@example.test", false, nil), nil)
+	restore()
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("subscribe without consent: got %d", rec.Code)
+	}
+	if _, ok := env.mock.Member("news@lists.test", "new@example.test"); ok {
+		t.Fatal("member was subscribed without consent")
+	}
+	// The consent of a failed subscription is discarded
+	if rec := env.do(http.MethodPut, "/v1/lists/blocked@lists.test/members/user@example.test", user, nil); rec.Code == http.StatusOK {
+		t.Fatal("subscribed to a blocked list")
+	}
+	if export, _ := consent.For("user@example.test"); len(export) != 2 {
+		t.Fatalf("unexpected consents after failed subscription: %+v", export)
+	}
+	env.mock.AddList(mtypes.MailingList{Address: "events@lists.test", Name: "Events"})
+	mailgun.InvalidateLists()
+	restore = env.breakStore()
+	rec = env.do(http.MethodPut, "/v1/me/preferences", user, strings.NewReader(`{"subscribed": ["news@lists.test", "events@lists.test"]}`))
+	restore()
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "failed to record consent") {
+		t.Fatalf("preferences without consent: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := env.mock.Member("events@lists.test", "user@example.test"); ok {
+		t.Fatal("member was subscribed without consent")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("WEBHOOK_RETRY_BASE", "1ms")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "2")
+	lg := slog.New(slog.NewTextHandler(io.Discard, nil))
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+
+	var (
+		mu       sync.Mutex
+		fail     = true
+		received []*http.Request
+		bodies   [][]byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received, bodies = append(received, r), append(bodies, body)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	if rec := env.do(http.MethodPost, "/v1/webhooks", user, strings.NewReader(`{"url": "`+srv.URL+`"}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPost, "/v1/webhooks", admin, strings.NewReader(`{"url": "`+srv.URL+`", "events": ["member.joined"]}`)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown event type: got %d", rec.Code)
+	}
+	rec := env.do(http.MethodPost, "/v1/webhooks", admin, strings.NewReader(`{"url": "`+srv.URL+`", "events": ["member.subscribed"], "secret": "s3cret"}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var hook webhooks.Webhook
+	_ = json.Unmarshal(rec.Body.Bytes(), &hook)
+	if rec := env.do(http.MethodGet, "/v1/webhooks/"+hook.ID, admin, nil); strings.Contains(rec.Body.String(), "s3cret") {
+		t.Fatalf("secret returned: %s", rec.Body.String())
+	}
+
+	// The receiver fails both attempts, the delivery is dead-lettered
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/user@example.test", user, nil)
+	scheduler.RunDue(context.Background(), lg)
+	time.Sleep(10 * time.Millisecond)
+	scheduler.RunDue(context.Background(), lg)
+	var dead []webhooks.Delivery
+	rec = env.do(http.MethodGet, "/v1/webhooks/"+hook.ID+"/deliveries?status=dead", admin, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &dead)
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].StatusCode != http.StatusInternalServerError || dead[0].Event.Type != "member.subscribed" {
+		t.Fatalf("unexpected dead letters: %s", rec.Body.String())
+	}
+	if len(received) != 2 {
+		t.Fatalf("got %d requests, want 2", len(received))
+	}
+
+	// Redelivery succeeds
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	path := "/v1/webhooks/" + hook.ID + "/deliveries/" + dead[0].ID + "/redeliver"
+	if rec := env.do(http.MethodPost, path, admin, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("redeliver: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodPost, path, admin, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("redeliver pending: got %d", rec.Code)
+	}
+	scheduler.RunDue(context.Background(), lg)
+	rec = env.do(http.MethodGet, "/v1/webhooks/"+hook.ID+"/deliveries?status=delivered", admin, nil)
+	if !strings.Contains(rec.Body.String(), dead[0].ID) {
+		t.Fatalf("not delivered: %s", rec.Body.String())
+	}
+
+	r, body := received[2], bodies[2]
+	var e events.Event
+	_ = json.Unmarshal(body, &e)
+	if e.Type != events.MemberSubscribed || e.List != "news@lists.test" || e.Member != "user@example.test" || r.Header.Get("X-Webhook-ID") != dead[0].ID {
+		t.Fatalf("unexpected event: %s", body)
+	}
+	sig := r.Header.Get("X-Webhook-Signature")
+	ts, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(sig, ",")[0], "t="), 10, 64)
+	if sig != webhooks.Sign("s3cret", time.Unix(ts, 0), body) {
+		t.Fatalf("invalid signature %q", sig)
+	}
+
+	if rec := env.do(http.MethodDelete, "/v1/webhooks/"+hook.ID, admin, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/webhooks/"+hook.ID+"/deliveries", admin, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("deliveries of deleted webhook: got %d", rec.Code)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("EVENTS_BUFFER_SIZE", "3")
+	srv := httptest.NewServer(env.handler)
+	defer srv.Close()
+	admin := env.token("admin@example.test", true, nil)
+	moderator := env.token("mod@example.test", false, jwt.MapClaims{"groups": []any{"Users", "Moderator:news@lists.test"}})
+
+	// stream connects and returns the IDs and types of the first n events.
+	stream := func(token, lastEventID string, n int, during func()) []string {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/events/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+			t.Fatalf("got %d %s", resp.StatusCode, ct)
+		}
+		if during != nil {
+			during()
+		}
+		var got []string
+		var id string
+		scanner := bufio.NewScanner(resp.Body)
+		for len(got) < n && scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case line == "event: reset":
+				got = append(got, "reset")
+			case strings.HasPrefix(line, "data: ") && id != "":
+				var e events.Event
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+				got = append(got, id+" "+string(e.Type)+" "+e.List)
+				id = ""
+			}
+		}
+		return got
+	}
+
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/a@example.test", admin, nil)
+	env.do(http.MethodPut, "/v1/lists/hidden@lists.test/members/b@example.test", admin, nil)
+	env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/a@example.test", admin, nil)
+
+	// Resuming: the moderator only receives the events of the news list
+	got := stream(moderator, "0", 2, nil)
+	if !slices.Equal(got, []string{"1 member.subscribed news@lists.test", "3 member.unsubscribed news@lists.test"}) {
+		t.Fatalf("unexpected backlog: %q", got)
+	}
+	got = stream(admin, "2", 1, nil)
+	if !slices.Equal(got, []string{"3 member.unsubscribed news@lists.test"}) {
+		t.Fatalf("unexpected resumed events: %q", got)
+	}
+
+	// Live events
+	got = stream(moderator, "", 1, func() {
+		env.do(http.MethodPut, "/v1/lists/hidden@lists.test/members/c@example.test", admin, nil)
+		env.do(http.MethodPut, "/v1/lists/news@lists.test/members/c@example.test", admin, nil)
+	})
+	if !slices.Equal(got, []string{"5 member.subscribed news@lists.test"}) {
+		t.Fatalf("unexpected live events: %q", got)
+	}
+
+	// Event 1 was dropped from the buffer of three
+	got = stream(admin, "0", 4, nil)
+	if !slices.Equal(got, []string{"reset", "3 member.unsubscribed news@lists.test", "4 member.subscribed hidden@lists.test", "5 member.subscribed news@lists.test"}) {
+		t.Fatalf("unexpected events after reset: %q", got)
+	}
+
+	// List changes
+	got = stream(moderator, "", 1, func() {
+		env.do(http.MethodPut, "/v1/lists/news@lists.test/schema", admin, strings.NewReader(`{"fields": []}`))
+	})
+	if !slices.Equal(got, []string{"6 list.updated news@lists.test"}) {
+		t.Fatalf("unexpected list events: %q", got)
+	}
+}
+
+func TestMachineAuth(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	user := env.token("user@example.test", false, nil)
+
+	if rec := env.do(http.MethodPost, "/v1/api-keys", user, strings.NewReader(`{"name": "crm", "scopes": ["lists:read"]}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-admin: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPost, "/v1/api-keys", admin, strings.NewReader(`{"name": "crm", "scopes": ["everything"]}`)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("unknown scope: got %d", rec.Code)
+	}
+	rec := env.do(http.MethodPost, "/v1/api-keys", admin, strings.NewReader(`{"name": "crm", "scopes": ["lists:read", "members:write"]}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created mailing.APIKeyResponse
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Key, "mlk_") || created.Hash != "" {
+		t.Fatalf("unexpected key: %s", rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/api-keys", admin, nil); strings.Contains(rec.Body.String(), `"hash"`) {
+		t.Fatalf("hash listed: %s", rec.Body.String())
+	}
+
+	// The key works within its scopes, as bearer token and as X-API-Key
+	if rec := env.do(http.MethodGet, "/v1/lists", created.Key, nil); rec.Code != http.StatusOK {
+		t.Fatalf("lists: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", "", nil, "X-API-Key", created.Key); rec.Code != http.StatusOK {
+		t.Fatalf("subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", created.Key, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("missing scope: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", created.Key, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("user route: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists", created.Key+"x", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: got %d", rec.Code)
+	}
+	export, _ := dataExport.Collect(context.Background(), "jane@example.test")
+	if len(export.AuditLog) != 1 || export.AuditLog[0].Actor != "api-key:crm:"+created.ID {
+		t.Fatalf("unexpected audit log: %+v", export.AuditLog)
+	}
+
+	if rec := env.do(http.MethodDelete, "/v1/api-keys/"+created.ID, admin, nil); rec.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists", created.Key, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key: got %d", rec.Code)
+	}
+
+	// A Keycloak client credentials token without user claims
+	client := env.token("", false, jwt.MapClaims{"email": nil, "given_name": nil, "family_name": nil, "groups": nil,
+		"client_id": "batch", "scope": "profile members:read"})
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", client, nil); rec.Code != http.StatusOK {
+		t.Fatalf("client token: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/jane@example.test", client, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("client token without scope: got %d", rec.Code)
+	}
+	// User tokens without name claims do not break
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", env.token("nameless@example.test", false, jwt.MapClaims{"given_name": nil}), nil); rec.Code != http.StatusOK {
+		t.Fatalf("token without name: got %d", rec.Code)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	env := newTestEnv(t)
+
+	// Missing or mistyped claims are rejected instead of yielding an empty user
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", env.token("", false, jwt.MapClaims{"email": nil}), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("missing email: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", env.token("jane@example.test", false, jwt.MapClaims{"groups": "Users"}), nil); rec.Code != http.StatusOK {
+		t.Fatalf("single group: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", env.token("jane@example.test", false, jwt.MapClaims{"groups": 42}), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("invalid groups: got %d", rec.Code)
+	}
+
+	// Unverified addresses cannot subscribe themselves
+	unverified := env.token("jane@example.test", false, jwt.MapClaims{"email_verified": false})
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", unverified, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified subscribe: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/me/preferences", unverified, strings.NewReader(`{"subscribed": ["news@lists.test"]}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified preferences: got %d", rec.Code)
+	}
+	stringVerified := env.token("jane@example.test", false, jwt.MapClaims{"email_verified": "true"})
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", stringVerified, nil); rec.Code != http.StatusOK {
+		t.Fatalf("verified subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	// ...but can stay subscribed and leave
+	if rec := env.do(http.MethodPut, "/v1/me/preferences", unverified, strings.NewReader(`{"subscribed": ["news@lists.test"]}`)); rec.Code != http.StatusOK {
+		t.Fatalf("unverified keeps list: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodPut, "/v1/me/preferences", unverified, strings.NewReader(`{"subscribed": ["News@Lists.test"]}`)); rec.Code != http.StatusOK {
+		t.Fatalf("unverified keeps list in other case: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodDelete, "/v1/lists/news@lists.test/members/jane@example.test", unverified, nil); rec.Code != http.StatusOK {
+		t.Fatalf("unverified unsubscribe: got %d", rec.Code)
+	}
+
+	// Custom claim names and nested roles
+	t.Setenv("CLAIM_EMAIL", "upn")
+	t.Setenv("CLAIM_ROLES", "$.realm_access.roles")
+	t.Setenv("ADMIN_ROLE", "mailinglist-admin")
+	roleAdmin := env.token("", false, jwt.MapClaims{"email": nil, "upn": "ops@example.test",
+		"realm_access": map[string]any{"roles": []any{"offline_access", "mailinglist-admin"}}})
+	if rec := env.do(http.MethodGet, "/v1/webhooks", roleAdmin, nil); rec.Code != http.StatusOK {
+		t.Fatalf("role admin: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/webhooks", env.token("jane@example.test", false, nil), nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token without upn: got %d", rec.Code)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token("admin@example.test", true, nil)
+	jane := env.token("jane@example.test", false, nil)
+	env.do(http.MethodPut, "/v1/lists/news@lists.test/members/bob@example.test", admin, nil)
+	env.do(http.MethodPut, "/v1/lists/blocked@lists.test/members/bob@example.test", admin, nil)
+
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/bob@example.test", jane, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("no role: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/roles/jane@example.test", jane, strings.NewReader(`{"role": "viewer"}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("grant by non-admin: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/roles/jane@example.test", admin, strings.NewReader(`{"role": "admin"}`)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("admin role: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/unknown@lists.test/roles/jane@example.test", admin, strings.NewReader(`{"role": "viewer"}`)); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown list: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/roles/jane@example.test", admin, strings.NewReader(`{"role": "viewer"}`)); rec.Code != http.StatusOK {
+		t.Fatalf("grant: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Viewers read the members of their list only, and change nobody
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/bob@example.test", jane, nil); rec.Code != http.StatusOK {
+		t.Fatalf("viewer: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/blocked@lists.test/members/bob@example.test", jane, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer of other list: got %d", rec.Code)
+	}
+	// A grant belongs to the owner of the address
+	t.Setenv("REQUIRE_EMAIL_VERIFIED", "false")
+	unverified := env.token("jane@example.test", false, jwt.MapClaims{"email_verified": false})
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/bob@example.test", unverified, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("unverified viewer: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodPatch, "/v1/lists/news@lists.test/members/bob@example.test", jane, strings.NewReader(`{"name": "Bob"}`)); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer update: got %d", rec.Code)
+	}
+
+	// Owners from a Keycloak group manage members and the schema
+	owner := env.token("jane@example.test", false, jwt.MapClaims{"groups": []any{"Users", "/Owner:news@lists.test"}})
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/carol@example.test", owner, nil); rec.Code != http.StatusOK {
+		t.Fatalf("owner subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/schema", owner, strings.NewReader(`{"fields": []}`)); rec.Code != http.StatusOK {
+		t.Fatalf("owner schema: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/suppressions", owner, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("owner admin route: got %d", rec.Code)
+	}
+	var mine mailing.MyRolesResponse
+	rec := env.do(http.MethodGet, "/v1/me/roles", owner, nil)
+	_ = json.Unmarshal(rec.Body.Bytes(), &mine)
+	if mine.Admin || len(mine.Lists) != 1 || mine.Lists["news@lists.test"] != roles.RoleOwner {
+		t.Fatalf("unexpected roles: %s", rec.Body.String())
+	}
+
+	rec = env.do(http.MethodGet, "/v1/lists/news@lists.test/roles", admin, nil)
+	if !strings.Contains(rec.Body.String(), `"role":"viewer"`) || !strings.Contains(rec.Body.String(), `"granted_by":"admin@example.test"`) {
+		t.Fatalf("unexpected grants: %s", rec.Body.String())
+	}
+	if rec := env.do(http.MethodDelete, "/v1/lists/news@lists.test/roles/jane@example.test", admin, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodDelete, "/v1/lists/news@lists.test/roles/jane@example.test", admin, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("revoke again: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/bob@example.test", jane, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("revoked viewer: got %d", rec.Code)
+	}
+	export, _ := dataExport.Collect(context.Background(), "jane@example.test")
+	if len(export.AuditLog) != 3 || export.AuditLog[0].Action != "grant_role" || export.AuditLog[2].Action != "revoke_role" || len(export.Roles) != 0 {
+		t.Fatalf("unexpected audit log: %+v", export.AuditLog)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	env := newTestEnv(t)
+	env.mock.AddList(mtypes.MailingList{Address: "events@lists.test", Name: "Events"})
+	jane := env.token("jane@example.test", false, jwt.MapClaims{"email_verified": false})
+	support := env.token("support@example.test", false, jwt.MapClaims{"groups": []any{"Users", "Support"}})
+	user := env.token("user@example.test", false, nil)
+	env.do(http.MethodPut, "/v1/me/preferences", env.token("jane@example.test", false, nil), strings.NewReader(`{"subscribed": ["news@lists.test"]}`))
+
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", user, nil, "X-Act-As", "jane@example.test"); rec.Code != http.StatusForbidden {
+		t.Fatalf("without permission: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", support, nil, "X-Act-As", "not an address"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid address: got %d", rec.Code)
+	}
+
+	// Support sees and changes what jane sees
+	rec := env.do(http.MethodGet, "/v1/me/preferences?act_as=jane@example.test", support, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Acting-As") != "jane@example.test" || !strings.Contains(rec.Body.String(), `"subscribed":true`) {
+		t.Fatalf("impersonated preferences: got %d %v: %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	rec = env.do(http.MethodPut, "/v1/me/preferences", support, strings.NewReader(`{"subscribed": ["news@lists.test", "events@lists.test"]}`), "X-Act-As", "jane@example.test")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("impersonated save: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", jane, nil); strings.Count(rec.Body.String(), `"subscribed":true`) != 2 {
+		t.Fatalf("jane's preferences: %s", rec.Body.String())
+	}
+	// Other routes ignore the header
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", support, nil, "X-Act-As", "jane@example.test"); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-me route: got %d", rec.Code)
+	}
+
+	export, _ := dataExport.Collect(context.Background(), "jane@example.test")
+	var impersonated, subscribed *audit.Entry
+	for i, e := range export.AuditLog {
+		switch e.Action {
+		case "impersonate":
+			impersonated = &export.AuditLog[i]
+		case "subscribe":
+			if e.List == "events@lists.test" {
+				subscribed = &export.AuditLog[i]
+			}
+		}
+	}
+	if impersonated == nil || impersonated.Actor != "support@example.test" || impersonated.OnBehalfOf != "jane@example.test" {
+		t.Fatalf("impersonation not audited: %+v", export.AuditLog)
+	}
+	if subscribed == nil || subscribed.Actor != "support@example.test" || subscribed.OnBehalfOf != "jane@example.test" || subscribed.Subject != "jane@example.test" {
+		t.Fatalf("change not audited with both identities: %+v", export.AuditLog)
+	}
+	if i := slices.IndexFunc(export.Consents, func(c consent.Record) bool { return c.List == "events@lists.test" }); i < 0 || export.Consents[i].Source != consent.SourceAdmin {
+		t.Fatalf("unexpected consents: %+v", export.Consents)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	env := newTestEnv(t)
+	introspection.Reset()
+	t.Cleanup(introspection.Reset)
+
+	// A local introspection endpoint authenticating the service with client credentials
+	var calls atomic.Int32
+	exp := time.Now().Add(time.Hour).Unix()
+	responses := map[string]map[string]any{
+		"opaque-user": {"active": true, "client_id": "frontend", "username": "jane", "sub": "sub-jane",
+			"email": "jane@example.test", "email_verified": true, "groups": []any{"Users"}, "exp": exp},
+		"opaque-service": {"active": true, "client_id": "batch", "username": "service-account-batch", "scope": "members:read", "exp": exp},
+		"opaque-client":  {"active": true, "client_id": "crm", "sub": "crm", "scope": "members:read", "exp": exp},
+		// Neither a user nor marked as a service account
+		"opaque-unknown": {"active": true, "client_id": "frontend", "scope": "members:read admin", "exp": exp},
+		"opaque-expired": {"active": true, "client_id": "frontend", "username": "jane", "email": "jane@example.test",
+			"exp": time.Now().Add(-time.Minute).Unix()},
+	}
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "mailinglist" || secret != "s3cret" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		resp, ok := responses[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]any{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(stub.Close)
+
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", "opaque-user", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without introspection: got %d", rec.Code)
+	}
+	t.Setenv("INTROSPECTION_URL", stub.URL)
+	t.Setenv("INTROSPECTION_CLIENT_ID", "mailinglist")
+	t.Setenv("INTROSPECTION_CLIENT_SECRET", "s3cret")
+
+	for range 2 {
+		if rec := env.do(http.MethodGet, "/v1/me/preferences", "opaque-user", nil); rec.Code != http.StatusOK {
+			t.Fatalf("opaque user token: got %d", rec.Code)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("active token not cached: %d calls", n)
+	}
+	if rec := env.do(http.MethodPut, "/v1/lists/news@lists.test/members/jane@example.test", "opaque-user", nil); rec.Code != http.StatusOK {
+		t.Fatalf("opaque user subscribe: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Service account tokens are machine clients with their scopes
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", "opaque-service", nil); rec.Code != http.StatusOK {
+		t.Fatalf("opaque service token: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/me/preferences", "opaque-service", nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("opaque service token on user route: got %d", rec.Code)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists/news@lists.test/members/jane@example.test", "opaque-client", nil); rec.Code != http.StatusOK {
+		t.Fatalf("opaque client token: got %d", rec.Code)
+	}
+	for _, path := range []string{"/v1/lists/news@lists.test/members/jane@example.test", "/v1/webhooks"} {
+		if rec := env.do(http.MethodGet, path, "opaque-unknown", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("unmarked client token on %s: got %d", path, rec.Code)
+		}
+	}
+
+	calls.Store(0)
+	for range 2 {
+		if rec := env.do(http.MethodGet, "/v1/lists", "opaque-revoked", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("inactive token: got %d", rec.Code)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("inactive token cached: %d calls", n)
+	}
+	if rec := env.do(http.MethodGet, "/v1/lists", "opaque-expired", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expired token: got %d", rec.Code)
+	}
+
+	// JWTs are still validated locally
+	calls.Store(0)
+	if rec := env.do(http.MethodGet, "/v1/lists", env.token("jane@example.test", false, nil), nil); rec.Code != http.StatusOK || calls.Load() != 0 {
+		t.Fatalf("jwt: got %d after %d introspections", rec.Code, calls.Load())
+	}
+
+	introspection.Reset()
+	t.Setenv("INTROSPECTION_CLIENT_SECRET", "wrong")
+	if rec := env.do(http.MethodGet, "/v1/lists", "opaque-user", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong client secret: got %d", rec.Code)
+	}
+}
@@ -0,0 +1,270 @@
+// Package analytics aggregates Mailgun delivery events per list and message tag.
+//
+// Mailgun keeps events only for a few days and cannot filter them by mailing list, so
+// the events of the sending domain are pulled periodically by a scheduler job and
+// counted into hourly buckets in the local store. Events are attributed to a list by
+// the "list" variable every list message carries. Statistics are read from the local
+// aggregates only and can be re-bucketed by hour or day.
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bucket      = "stats"
+	stateBucket = "stats_state"
+
+	// SyncJob is the scheduler job type pulling new events from Mailgun.
+	SyncJob = "analytics_sync"
+
+	// maxPoints limits the length of a series.
+	maxPoints = 2000
+)
+
+// Counts are the number of events of each kind.
+type Counts struct {
+	Delivered    int `json:"delivered"`
+	Opened       int `json:"opened"`
+	Clicked      int `json:"clicked"`
+	Bounced      int `json:"bounced"`
+	Complained   int `json:"complained"`
+	Unsubscribed int `json:"unsubscribed"`
+}
+
+// Point is the aggregate of one time bucket starting at Start.
+type Point struct {
+	Start time.Time `json:"start"`
+	Counts
+}
+
+// Stats are the aggregated events of a list, optionally limited to a message tag.
+type Stats struct {
+	List     string    `json:"list" example:"news@example.com"`
+	Tag      string    `json:"tag,omitempty" example:"newsletter"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Interval string    `json:"interval" example:"day"`
+	Totals   Counts    `json:"totals"`
+	Series   []Point   `json:"series"`
+	// SyncedUntil is the time of the latest event pulled from Mailgun.
+	SyncedUntil *time.Time `json:"synced_until,omitempty"`
+}
+
+// cursor remembers the newest event counted. IDs are the events at exactly Timestamp,
+// which are returned again by the next sync.
+type cursor struct {
+	Timestamp float64  `json:"timestamp"`
+	IDs       []string `json:"ids"`
+}
+
+var (
+	// syncMu serializes syncs so that no event is counted twice
+	syncMu sync.Mutex
+
+	intervals = map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour}
+)
+
+func (c *Counts) add(o Counts) {
+	c.Delivered += o.Delivered
+	c.Opened += o.Opened
+	c.Clicked += o.Clicked
+	c.Bounced += o.Bounced
+	c.Complained += o.Complained
+	c.Unsubscribed += o.Unsubscribed
+}
+
+// countsOf returns the counts of a single event and false for events that are not counted.
+func countsOf(e mailgun.DeliveryEvent) (Counts, bool) {
+	var c Counts
+	switch e.Name {
+	case "delivered":
+		c.Delivered = 1
+	case "opened":
+		c.Opened = 1
+	case "clicked":
+		c.Clicked = 1
+	case "failed":
+		// Temporary failures are retried by Mailgun and end up delivered or failed permanently
+		if e.Severity != "permanent" {
+			return c, false
+		}
+		c.Bounced = 1
+	case "complained":
+		c.Complained = 1
+	case "unsubscribed":
+		c.Unsubscribed = 1
+	default:
+		return c, false
+	}
+	return c, true
+}
+
+func key(list, tag string, hour time.Time) string {
+	return strings.Join([]string{list, tag, hour.UTC().Format(time.RFC3339)}, "|")
+}
+
+// Sync pulls the events since the last sync and adds them to the aggregates. Events
+// younger than ANALYTICS_EVENT_LAG are left for the next sync because Mailgun may
+// still add older events in that window. It returns the number of counted events. The
+// aggregates and the cursor are stored together, so a batch is never counted twice.
+func Sync(ctx context.Context) (int, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	var cur cursor
+	if err := store.Get(stateBucket, "cursor", &cur); err != nil && !errors.Is(err, common.ErrNotFound) {
+		return 0, err
+	}
+	now := time.Now()
+	end := now.Add(-configReader.Duration("ANALYTICS_EVENT_LAG", 30*time.Minute))
+	begin := end.Add(-configReader.Duration("ANALYTICS_BACKFILL", 7*24*time.Hour))
+	if cur.Timestamp > 0 {
+		begin = timeOf(cur.Timestamp)
+	}
+	if !end.After(begin) {
+		return 0, nil
+	}
+
+	pending := map[string]Counts{}
+	counted := 0
+	err := mailgun.DeliveryEvents(ctx, begin, end, func(e mailgun.DeliveryEvent) error {
+		if e.Timestamp < cur.Timestamp || (e.Timestamp == cur.Timestamp && slices.Contains(cur.IDs, e.ID)) {
+			return nil
+		}
+		if e.Timestamp > cur.Timestamp {
+			cur = cursor{Timestamp: e.Timestamp}
+		}
+		cur.IDs = append(cur.IDs, e.ID)
+
+		c, ok := countsOf(e)
+		if !ok || e.List == "" {
+			return nil
+		}
+		hour := timeOf(e.Timestamp).Truncate(time.Hour)
+		tags := append([]string{""}, e.Tags...)
+		slices.Sort(tags)
+		for _, tag := range slices.Compact(tags) {
+			k := key(e.List, tag, hour)
+			total := pending[k]
+			total.add(c)
+			pending[k] = total
+		}
+		counted++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ops := make([]store.Op, 0, len(pending)+1)
+	for k, c := range pending {
+		var total Counts
+		if err := store.Get(bucket, k, &total); err != nil && !errors.Is(err, common.ErrNotFound) {
+			return 0, err
+		}
+		total.add(c)
+		ops = append(ops, store.Op{Bucket: bucket, Key: k, Value: total})
+	}
+	ops = append(ops, store.Op{Bucket: stateBucket, Key: "cursor", Value: cur})
+	if err := store.Apply(ops...); err != nil {
+		return 0, err
+	}
+	return counted, prune(now.Add(-configReader.Duration("ANALYTICS_RETENTION", 90*24*time.Hour)))
+}
+
+// prune removes the buckets before cutoff.
+func prune(cutoff time.Time) error {
+	for _, k := range store.Keys(bucket) {
+		t, err := time.Parse(time.RFC3339, k[strings.LastIndex(k, "|")+1:])
+		if err == nil && t.Before(cutoff) {
+			if err := store.Delete(bucket, k); err != nil && !errors.Is(err, common.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Query returns the statistics of list (and tag, if not empty) between from and to,
+// bucketed by interval ("hour" or "day").
+func Query(list, tag string, from, to time.Time, interval string) (Stats, error) {
+	step, ok := intervals[interval]
+	if !ok {
+		return Stats{}, fmt.Errorf("%w: interval must be hour or day", common.ErrBadRequest)
+	}
+	from, to = from.UTC().Truncate(step), to.UTC()
+	if !to.After(from) {
+		return Stats{}, fmt.Errorf("%w: from must be before to", common.ErrBadRequest)
+	}
+	if to.Sub(from)/step > maxPoints {
+		return Stats{}, fmt.Errorf("%w: at most %d points, use a larger interval", common.ErrBadRequest, maxPoints)
+	}
+
+	list = strings.ToLower(list)
+	stats := Stats{List: list, Tag: tag, From: from, To: to, Interval: interval, Series: []Point{}}
+	for t := from; t.Before(to); t = t.Add(step) {
+		stats.Series = append(stats.Series, Point{Start: t})
+	}
+
+	prefix := list + "|" + tag + "|"
+	for _, k := range store.Keys(bucket) {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		hour, err := time.Parse(time.RFC3339, strings.TrimPrefix(k, prefix))
+		if err != nil || hour.Before(from) || !hour.Before(to) {
+			continue
+		}
+		var c Counts
+		if err := store.Get(bucket, k, &c); err != nil {
+			return Stats{}, err
+		}
+		stats.Series[hour.Sub(from)/step].add(c)
+		stats.Totals.add(c)
+	}
+
+	var cur cursor
+	if err := store.Get(stateBucket, "cursor", &cur); err == nil && cur.Timestamp > 0 {
+		t := timeOf(cur.Timestamp)
+		stats.SyncedUntil = &t
+	}
+	return stats, nil
+}
+
+// ScheduleSync schedules the next sync at the next multiple of ANALYTICS_SYNC_INTERVAL.
+// Scheduling the same slot twice is a no-op. A non-positive interval disables syncing.
+func ScheduleSync() error {
+	interval := configReader.Duration("ANALYTICS_SYNC_INTERVAL", 15*time.Minute)
+	if interval <= 0 {
+		return nil
+	}
+	next := time.Now().UTC().Truncate(interval).Add(interval)
+	_, err := scheduler.Schedule(SyncJob, next, struct{}{}, SyncJob+":"+next.Format(time.RFC3339))
+	return err
+}
+
+// RunSyncJob is the scheduler handler of [SyncJob]. The next sync is scheduled first so
+// that a failing sync does not stop the periodic syncs.
+func RunSyncJob(ctx context.Context, _ scheduler.Job) error {
+	if err := ScheduleSync(); err != nil {
+		return fmt.Errorf("failed to schedule next sync: %w", err)
+	}
+	_, err := Sync(ctx)
+	return err
+}
+
+func timeOf(ts float64) time.Time {
+	return time.Unix(0, int64(ts*float64(time.Second))).UTC()
+}
@@ -0,0 +1,173 @@
+// Package apiKeys issues API keys for batch jobs and other backends that cannot obtain a
+// user token. A key is shown once when it is created; only the SHA-256 hash of its
+// secret is stored.
+package apiKeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/store"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bucket = "api_keys"
+
+	// Prefix starts every key, so that keys can be told apart from JWTs and found by
+	// secret scanners.
+	Prefix = "mlk_"
+)
+
+// ErrInvalid is returned for unknown, revoked or expired keys.
+var ErrInvalid = errors.New("invalid api key")
+
+// Scopes are the scopes a key can be granted, those of machine clients in
+// requestValidator.
+var Scopes = []string{"lists:read", "lists:write", "members:read", "members:write", "messages:send", "admin"}
+
+// APIKey is an issued key. Hash is never returned.
+type APIKey struct {
+	ID         string     `json:"id" example:"3f2a9c0d4b1e7a65"`
+	Name       string     `json:"name" example:"crm-sync"`
+	Scopes     []string   `json:"scopes" example:"members:write"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedBy  string     `json:"created_by" example:"admin@example.com"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// mu serializes changes of keys.
+var mu sync.Mutex
+
+// Create issues a key and returns it together with the token, which is not stored.
+func Create(name string, scopes []string, expiresAt *time.Time, createdBy string) (APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return APIKey{}, "", fmt.Errorf("%w: name is required", common.ErrBadRequest)
+	}
+	if len(scopes) == 0 {
+		return APIKey{}, "", fmt.Errorf("%w: at least one scope is required", common.ErrBadRequest)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return APIKey{}, "", fmt.Errorf("%w: unknown scope %q", common.ErrBadRequest, scope)
+		}
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return APIKey{}, "", fmt.Errorf("%w: expires_at must be in the future", common.ErrBadRequest)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	k := APIKey{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hash(secret),
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	if err := store.Put(bucket, k.ID, k); err != nil {
+		return APIKey{}, "", err
+	}
+	k.Hash = ""
+	return k, Prefix + id + "_" + secret, nil
+}
+
+// List returns all keys, including revoked ones, oldest first.
+func List() ([]APIKey, error) {
+	all, err := store.All[APIKey](bucket)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(all, func(a, b APIKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for i := range all {
+		all[i].Hash = ""
+	}
+	if all == nil {
+		all = []APIKey{}
+	}
+	return all, nil
+}
+
+// Revoke invalidates a key. Revoked keys are kept to show who used what.
+func Revoke(id string) (APIKey, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var k APIKey
+	if err := store.Get(bucket, id, &k); err != nil {
+		return APIKey{}, err
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+		if err := store.Put(bucket, k.ID, k); err != nil {
+			return APIKey{}, err
+		}
+	}
+	k.Hash = ""
+	return k, nil
+}
+
+// Authenticate returns the key of token, or [ErrInvalid].
+func Authenticate(token string) (APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, Prefix), "_")
+	if !ok || !strings.HasPrefix(token, Prefix) {
+		return APIKey{}, ErrInvalid
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var k APIKey
+	if err := store.Get(bucket, id, &k); err != nil {
+		if errors.Is(err, common.ErrNotFound) {
+			return APIKey{}, ErrInvalid
+		}
+		return APIKey{}, err
+	}
+	now := time.Now().UTC()
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(k.Hash)) != 1 ||
+		k.RevokedAt != nil || (k.ExpiresAt != nil && !k.ExpiresAt.After(now)) {
+		return APIKey{}, ErrInvalid
+	}
+	// Recorded at most once a minute to keep busy keys from rewriting the store
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > time.Minute {
+		k.LastUsedAt = &now
+		if err := store.Put(bucket, k.ID, k); err != nil {
+			return APIKey{}, err
+		}
+	}
+	k.Hash = ""
+	return k, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,45 @@
+package apiKeys_test
+
+import (
+	"errors"
+	"mailinglist-backend-go/services/apiKeys"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/store"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCreateValidatesScopes(t *testing.T) {
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scopes := range [][]string{nil, {"members:write", "superuser"}, {"Admin"}} {
+		if _, _, err := apiKeys.Create("crm-sync", scopes, nil, "admin@example.test"); !errors.Is(err, common.ErrBadRequest) {
+			t.Fatalf("scopes %v: got %v, want ErrBadRequest", scopes, err)
+		}
+	}
+	if keys, _ := apiKeys.List(); len(keys) != 0 {
+		t.Fatalf("invalid keys were stored: %+v", keys)
+	}
+
+	k, token, err := apiKeys.Create("crm-sync", []string{"members:write", "admin"}, nil, "admin@example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := apiKeys.Authenticate(token); err != nil || !slices.Equal(got.Scopes, k.Scopes) {
+		t.Fatalf("authenticate: %+v, %v", got, err)
+	}
+}
+
+func TestScopesOfMachineClients(t *testing.T) {
+	var want []string
+	for _, s := range requestValidator.Scopes {
+		want = append(want, string(s))
+	}
+	if !slices.Equal(apiKeys.Scopes, want) {
+		t.Fatalf("api key scopes %v differ from the machine client scopes %v", apiKeys.Scopes, want)
+	}
+}
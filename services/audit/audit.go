@@ -0,0 +1,90 @@
+// Package audit keeps a local log of the changes made to memberships: who changed what
+// for which address and when. The log is part of data exports and lets admins trace
+// changes that are not visible in Mailgun, e.g. who unsubscribed a member.
+package audit
+
+import (
+	"errors"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/store"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const bucket = "audit"
+
+// Entry is a single change. Actor is the authenticated user, Subject the member the
+// change was made for; both are the same for self-service changes. OnBehalfOf is the
+// user the actor impersonated.
+type Entry struct {
+	ID         string            `json:"id"`
+	Time       time.Time         `json:"time"`
+	Actor      string            `json:"actor" example:"admin@example.com"`
+	OnBehalfOf string            `json:"on_behalf_of,omitempty" example:"jane@example.com"`
+	Action     string            `json:"action" example:"unsubscribe"`
+	List       string            `json:"list,omitempty" example:"news@example.com"`
+	Subject    string            `json:"subject,omitempty" example:"jane@example.com"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// Record stores e with a new ID and the current time.
+func Record(e Entry) error {
+	e.ID = uuid.NewString()
+	e.Time = time.Now().UTC()
+	// Keys sort by time
+	return store.Put(bucket, e.Time.Format(time.RFC3339Nano)+"|"+e.ID, e)
+}
+
+// For returns the entries in which address is the actor, the impersonated user or the
+// subject, oldest first.
+func For(address string) ([]Entry, error) {
+	all, err := store.All[Entry](bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries := slices.DeleteFunc(all, func(e Entry) bool {
+		return !strings.EqualFold(e.Actor, address) && !strings.EqualFold(e.OnBehalfOf, address) && !strings.EqualFold(e.Subject, address)
+	})
+	slices.SortFunc(entries, func(a, b Entry) int { return a.Time.Compare(b.Time) })
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return entries, nil
+}
+
+// Pseudonymize replaces address by pseudonym in all entries and returns the number of
+// changed entries.
+func Pseudonymize(address, pseudonym string) (int, error) {
+	changed := 0
+	for _, k := range store.Keys(bucket) {
+		var e Entry
+		if err := store.Get(bucket, k, &e); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				continue
+			}
+			return changed, err
+		}
+		actor, subject := strings.EqualFold(e.Actor, address), strings.EqualFold(e.Subject, address)
+		onBehalfOf := strings.EqualFold(e.OnBehalfOf, address)
+		if !actor && !subject && !onBehalfOf {
+			continue
+		}
+		if actor {
+			e.Actor = pseudonym
+		}
+		if onBehalfOf {
+			e.OnBehalfOf = pseudonym
+		}
+		if subject {
+			e.Subject = pseudonym
+		}
+		if err := store.Put(bucket, k, e); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
@@ -3,6 +3,7 @@ package configReader
 import (
 	"os"
 	"strings"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -19,3 +20,13 @@ func Exists(key string) bool {
 func Values(key string) []string {
 	return strings.Split(Value(key), ",")
 }
+
+// Duration parses the value of key as [time.Duration]. def is returned if the key is
+// unset or cannot be parsed.
+func Duration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(Value(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
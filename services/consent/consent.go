@@ -0,0 +1,246 @@
+// Package consent records how and when members consented to receive a list: the
+// source, client IP and user agent, the privacy policy version and the list as it was
+// described at that time.
+//
+// The current policy version is kept locally (initially PRIVACY_POLICY_VERSION). When
+// admins publish a new version and require re-consent, members whose latest consent
+// was given for an older version are reported as pending until they subscribe again.
+package consent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/store"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	bucket       = "consents"
+	policyBucket = "consent_policy"
+)
+
+// Source is how consent was given.
+type Source string
+
+const (
+	SourceSelf        Source = "self"
+	SourceAdmin       Source = "admin"
+	SourceImport      Source = "import"
+	SourceDoubleOptIn Source = "double_opt_in"
+)
+
+// ParseSource parses a consent source.
+func ParseSource(s string) (Source, error) {
+	switch Source(s) {
+	case SourceSelf, SourceAdmin, SourceImport, SourceDoubleOptIn:
+		return Source(s), nil
+	}
+	return "", fmt.Errorf("%w: consent source must be self, admin, import or double_opt_in", common.ErrBadRequest)
+}
+
+// Record is the consent of a member to receive a list.
+type Record struct {
+	ID            string `json:"id"`
+	List          string `json:"list" example:"news@example.com"`
+	Member        string `json:"member" example:"jane@example.com"`
+	Source        Source `json:"source" example:"self"`
+	IP            string `json:"ip,omitempty" example:"203.0.113.7"`
+	UserAgent     string `json:"user_agent,omitempty"`
+	PolicyVersion string `json:"policy_version" example:"2026-10"`
+	// ListName and ListDescription are the list as described when consent was given.
+	ListName        string     `json:"list_name,omitempty" example:"News"`
+	ListDescription string     `json:"list_description,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	WithdrawnAt     *time.Time `json:"withdrawn_at,omitempty"`
+}
+
+// Policy is the current privacy policy version.
+type Policy struct {
+	Version string `json:"version" example:"2026-10"`
+	// RequireReconsent reports members whose consent is for an older version as pending.
+	RequireReconsent bool       `json:"require_reconsent"`
+	UpdatedBy        string     `json:"updated_by,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// Pending is a membership that needs consent for the current policy version.
+type Pending struct {
+	List   string `json:"list" example:"news@example.com"`
+	Member string `json:"member" example:"jane@example.com"`
+	// PolicyVersion is the version of the latest consent, empty if there is none.
+	PolicyVersion string `json:"policy_version"`
+}
+
+// mu serializes changes of records.
+var mu sync.Mutex
+
+// CurrentPolicy returns the stored policy or, before one was stored, PRIVACY_POLICY_VERSION.
+func CurrentPolicy() (Policy, error) {
+	var p Policy
+	err := store.Get(policyBucket, "current", &p)
+	if errors.Is(err, common.ErrNotFound) {
+		return Policy{Version: configReader.Value("PRIVACY_POLICY_VERSION")}, nil
+	}
+	return p, err
+}
+
+// SetPolicy stores a new policy version.
+func SetPolicy(version string, requireReconsent bool, by string) (Policy, error) {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return Policy{}, fmt.Errorf("%w: version is required", common.ErrBadRequest)
+	}
+	now := time.Now().UTC()
+	p := Policy{Version: version, RequireReconsent: requireReconsent, UpdatedBy: by, UpdatedAt: &now}
+	return p, store.Put(policyBucket, "current", p)
+}
+
+// Add records the consent of r.Member to r.List for the current policy version.
+func Add(ctx context.Context, r Record) (Record, error) {
+	policy, err := CurrentPolicy()
+	if err != nil {
+		return Record{}, err
+	}
+	list, err := mailgun.List(ctx, r.List, true)
+	if err != nil {
+		return Record{}, err
+	}
+	r.ID = uuid.NewString()
+	r.CreatedAt = time.Now().UTC()
+	r.PolicyVersion = policy.Version
+	r.ListName, r.ListDescription = list.Name, list.Description
+	r.WithdrawnAt = nil
+	return r, store.Put(bucket, r.ID, r)
+}
+
+// Discard deletes the record id, which was added for a subscription that failed or was
+// rolled back.
+func Discard(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return store.Delete(bucket, id)
+}
+
+// Withdraw marks the consents of member to list as withdrawn, e.g. when it unsubscribes.
+func Withdraw(list, member string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	records, err := all(func(r Record) bool {
+		return r.WithdrawnAt == nil && strings.EqualFold(r.List, list) && strings.EqualFold(r.Member, member)
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, r := range records {
+		r.WithdrawnAt = &now
+		if err := store.Put(bucket, r.ID, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For returns the consents of member, oldest first.
+func For(member string) ([]Record, error) {
+	return all(func(r Record) bool { return strings.EqualFold(r.Member, member) })
+}
+
+// NeedsReconsent reports whether the membership of member in list needs consent for the
+// current policy version: re-consent is required and the latest consent that was not
+// withdrawn is for another version or missing.
+func NeedsReconsent(policy Policy, records []Record, list, member string) (bool, string) {
+	if !policy.RequireReconsent {
+		return false, ""
+	}
+	version := ""
+	for _, r := range records {
+		if r.WithdrawnAt == nil && strings.EqualFold(r.List, list) && strings.EqualFold(r.Member, member) {
+			version = r.PolicyVersion
+		}
+	}
+	return version != policy.Version, version
+}
+
+// PendingReconsent returns the members of list (or all lists, if empty) who need to
+// consent to the current policy version. Unsubscribed members are skipped.
+func PendingReconsent(ctx context.Context, list string) ([]Pending, error) {
+	result := []Pending{}
+	policy, err := CurrentPolicy()
+	if err != nil || !policy.RequireReconsent {
+		return result, err
+	}
+	lists, err := mailgun.Lists(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	records, err := all(func(Record) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, l := range lists {
+		if list != "" && !strings.EqualFold(l.Address, list) {
+			continue
+		}
+		found = true
+		members, err := mailgun.Members(ctx, l.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get members of %s: %w", l.Address, err)
+		}
+		for _, m := range members {
+			if m.Status == mailgun.StatusUnsubscribed {
+				continue
+			}
+			if pending, version := NeedsReconsent(policy, records, l.Address, m.Address); pending {
+				result = append(result, Pending{List: l.Address, Member: m.Address, PolicyVersion: version})
+			}
+		}
+	}
+	if list != "" && !found {
+		return nil, common.ErrNotFound
+	}
+	return result, nil
+}
+
+// Erase replaces member by pseudonym in its consents and drops the IP and user agent. It
+// returns the number of changed records.
+func Erase(member, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	records, err := For(member)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range records {
+		r.Member, r.IP, r.UserAgent = pseudonym, "", ""
+		if err := store.Put(bucket, r.ID, r); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+func all(keep func(Record) bool) ([]Record, error) {
+	records, err := store.All[Record](bucket)
+	if err != nil {
+		return nil, err
+	}
+	records = slices.DeleteFunc(records, func(r Record) bool { return !keep(r) })
+	slices.SortFunc(records, func(a, b Record) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	if records == nil {
+		records = []Record{}
+	}
+	return records, nil
+}
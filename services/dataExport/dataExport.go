@@ -0,0 +1,120 @@
+// Package dataExport assembles everything stored about an email address, locally and at
+// Mailgun, to answer subject access requests.
+package dataExport
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/moderation"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/subscriptions"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Export is the data stored about an address.
+type Export struct {
+	Address     string    `json:"address" example:"jane@example.com"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Memberships include the name, vars and pause of the member in each list.
+	Memberships  []subscriptions.Membership `json:"memberships"`
+	Suppressions []mailgun.Suppression      `json:"suppressions"`
+	// Events are the Mailgun events of the last EXPORT_EVENT_WINDOW. Mailgun itself keeps
+	// events only for a limited time.
+	Events      []mailgun.DeliveryEvent `json:"events"`
+	Submissions []moderation.Submission `json:"submissions"`
+	Consents    []consent.Record        `json:"consents"`
+	Roles       []roles.Grant           `json:"roles"`
+	AuditLog    []audit.Entry           `json:"audit_log"`
+}
+
+// Collect gathers the data stored about address.
+func Collect(ctx context.Context, address string) (Export, error) {
+	now := time.Now().UTC()
+	e := Export{Address: address, GeneratedAt: now, Submissions: []moderation.Submission{}}
+
+	var err error
+	if e.Memberships, err = subscriptions.Memberships(ctx, address); err != nil {
+		return Export{}, fmt.Errorf("failed to get memberships: %w", err)
+	}
+	if e.Suppressions, err = mailgun.SuppressedAddress(ctx, address); err != nil {
+		return Export{}, fmt.Errorf("failed to get suppressions: %w", err)
+	}
+	window := configReader.Duration("EXPORT_EVENT_WINDOW", 30*24*time.Hour)
+	if e.Events, err = mailgun.RecipientEvents(ctx, address, now.Add(-window), now); err != nil {
+		return Export{}, fmt.Errorf("failed to get events: %w", err)
+	}
+	submissions, err := moderation.List("", "")
+	if err != nil {
+		return Export{}, fmt.Errorf("failed to get submissions: %w", err)
+	}
+	e.Submissions = append(e.Submissions, slices.DeleteFunc(submissions, func(s moderation.Submission) bool {
+		return !strings.EqualFold(s.SubmitterEmail, address)
+	})...)
+	if e.Consents, err = consent.For(address); err != nil {
+		return Export{}, fmt.Errorf("failed to get consents: %w", err)
+	}
+	if e.Roles, err = roles.ForMember(address); err != nil {
+		return Export{}, fmt.Errorf("failed to get roles: %w", err)
+	}
+	if e.AuditLog, err = audit.For(address); err != nil {
+		return Export{}, fmt.Errorf("failed to get audit log: %w", err)
+	}
+	return e, nil
+}
+
+// manifest is the index of a ZIP archive.
+type manifest struct {
+	Address     string    `json:"address"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Files       []string  `json:"files"`
+}
+
+// WriteZIP writes e as a ZIP archive with one JSON file per section and a manifest.json.
+func WriteZIP(w io.Writer, e Export) error {
+	sections := []struct {
+		name string
+		data any
+	}{
+		{"memberships.json", e.Memberships},
+		{"suppressions.json", e.Suppressions},
+		{"events.json", e.Events},
+		{"submissions.json", e.Submissions},
+		{"consents.json", e.Consents},
+		{"roles.json", e.Roles},
+		{"audit_log.json", e.AuditLog},
+	}
+	m := manifest{Address: e.Address, GeneratedAt: e.GeneratedAt}
+	for _, s := range sections {
+		m.Files = append(m.Files, s.name)
+	}
+
+	zw := zip.NewWriter(w)
+	if err := writeFile(zw, "manifest.json", e.GeneratedAt, m); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		if err := writeFile(zw, s.name, e.GeneratedAt, s.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeFile(zw *zip.Writer, name string, modified time.Time, v any) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,367 @@
+// Package digest compiles the messages sent to a list into daily or weekly digests for
+// members who do not want to receive every message.
+//
+// Digest members are unsubscribed in Mailgun (see [mailgun.StatusDigest]), so list
+// messages skip them. Every message sent through this service is recorded locally by
+// [Record]. A scheduler job runs once a day at DIGEST_HOUR (UTC) and sends the messages
+// recorded since the previous digest to the daily members of each list, and on
+// DIGEST_WEEKDAY also to the weekly members. Digests are rendered with the stored
+// template DIGEST_TEMPLATE_ID or a built-in default. The members a digest was sent to are
+// recorded batch by batch, so that a retried job sends it only to the others.
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"mailinglist-backend-go/services/templates"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bucket         = "digest_items"
+	stateBucket    = "digest_state"
+	progressBucket = "digest_progress"
+
+	// Job is the scheduler job type sending the digests of a day.
+	Job = "send_digests"
+
+	// excerptLength limits the text of a message in a digest.
+	excerptLength = 1000
+)
+
+// Item is a message sent to a list, kept until it was part of the digests.
+type Item struct {
+	List      string    `json:"list"`
+	MessageID string    `json:"message_id"`
+	Subject   string    `json:"subject"`
+	Text      string    `json:"text"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// state is the end of the last digest of a list and delivery mode.
+type state struct {
+	Until time.Time `json:"until"`
+}
+
+// progress are the members the digest until Until of a list and delivery mode was sent
+// to before the sending failed.
+type progress struct {
+	Until time.Time `json:"until"`
+	Sent  []string  `json:"sent"`
+}
+
+// payload is the payload of [Job].
+type payload struct {
+	// At is the time the digests are due at.
+	At time.Time `json:"at"`
+}
+
+var (
+	// mu serializes sends so that no digest is sent twice
+	mu sync.Mutex
+
+	tags = regexp.MustCompile(`<[^>]*>`)
+
+	periods = map[mailgun.Delivery]time.Duration{
+		mailgun.DeliveryDaily:  24 * time.Hour,
+		mailgun.DeliveryWeekly: 7 * 24 * time.Hour,
+	}
+
+	// defaultTemplate is used unless DIGEST_TEMPLATE_ID is set. Stored templates get the
+	// same variables.
+	defaultTemplate = templates.Template{
+		Subject: "{{.list_name}}: your {{.period}} digest ({{.count}} messages)",
+		Text: "Hello {{recipient \"name\"}},\n\n" +
+			"these messages were sent to {{.list_name}} since your last digest:\n\n" +
+			"{{.messages}}\n" +
+			"You receive a {{.period}} digest instead of every message of {{.list}}.\n",
+		Variables: []templates.Variable{
+			{Name: "list", Required: true},
+			{Name: "list_name", Required: true},
+			{Name: "period", Required: true},
+			{Name: "count", Required: true},
+			{Name: "messages", Required: true},
+		},
+	}
+)
+
+func itemKey(list string, sentAt time.Time, id string) string {
+	return strings.ToLower(list) + "|" + sentAt.Format(time.RFC3339Nano) + "|" + id
+}
+
+func stateKey(list string, delivery mailgun.Delivery) string {
+	return strings.ToLower(list) + "|" + string(delivery)
+}
+
+// Record keeps a message sent to list for the next digests. It is called for every
+// message sent by [mailgun.SendToList].
+func Record(list string, msg mailgun.Message, id string) error {
+	text := msg.Text
+	if text == "" {
+		text = tags.ReplaceAllString(msg.HTML, "")
+	}
+	item := Item{List: list, MessageID: id, Subject: msg.Subject, Text: excerpt(text), SentAt: time.Now().UTC()}
+	return store.Put(bucket, itemKey(list, item.SentAt, id), item)
+}
+
+// Send sends the digests due at now: the daily digests and, on DIGEST_WEEKDAY, the
+// weekly digests. Each digest contains the messages recorded since the previous digest
+// of the same list and mode, or within the last period for the first one. It returns
+// the number of members a digest was sent to.
+func Send(ctx context.Context, now time.Time) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now = now.UTC()
+	modes := []mailgun.Delivery{mailgun.DeliveryDaily}
+	if now.Weekday() == weekday() {
+		modes = append(modes, mailgun.DeliveryWeekly)
+	}
+	lists, err := mailgun.Lists(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var errs []error
+	for _, list := range lists {
+		n, err := sendList(ctx, list, modes, now)
+		sent += n
+		if err != nil {
+			errs = append(errs, fmt.Errorf("list %s: %w", list.Address, err))
+		}
+	}
+	if err := prune(now.Add(-configReader.Duration("DIGEST_RETENTION", 14*24*time.Hour))); err != nil {
+		errs = append(errs, err)
+	}
+	return sent, errors.Join(errs...)
+}
+
+// sendList sends the digests of one list. Members are only fetched if there are messages.
+func sendList(ctx context.Context, list mailgun.MGMailingList, modes []mailgun.Delivery, now time.Time) (int, error) {
+	var members []mailgun.Member
+	sent := 0
+	for _, mode := range modes {
+		var last state
+		if err := store.Get(stateBucket, stateKey(list.Address, mode), &last); err != nil && !errors.Is(err, common.ErrNotFound) {
+			return sent, err
+		}
+		since := now.Add(-periods[mode])
+		if !last.Until.IsZero() {
+			since = last.Until
+		}
+		if !now.After(since) {
+			continue
+		}
+		items, err := between(list.Address, since, now)
+		if err != nil {
+			return sent, err
+		}
+
+		if len(items) > 0 {
+			if members == nil {
+				if members, err = mailgun.Members(ctx, list.Address); err != nil {
+					return sent, err
+				}
+			}
+			recipients := slices.DeleteFunc(slices.Clone(members), func(m mailgun.Member) bool {
+				return m.Status != mailgun.StatusDigest || m.Delivery != mode
+			})
+			if len(recipients) > 0 {
+				msg, err := compose(list, mode, items)
+				if err != nil {
+					return sent, err
+				}
+				n, err := sendBatches(ctx, list.Address, mode, now, msg, recipients)
+				sent += n
+				if err != nil {
+					return sent, err
+				}
+			}
+		}
+		key := stateKey(list.Address, mode)
+		if err := store.Apply(
+			store.Op{Bucket: stateBucket, Key: key, Value: state{Until: now}},
+			store.Op{Bucket: progressBucket, Key: key, Delete: true},
+		); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// sendBatches sends the digest until now to the recipients it was not sent to yet and
+// records them after every batch. It returns the number of members it was sent to.
+func sendBatches(ctx context.Context, list string, mode mailgun.Delivery, now time.Time, msg mailgun.Message, recipients []mailgun.Member) (int, error) {
+	key := stateKey(list, mode)
+	var p progress
+	if err := store.Get(progressBucket, key, &p); err != nil && !errors.Is(err, common.ErrNotFound) {
+		return 0, err
+	}
+	if !p.Until.Equal(now) {
+		// Left over from a digest that was given up
+		p = progress{Until: now}
+	}
+	done := map[string]bool{}
+	for _, address := range p.Sent {
+		done[strings.ToLower(address)] = true
+	}
+	recipients = slices.DeleteFunc(recipients, func(m mailgun.Member) bool { return done[strings.ToLower(m.Address)] })
+
+	sent := 0
+	for batch := range slices.Chunk(recipients, mailgun.BatchSize) {
+		if _, err := mailgun.SendToMembers(ctx, list, msg, batch); err != nil {
+			return sent, err
+		}
+		sent += len(batch)
+		for _, m := range batch {
+			p.Sent = append(p.Sent, m.Address)
+		}
+		if err := store.Put(progressBucket, key, p); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// between returns the items of list sent after from and until to, oldest first.
+func between(list string, from, to time.Time) ([]Item, error) {
+	prefix := strings.ToLower(list) + "|"
+	var items []Item
+	for _, k := range store.Keys(bucket) {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		var item Item
+		if err := store.Get(bucket, k, &item); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if item.SentAt.After(from) && !item.SentAt.After(to) {
+			items = append(items, item)
+		}
+	}
+	slices.SortFunc(items, func(a, b Item) int { return a.SentAt.Compare(b.SentAt) })
+	return items, nil
+}
+
+// compose renders the digest of items with the configured template.
+func compose(list mailgun.MGMailingList, mode mailgun.Delivery, items []Item) (mailgun.Message, error) {
+	t := defaultTemplate
+	if id := configReader.Value("DIGEST_TEMPLATE_ID"); id != "" {
+		var err error
+		if t, err = templates.Get(id); err != nil {
+			return mailgun.Message{}, fmt.Errorf("failed to get digest template %s: %w", id, err)
+		}
+	}
+
+	var b strings.Builder
+	for _, item := range items {
+		fmt.Fprintf(&b, "%s\n%s\n\n%s\n\n", item.Subject, item.SentAt.Format("Mon, 2 Jan 2006 15:04 MST"), item.Text)
+	}
+	name := list.Name
+	if name == "" {
+		name = list.Address
+	}
+	rendered, err := templates.Render(t, map[string]string{
+		"list":      list.Address,
+		"list_name": name,
+		"period":    string(mode),
+		"count":     strconv.Itoa(len(items)),
+		"messages":  b.String(),
+	})
+	if err != nil {
+		return mailgun.Message{}, err
+	}
+	return mailgun.Message{
+		Subject: rendered.Subject,
+		Text:    rendered.Text,
+		HTML:    rendered.HTML,
+		Tags:    []string{"digest"},
+	}, nil
+}
+
+// prune removes the items sent before cutoff. DIGEST_RETENTION must be longer than a
+// week so that weekly digests are complete.
+func prune(cutoff time.Time) error {
+	for _, k := range store.Keys(bucket) {
+		parts := strings.SplitN(k, "|", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, parts[1])
+		if err == nil && t.Before(cutoff) {
+			if err := store.Delete(bucket, k); err != nil && !errors.Is(err, common.ErrNotFound) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Schedule schedules the next digests at the next DIGEST_HOUR (UTC, default 7).
+// Scheduling the same day twice is a no-op.
+func Schedule() error {
+	hour, err := strconv.Atoi(configReader.Value("DIGEST_HOUR"))
+	if err != nil || hour < 0 || hour > 23 {
+		hour = 7
+	}
+	now := time.Now().UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	_, err = scheduler.Schedule(Job, next, payload{At: next}, Job+":"+next.Format(time.DateOnly))
+	return err
+}
+
+// RunJob is the scheduler handler of [Job]. The next digests are scheduled first so
+// that a failing run does not stop the digests. The digests are those due at the
+// planned time, even if the job runs late or is retried.
+func RunJob(ctx context.Context, job scheduler.Job) error {
+	if err := Schedule(); err != nil {
+		return fmt.Errorf("failed to schedule next digests: %w", err)
+	}
+	var p payload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("%w: invalid payload: %w", scheduler.ErrPermanent, err)
+	}
+	if p.At.IsZero() {
+		return fmt.Errorf("%w: payload without digest time", scheduler.ErrPermanent)
+	}
+	_, err := Send(ctx, p.At)
+	return err
+}
+
+// weekday is DIGEST_WEEKDAY, Monday by default.
+func weekday() time.Weekday {
+	v := configReader.Value("DIGEST_WEEKDAY")
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), v) {
+			return d
+		}
+	}
+	return time.Monday
+}
+
+func excerpt(text string) string {
+	text = strings.TrimSpace(text)
+	if r := []rune(text); len(r) > excerptLength {
+		return strings.TrimSpace(string(r[:excerptLength])) + " …"
+	}
+	return text
+}
@@ -0,0 +1,119 @@
+package digest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/mailgunmock"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+const testList = "news@lists.test"
+
+// setup starts a Mailgun mock with testList and n daily digest members.
+func setup(t *testing.T, n int) *mailgunmock.Server {
+	t.Helper()
+	mock := mailgunmock.StartWithKey("test-key")
+	t.Cleanup(mock.Close)
+	members := make([]mtypes.Member, n)
+	for i := range members {
+		unsubscribed := false
+		members[i] = mtypes.Member{
+			Address:    fmt.Sprintf("member%d@example.test", i),
+			Subscribed: &unsubscribed,
+			Vars:       map[string]any{mailgun.DeliveryVar: string(mailgun.DeliveryDaily)},
+		}
+	}
+	mock.AddList(mtypes.MailingList{Address: testList, Name: "News"}, members...)
+	err := mailgun.Setup(mailgun.Config{APIKey: "test-key", APIBase: mock.URL(), Domain: "lists.test", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Register(Job, RunJob)
+	return mock
+}
+
+func recipients(mock *mailgunmock.Server) int {
+	n := 0
+	for _, m := range mock.Messages() {
+		n += len(m.To)
+	}
+	return n
+}
+
+func TestRetryDoesNotResendBatches(t *testing.T) {
+	// A full batch has more parts than the mock parses by default
+	t.Setenv("GODEBUG", "multipartmaxparts=5000")
+	mock := setup(t, mailgun.BatchSize+1)
+	if err := Record(testList, mailgun.Message{Subject: "Hello", Text: "Hi all"}, "<1@lists.test>"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Minute)
+
+	// The second batch fails
+	mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists.test/messages", Status: http.StatusInternalServerError, After: 1})
+	sent, err := Send(context.Background(), now)
+	if err == nil || sent != mailgun.BatchSize {
+		t.Fatalf("first run: sent %d, %v", sent, err)
+	}
+	mock.ClearFaults()
+
+	sent, err = Send(context.Background(), now)
+	if err != nil || sent != 1 {
+		t.Fatalf("retry: sent %d, %v", sent, err)
+	}
+	if n := recipients(mock); n != mailgun.BatchSize+1 {
+		t.Fatalf("digest was sent to %d recipients", n)
+	}
+	if keys := store.Keys(progressBucket); len(keys) != 0 {
+		t.Fatalf("progress left behind: %v", keys)
+	}
+}
+
+func TestRunJobUsesPlannedTime(t *testing.T) {
+	mock := setup(t, 1)
+	if err := Record(testList, mailgun.Message{Subject: "Hello", Text: "Hi all"}, "<1@lists.test>"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry runs later than planned; messages recorded in between belong to the next digest
+	at := time.Now().Add(time.Minute)
+	job, err := scheduler.Schedule(Job, at, payload{At: at}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.RunAt = at.Add(time.Hour)
+	if err := store.Put(bucket, itemKey(testList, at.Add(time.Minute), "<2@lists.test>"), Item{List: testList, MessageID: "<2@lists.test>", Subject: "Later", SentAt: at.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	messages := mock.Messages()
+	if len(messages) != 1 || messages[0].Subject != "News: your daily digest (1 messages)" {
+		t.Fatalf("unexpected digests: %+v", messages)
+	}
+	var last state
+	if err := store.Get(stateBucket, stateKey(testList, mailgun.DeliveryDaily), &last); err != nil || !last.Until.Equal(at.UTC()) {
+		t.Fatalf("digest until %v, want %v (%v)", last.Until, at.UTC(), err)
+	}
+}
+
+func TestRunJobRequiresPlannedTime(t *testing.T) {
+	setup(t, 1)
+	err := RunJob(context.Background(), scheduler.Job{Type: Job, ScheduledAt: time.Now(), Payload: []byte(`{}`)})
+	if !errors.Is(err, scheduler.ErrPermanent) {
+		t.Fatalf("got %v, want ErrPermanent", err)
+	}
+}
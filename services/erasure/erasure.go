@@ -0,0 +1,323 @@
+// Package erasure removes an email address from everything this service and Mailgun
+// store about it, for right to erasure requests.
+//
+// An erasure runs as a scheduler job in steps: list memberships, suppressions,
+// submissions, consent records, role grants, buffered events and webhook deliveries,
+// scheduler jobs and the audit log. Every finished step is recorded in the erasure, so a
+// retried job continues with the first unfinished step. The address itself is only kept
+// until the erasure is complete; afterwards the erasure is the receipt and refers to the
+// address by its pseudonym, which also replaces the address in the audit log, consent
+// records, events and job payloads.
+package erasure
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/audit"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/consent"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/moderation"
+	"mailinglist-backend-go/services/roles"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"mailinglist-backend-go/services/subscriptions"
+	"mailinglist-backend-go/services/webhooks"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	bucket = "erasures"
+
+	// Job is the scheduler job type running an erasure.
+	Job = "erase_member"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusCompleted Status = "completed"
+)
+
+// Step is the result of one part of an erasure.
+type Step struct {
+	Name string `json:"name" example:"memberships"`
+	Done bool   `json:"done"`
+	// Count is the number of removed or pseudonymized items.
+	Count  int    `json:"count"`
+	Detail string `json:"detail,omitempty"`
+	// Error is the last error of an unfinished step.
+	Error string `json:"error,omitempty"`
+}
+
+// Erasure is a right to erasure request and, once completed, its receipt.
+type Erasure struct {
+	ID string `json:"id"`
+	// Address is cleared when the erasure is complete.
+	Address string `json:"address,omitempty" example:"jane@example.com"`
+	// Pseudonym replaces the address in the audit log and in decided submissions.
+	Pseudonym   string     `json:"pseudonym" example:"erased:3f2a9c0d4b1e7a65"`
+	RequestedBy string     `json:"requested_by" example:"admin@example.com"`
+	Status      Status     `json:"status" example:"pending"`
+	Steps       []Step     `json:"steps"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type payload struct {
+	ID string `json:"id"`
+}
+
+// steps are run in order; each must be safe to repeat.
+var steps = []struct {
+	name string
+	run  func(ctx context.Context, e Erasure) (int, string, error)
+}{
+	{"memberships", eraseMemberships},
+	{"suppressions", eraseSuppressions},
+	{"submissions", eraseSubmissions},
+	{"consents", eraseConsents},
+	{"roles", eraseRoles},
+	{"events", eraseEvents},
+	{"jobs", eraseJobs},
+	{"audit_log", eraseAuditLog},
+}
+
+// mu serializes changes of erasures.
+var mu sync.Mutex
+
+// Start records an erasure of address and schedules its job. requestedBy is the acting
+// user; a user erasing itself is recorded by its pseudonym. A pending erasure of the
+// same address is returned instead of starting another one.
+func Start(address, requestedBy string) (Erasure, error) {
+	if _, err := mail.ParseAddress(address); err != nil {
+		return Erasure{}, fmt.Errorf("%w: invalid address: %w", common.ErrBadRequest, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	all, err := store.All[Erasure](bucket)
+	if err != nil {
+		return Erasure{}, err
+	}
+	if i := slices.IndexFunc(all, func(e Erasure) bool { return e.Status == StatusPending && strings.EqualFold(e.Address, address) }); i >= 0 {
+		return all[i], nil
+	}
+
+	pseudonym, err := pseudonymOf(address)
+	if err != nil {
+		return Erasure{}, err
+	}
+	e := Erasure{
+		ID:          uuid.NewString(),
+		Address:     address,
+		Pseudonym:   pseudonym,
+		RequestedBy: requestedBy,
+		Status:      StatusPending,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if strings.EqualFold(requestedBy, address) {
+		e.RequestedBy = pseudonym
+	}
+	for _, s := range steps {
+		e.Steps = append(e.Steps, Step{Name: s.name})
+	}
+	if err := store.Put(bucket, e.ID, e); err != nil {
+		return Erasure{}, err
+	}
+	// The job only refers to the erasure so that finished jobs do not keep the address
+	if _, err := scheduler.Schedule(Job, time.Now(), payload{ID: e.ID}, Job+":"+e.ID); err != nil {
+		return Erasure{}, err
+	}
+	return e, nil
+}
+
+func Get(id string) (Erasure, error) {
+	var e Erasure
+	err := store.Get(bucket, id, &e)
+	return e, err
+}
+
+// RunJob is the scheduler handler of [Job]. It runs the unfinished steps of the erasure
+// and completes it.
+func RunJob(ctx context.Context, job scheduler.Job) error {
+	var p payload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("%w: invalid payload: %w", scheduler.ErrPermanent, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, err := Get(p.ID)
+	if errors.Is(err, common.ErrNotFound) {
+		return fmt.Errorf("%w: erasure %s not found", scheduler.ErrPermanent, p.ID)
+	}
+	if err != nil || e.Status == StatusCompleted {
+		return err
+	}
+
+	// Erasures started before a step was added get it now
+	done := e.Steps
+	e.Steps = make([]Step, len(steps))
+	for i, s := range steps {
+		e.Steps[i] = Step{Name: s.name}
+		if j := slices.IndexFunc(done, func(d Step) bool { return d.Name == s.name }); j >= 0 {
+			e.Steps[i] = done[j]
+		}
+	}
+	for i, s := range steps {
+		if e.Steps[i].Done {
+			continue
+		}
+		count, detail, err := s.run(ctx, e)
+		e.Steps[i].Count += count
+		e.Steps[i].Detail = detail
+		if err != nil {
+			e.Steps[i].Error = err.Error()
+			if putErr := store.Put(bucket, e.ID, e); putErr != nil {
+				return errors.Join(err, putErr)
+			}
+			return fmt.Errorf("erasure %s: step %s: %w", e.ID, s.name, err)
+		}
+		e.Steps[i].Done, e.Steps[i].Error = true, ""
+		if err := store.Put(bucket, e.ID, e); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	e.Status, e.CompletedAt, e.Address = StatusCompleted, &now, ""
+	if err := store.Put(bucket, e.ID, e); err != nil {
+		return err
+	}
+	// The event is buffered and sent to webhooks, so it only carries the pseudonym.
+	// Downstream systems sharing ERASURE_PSEUDONYM_KEY derive it from their copies.
+	err = events.Publish(ctx, events.Event{Type: events.MemberErased, Actor: e.RequestedBy, Member: e.Pseudonym,
+		Data: map[string]string{"erasure": e.ID}})
+	return errors.Join(err, audit.Record(audit.Entry{Actor: e.RequestedBy, Action: "erase", Subject: e.Pseudonym, Details: map[string]string{"erasure": e.ID}}))
+}
+
+// eraseMemberships deletes the address from every list, including hidden and blocked
+// ones, and ends its pauses.
+func eraseMemberships(ctx context.Context, e Erasure) (int, string, error) {
+	memberships, err := subscriptions.Memberships(ctx, e.Address)
+	if err != nil {
+		return 0, "", err
+	}
+	removed := 0
+	for _, m := range memberships {
+		if err := mailgun.DeleteMember(ctx, m.List, e.Address); err != nil && !errors.Is(err, common.ErrNotFound) {
+			return removed, "", fmt.Errorf("failed to remove from %s: %w", m.List, err)
+		}
+		if err := subscriptions.Clear(m.List, e.Address); err != nil {
+			return removed, "", err
+		}
+		removed++
+	}
+	return removed, "", nil
+}
+
+// eraseSuppressions removes the address from the suppression lists, except for those in
+// ERASURE_KEEP_SUPPRESSIONS (default complaints), which keep Mailgun from sending to an
+// address that objected.
+func eraseSuppressions(ctx context.Context, e Erasure) (int, string, error) {
+	keep := []mailgun.SuppressionType{mailgun.Complaints}
+	if configReader.Exists("ERASURE_KEEP_SUPPRESSIONS") {
+		keep = nil
+		for _, v := range configReader.Values("ERASURE_KEEP_SUPPRESSIONS") {
+			if t, err := mailgun.ParseSuppressionType(strings.TrimSpace(v)); err == nil {
+				keep = append(keep, t)
+			}
+		}
+	}
+	suppressions, err := mailgun.SuppressedAddress(ctx, e.Address)
+	if err != nil {
+		return 0, "", err
+	}
+	removed := 0
+	var kept []string
+	for _, s := range suppressions {
+		if slices.Contains(keep, s.Type) {
+			kept = append(kept, string(s.Type))
+			continue
+		}
+		if err := mailgun.RemoveSuppression(ctx, s.Type, e.Address); err != nil && !errors.Is(err, common.ErrNotFound) {
+			return removed, "", err
+		}
+		removed++
+	}
+	if len(kept) > 0 {
+		return removed, "kept " + strings.Join(kept, ", "), nil
+	}
+	return removed, "", nil
+}
+
+func eraseSubmissions(_ context.Context, e Erasure) (int, string, error) {
+	n, err := moderation.Erase(e.Address, e.Pseudonym)
+	return n, "", err
+}
+
+func eraseConsents(_ context.Context, e Erasure) (int, string, error) {
+	n, err := consent.Erase(e.Address, e.Pseudonym)
+	return n, "", err
+}
+
+func eraseRoles(_ context.Context, e Erasure) (int, string, error) {
+	n, err := roles.Erase(e.Address, e.Pseudonym)
+	return n, "", err
+}
+
+// eraseEvents pseudonymizes the address in the event buffer and in webhook deliveries.
+func eraseEvents(_ context.Context, e Erasure) (int, string, error) {
+	buffered, err := events.Pseudonymize(e.Address, e.Pseudonym)
+	if err != nil {
+		return buffered, "", err
+	}
+	deliveries, err := webhooks.Pseudonymize(e.Address, e.Pseudonym)
+	return buffered + deliveries, "", err
+}
+
+// eraseJobs cancels the pending jobs for the address, e.g. the end of a pause, and
+// pseudonymizes it in the payloads of the others.
+func eraseJobs(_ context.Context, e Erasure) (int, string, error) {
+	n, err := scheduler.Pseudonymize(e.Address, e.Pseudonym)
+	return n, "", err
+}
+
+func eraseAuditLog(_ context.Context, e Erasure) (int, string, error) {
+	n, err := audit.Pseudonymize(e.Address, e.Pseudonym)
+	return n, "", err
+}
+
+// pseudonymOf derives a pseudonym with the key ERASURE_PSEUDONYM_KEY, so that later
+// requests about the same address can be matched to the receipt. Without a key the
+// pseudonym is random.
+func pseudonymOf(address string) (string, error) {
+	key := []byte(configReader.Value("ERASURE_PSEUDONYM_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return "", err
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(address)))
+	return "erased:" + hex.EncodeToString(mac.Sum(nil)[:8]), nil
+}
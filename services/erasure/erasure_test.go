@@ -0,0 +1,86 @@
+package erasure
+
+import (
+	"context"
+	"encoding/json"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/mailgunmock"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"mailinglist-backend-go/services/webhooks"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+func TestErasureLeavesNoEventsBehind(t *testing.T) {
+	const address = "jane@example.com"
+	mock := mailgunmock.Start()
+	t.Cleanup(mock.Close)
+	mock.AddList(mtypes.MailingList{Address: "news@lists.test"}, mtypes.Member{Address: address})
+	if err := mailgun.Setup(mailgun.Config{APIBase: mock.URL(), Domain: "lists.test", Timeout: 5 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Register(Job, RunJob)
+	scheduler.Register(webhooks.Job, webhooks.RunJob)
+	events.Reset()
+	events.Subscribe(func(_ context.Context, e events.Event) {
+		if err := webhooks.Enqueue(e); err != nil {
+			t.Error(err)
+		}
+	})
+	// The webhook is down, so its deliveries stay pending
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	hook, err := webhooks.Create(srv.URL, nil, "secret", "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	_ = events.Publish(ctx, events.Event{Type: events.MemberSubscribed, Actor: address, List: "news@lists.test", Member: address})
+	_ = events.Publish(ctx, events.Event{Type: events.MemberPaused, Actor: "admin@example.com", List: "news@lists.test", Member: address})
+
+	e, err := Start(address, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(map[string]string{"id": e.ID})
+	if err := RunJob(ctx, scheduler.Job{Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	e, _ = Get(e.ID)
+	if e.Status != StatusCompleted || e.Steps[5].Name != "events" || e.Steps[5].Count != 4 {
+		t.Fatalf("unexpected erasure: %+v", e)
+	}
+
+	buffered, _, err := events.Since("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffered) != 3 || buffered[2].Type != events.MemberErased || buffered[2].Member != e.Pseudonym {
+		t.Fatalf("unexpected events: %+v", buffered)
+	}
+	all, err := webhooks.Deliveries(hook.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(struct {
+		Events     []events.Event
+		Deliveries []webhooks.Delivery
+	}{buffered, all})
+	if strings.Contains(strings.ToLower(string(raw)), address) {
+		t.Fatalf("address is still stored: %s", raw)
+	}
+}
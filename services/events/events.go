@@ -0,0 +1,214 @@
+// Package events is the in-process bus of domain events: changes of memberships and lists
+// that downstream systems want to follow, e.g. a CRM tracking who joins or leaves a list.
+//
+// Handlers run synchronously in the goroutine that publishes the event, so they must be
+// quick, hand longer work (like outgoing webhooks) to the scheduler and not publish
+// events themselves.
+//
+// Events are numbered in the order they are published; the number is the event ID. The
+// latest EVENTS_BUFFER_SIZE (default 1000) events are kept in the local store, so that
+// stream clients can resume after a reconnect or restart with the last ID they saw.
+package events
+
+import (
+	"context"
+	"fmt"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/store"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bucket = "events"
+
+type Type string
+
+const (
+	MemberSubscribed      Type = "member.subscribed"
+	MemberUnsubscribed    Type = "member.unsubscribed"
+	MemberUpdated         Type = "member.updated"
+	MemberPaused          Type = "member.paused"
+	MemberResumed         Type = "member.resumed"
+	MemberDeliveryChanged Type = "member.delivery_changed"
+	MemberErased          Type = "member.erased"
+	SuppressionRemoved    Type = "suppression.removed"
+	// ListUpdated is a change of the settings this service keeps for a list, e.g. its
+	// member vars schema. Lists themselves are managed in Mailgun.
+	ListUpdated Type = "list.updated"
+)
+
+// Types are all event types, e.g. to validate subscriptions.
+var Types = []Type{
+	MemberSubscribed, MemberUnsubscribed, MemberUpdated, MemberPaused, MemberResumed,
+	MemberDeliveryChanged, MemberErased, SuppressionRemoved, ListUpdated,
+}
+
+// Event is a change that happened. Actor is the authenticated user that made it.
+type Event struct {
+	ID     string            `json:"id" example:"42"`
+	Type   Type              `json:"type" example:"member.subscribed"`
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor,omitempty" example:"admin@example.com"`
+	List   string            `json:"list,omitempty" example:"news@example.com"`
+	Member string            `json:"member,omitempty" example:"jane@example.com"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// Handler receives published events.
+type Handler func(ctx context.Context, e Event)
+
+var (
+	// mu serializes publishing, so that IDs are buffered and passed on in order.
+	mu        sync.Mutex
+	handlers  []Handler
+	listeners = map[chan Event]struct{}{}
+)
+
+// Subscribe adds fn to the handlers of all events published from now on.
+func Subscribe(fn Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers = append(handlers, fn)
+}
+
+// Publish numbers e, sets its time, buffers it and passes it to all handlers and
+// listeners. A failure to buffer it is returned after it was passed on.
+func Publish(ctx context.Context, e Event) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	keys := store.Keys(bucket)
+	var seq uint64 = 1
+	if len(keys) > 0 {
+		last, _ := strconv.ParseUint(keys[len(keys)-1], 10, 64)
+		seq = last + 1
+	}
+	e.ID = strconv.FormatUint(seq, 10)
+	e.Time = time.Now().UTC()
+	// The event and the removal of the events it pushes out of the buffer are one write
+	ops := []store.Op{{Bucket: bucket, Key: key(seq), Value: e}}
+	for _, k := range keys[:max(0, len(keys)+1-bufferSize())] {
+		ops = append(ops, store.Op{Bucket: bucket, Key: k, Delete: true})
+	}
+	err := store.Apply(ops...)
+
+	for _, h := range handlers {
+		h(ctx, e)
+	}
+	for ch := range listeners {
+		select {
+		case ch <- e:
+		default:
+			// A listener that does not keep up is dropped; it can resume from the buffer
+			delete(listeners, ch)
+			close(ch)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to buffer event %s: %w", e.ID, err)
+	}
+	return nil
+}
+
+// Listen returns a channel receiving all events published from now on and a function
+// to stop listening. The channel is closed if the listener falls behind.
+func Listen() (<-chan Event, func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	ch := make(chan Event, 64)
+	listeners[ch] = struct{}{}
+	return ch, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := listeners[ch]; ok {
+			delete(listeners, ch)
+			close(ch)
+		}
+	}
+}
+
+// Since returns the buffered events published after the event with ID lastID, oldest
+// first. complete is false if events after lastID are no longer buffered or lastID is
+// unknown, e.g. because the store was reset; the result then holds all buffered events
+// after lastID, or all of them.
+func Since(lastID string) (result []Event, complete bool, err error) {
+	last, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		last = math.MaxUint64
+	}
+	buffered, err := store.All[Event](bucket)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(buffered) == 0 {
+		return nil, last == 0, nil
+	}
+	first, _ := strconv.ParseUint(buffered[0].ID, 10, 64)
+	newest, _ := strconv.ParseUint(buffered[len(buffered)-1].ID, 10, 64)
+	if last > newest {
+		return buffered, false, nil
+	}
+	for _, e := range buffered {
+		if seq, _ := strconv.ParseUint(e.ID, 10, 64); seq > last {
+			result = append(result, e)
+		}
+	}
+	return result, first <= last+1, nil
+}
+
+// Pseudonymize replaces address by pseudonym as member and actor of the buffered events,
+// for right to erasure requests. It returns the number of changed events.
+func Pseudonymize(address, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	changed := 0
+	for _, k := range store.Keys(bucket) {
+		var e Event
+		if err := store.Get(bucket, k, &e); err != nil {
+			return changed, err
+		}
+		member, actor := strings.EqualFold(e.Member, address), strings.EqualFold(e.Actor, address)
+		if !member && !actor {
+			continue
+		}
+		if member {
+			e.Member = pseudonym
+		}
+		if actor {
+			e.Actor = pseudonym
+		}
+		if err := store.Put(bucket, k, e); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Reset removes all handlers and listeners.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers = nil
+	for ch := range listeners {
+		delete(listeners, ch)
+		close(ch)
+	}
+}
+
+func bufferSize() int {
+	n, err := strconv.Atoi(configReader.Value("EVENTS_BUFFER_SIZE"))
+	if err != nil || n < 1 {
+		return 1000
+	}
+	return n
+}
+
+// key pads seq so that the store sorts events in order.
+func key(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
@@ -0,0 +1,73 @@
+package events
+
+import (
+	"context"
+	"mailinglist-backend-go/services/store"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openStore(t *testing.T) {
+	t.Helper()
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	Reset()
+}
+
+func TestPublishKeepsBuffer(t *testing.T) {
+	openStore(t)
+	t.Setenv("EVENTS_BUFFER_SIZE", "3")
+	ctx := context.Background()
+
+	var handled []string
+	Subscribe(func(_ context.Context, e Event) { handled = append(handled, e.ID) })
+	for i := 0; i < 5; i++ {
+		if err := Publish(ctx, Event{Type: MemberSubscribed, Member: "member" + strconv.Itoa(i) + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handled) != 5 || handled[4] != "5" {
+		t.Fatalf("handled %v", handled)
+	}
+
+	buffered, complete, err := Since("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete || len(buffered) != 3 || buffered[0].ID != "3" {
+		t.Fatalf("since 0: complete=%v %+v", complete, buffered)
+	}
+	buffered, complete, _ = Since("3")
+	if !complete || len(buffered) != 2 || buffered[0].ID != "4" {
+		t.Fatalf("since 3: complete=%v %+v", complete, buffered)
+	}
+}
+
+func TestPseudonymize(t *testing.T) {
+	openStore(t)
+	ctx := context.Background()
+
+	_ = Publish(ctx, Event{Type: MemberSubscribed, Actor: "Jane@Example.com", List: "news@example.com", Member: "jane@example.com"})
+	_ = Publish(ctx, Event{Type: MemberUnsubscribed, Actor: "admin@example.com", List: "news@example.com", Member: "jane@example.com"})
+	_ = Publish(ctx, Event{Type: MemberSubscribed, Actor: "jane@example.com", List: "news@example.com", Member: "john@example.com"})
+	_ = Publish(ctx, Event{Type: MemberSubscribed, Actor: "john@example.com", List: "news@example.com", Member: "john@example.com"})
+
+	n, err := Pseudonymize("jane@example.com", "erased:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("changed %d events, want 3", n)
+	}
+	buffered, _, _ := Since("0")
+	for _, e := range buffered {
+		if e.Actor == "jane@example.com" || e.Member == "jane@example.com" || e.Actor == "Jane@Example.com" {
+			t.Fatalf("address is still buffered: %+v", e)
+		}
+	}
+	if buffered[0].Actor != "erased:1" || buffered[0].Member != "erased:1" || buffered[3].Member != "john@example.com" {
+		t.Fatalf("unexpected events: %+v", buffered)
+	}
+}
@@ -0,0 +1,158 @@
+// Package introspection validates opaque access tokens with OAuth 2.0 token
+// introspection (RFC 7662). It is enabled by INTROSPECTION_URL; the service authenticates
+// at the endpoint with INTROSPECTION_CLIENT_ID and INTROSPECTION_CLIENT_SECRET.
+//
+// Active tokens are cached until they expire, at most for INTROSPECTION_CACHE_TTL
+// (default 5m), so that revoked tokens are rejected after that time at the latest.
+// Inactive tokens and failures are not cached.
+package introspection
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/configReader"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInactive is returned for tokens the authorization server does not consider active.
+var ErrInactive = errors.New("token is not active")
+
+// maxCacheSize is the number of cached tokens above which expired entries are purged.
+const maxCacheSize = 10000
+
+type entry struct {
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+var (
+	mu     sync.Mutex
+	cache  = map[string]entry{}
+	client = &http.Client{}
+)
+
+// Enabled reports whether INTROSPECTION_URL is set.
+func Enabled() bool {
+	return configReader.Value("INTROSPECTION_URL") != ""
+}
+
+// Introspect returns the claims of an active token. The claims are those of the
+// introspection response without "active". Unless the response marks the token as one of
+// a service account, its client_id is moved to azp, as in the user's JWTs, so that the
+// token is not taken for a machine client.
+func Introspect(ctx context.Context, token string) (jwt.MapClaims, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	mu.Lock()
+	e, ok := cache[key]
+	mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.claims, nil
+	}
+
+	claims, err := introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(configReader.Duration("INTROSPECTION_CACHE_TTL", 5*time.Minute))
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		if !exp.After(now) {
+			return nil, ErrInactive
+		}
+		if exp.Before(expires) {
+			expires = exp.Time
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(cache) >= maxCacheSize {
+		for k, e := range cache {
+			if !now.Before(e.expires) {
+				delete(cache, k)
+			}
+		}
+	}
+	cache[key] = entry{claims: claims, expires: expires}
+	return claims, nil
+}
+
+// Reset empties the cache.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	cache = map[string]entry{}
+}
+
+func introspect(ctx context.Context, token string) (jwt.MapClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, configReader.Duration("INTROSPECTION_TIMEOUT", 5*time.Second))
+	defer cancel()
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, configReader.Value("INTROSPECTION_URL"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(configReader.Value("INTROSPECTION_CLIENT_ID")), url.QueryEscape(configReader.Value("INTROSPECTION_CLIENT_SECRET")))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("introspection failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint answered %s", resp.Status)
+	}
+	var claims jwt.MapClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInactive
+	}
+	delete(claims, "active")
+
+	if !serviceAccount(claims) {
+		// client_id alone would make the token a machine client, which is an admin within
+		// its scopes. Tokens not marked as issued to a service account are user tokens
+		// instead and are rejected without the user claims.
+		if client, ok := claims["client_id"]; ok {
+			if _, ok := claims["azp"]; !ok {
+				claims["azp"] = client
+			}
+			delete(claims, "client_id")
+		}
+	}
+	return claims, nil
+}
+
+// serviceAccount reports whether the introspection response explicitly marks a token of a
+// client acting on its own behalf: a Keycloak service account user ("service-account-"
+// prefix) or a subject that is the client itself.
+func serviceAccount(claims jwt.MapClaims) bool {
+	for _, claim := range []string{"username", "preferred_username"} {
+		if username, _ := claims[claim].(string); strings.HasPrefix(username, "service-account-") {
+			return true
+		}
+	}
+	client, _ := claims["client_id"].(string)
+	sub, _ := claims["sub"].(string)
+	return client != "" && sub == client
+}
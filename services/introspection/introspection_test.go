@@ -0,0 +1,54 @@
+package introspection
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMachineClients(t *testing.T) {
+	responses := map[string]map[string]any{
+		"service-account": {"active": true, "client_id": "batch", "username": "service-account-batch"},
+		"preferred":       {"active": true, "client_id": "batch", "preferred_username": "service-account-batch"},
+		"own-subject":     {"active": true, "client_id": "crm", "sub": "crm"},
+		"user":            {"active": true, "client_id": "frontend", "username": "jane", "email": "jane@example.test"},
+		"unmarked":        {"active": true, "client_id": "frontend"},
+		"other-subject":   {"active": true, "client_id": "frontend", "sub": "f2a0c1e4"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]any{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	t.Setenv("INTROSPECTION_URL", srv.URL)
+	Reset()
+
+	for token, machine := range map[string]bool{
+		"service-account": true,
+		"preferred":       true,
+		"own-subject":     true,
+		"user":            false,
+		"unmarked":        false,
+		"other-subject":   false,
+	} {
+		claims, err := Introspect(t.Context(), token)
+		if err != nil {
+			t.Fatalf("%s: %v", token, err)
+		}
+		_, hasClient := claims["client_id"]
+		if hasClient != machine {
+			t.Errorf("%s: client_id kept = %v, want %v", token, hasClient, machine)
+		}
+		if !machine && claims["azp"] != responses[token]["client_id"] {
+			t.Errorf("%s: azp = %v", token, claims["azp"])
+		}
+	}
+
+	if _, err := Introspect(t.Context(), "revoked"); err != ErrInactive {
+		t.Fatalf("inactive token: got %v", err)
+	}
+}
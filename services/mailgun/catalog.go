@@ -0,0 +1,125 @@
+package mailgun
+
+import (
+	"context"
+	"mailinglist-backend-go/services/configReader"
+	"sync"
+	"time"
+)
+
+// catalog caches all mailing lists (including hidden ones) in process.
+//
+// Entries younger than ttl are served directly. Entries older than ttl but younger than
+// ttl+stale are served as well while a single background refresh is started
+// (stale-while-revalidate). Anything older is a miss and the caller waits for the fetch.
+// Concurrent misses share one fetch.
+type catalog struct {
+	ttl   time.Duration
+	stale time.Duration
+	fetch func(ctx context.Context) ([]MGMailingList, error)
+
+	mu         sync.Mutex
+	lists      []MGMailingList
+	fetchedAt  time.Time
+	valid      bool
+	generation int
+	inflight   *catalogFetch
+}
+
+type catalogFetch struct {
+	done  chan struct{}
+	lists []MGMailingList
+	err   error
+}
+
+var listCache = &catalog{
+	ttl:   configReader.Duration("MAILGUN_LISTS_CACHE_TTL", 5*time.Minute),
+	stale: configReader.Duration("MAILGUN_LISTS_CACHE_STALE", time.Hour),
+}
+
+func init() {
+	// Assigned here to break the initialization cycle Setup -> InvalidateLists -> listCache
+	listCache.fetch = fetchLists
+}
+
+// InvalidateLists drops the cached list catalog. The next read fetches it from Mailgun again.
+func InvalidateLists() {
+	listCache.invalidate()
+}
+
+func (c *catalog) get(ctx context.Context) ([]MGMailingList, error) {
+	c.mu.Lock()
+	if c.valid {
+		age := time.Since(c.fetchedAt)
+		if age < c.ttl {
+			defer c.mu.Unlock()
+			return c.lists, nil
+		}
+		if age < c.ttl+c.stale {
+			defer c.mu.Unlock()
+			c.refresh()
+			return c.lists, nil
+		}
+	}
+	f := c.refresh()
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.lists, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh starts a fetch unless one is already running. c.mu must be held.
+func (c *catalog) refresh() *catalogFetch {
+	if c.inflight != nil {
+		return c.inflight
+	}
+	f := &catalogFetch{done: make(chan struct{})}
+	c.inflight = f
+	generation := c.generation
+
+	go func() {
+		// Detached from the caller so that a cancelled request does not abort the shared fetch
+		f.lists, f.err = c.fetch(context.Background())
+
+		c.mu.Lock()
+		if c.inflight == f {
+			c.inflight = nil
+		}
+		// Results of fetches started before an invalidation are handed to the waiting callers only
+		if f.err == nil && generation == c.generation {
+			c.lists = f.lists
+			c.fetchedAt = time.Now()
+			c.valid = true
+		}
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// markStale keeps the cached lists but lets the next read refresh them in the
+// background, e.g. after a membership change altered a member count. Results of a fetch
+// already running may miss the change and are not cached.
+func (c *catalog) markStale() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expired := time.Now().Add(-c.ttl); c.valid && c.fetchedAt.After(expired) {
+		c.fetchedAt = expired
+	}
+	c.generation++
+	c.inflight = nil
+}
+
+func (c *catalog) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.valid = false
+	c.lists = nil
+	c.generation++
+	// A fetch started before the invalidation may already miss the change
+	c.inflight = nil
+}
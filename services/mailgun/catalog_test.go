@@ -0,0 +1,51 @@
+package mailgun
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+func TestCatalogMarkStale(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{}, 1)
+	c := &catalog{ttl: time.Minute, stale: time.Hour}
+	c.fetch = func(ctx context.Context) ([]MGMailingList, error) {
+		n := fetches.Add(1)
+		if n > 1 {
+			<-release
+		}
+		return []MGMailingList{{MailingList: &mtypes.MailingList{MembersCount: int(n)}}}, nil
+	}
+	ctx := context.Background()
+
+	lists, err := c.get(ctx)
+	if err != nil || lists[0].MembersCount != 1 {
+		t.Fatalf("first read: %v %+v", err, lists)
+	}
+	c.markStale()
+
+	// The stale lists are served while the refresh is blocked
+	lists, err = c.get(ctx)
+	if err != nil || lists[0].MembersCount != 1 {
+		t.Fatalf("read after markStale: %v %+v", err, lists)
+	}
+	release <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for {
+		lists, _ = c.get(ctx)
+		if lists[0].MembersCount == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("catalog was not refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+}
@@ -0,0 +1,204 @@
+package mailgun
+
+import (
+	"context"
+	"fmt"
+	"mailinglist-backend-go/services/configReader"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5"
+)
+
+// Config configures the shared Mailgun client.
+type Config struct {
+	APIKey string
+	// Region is either "eu" or "us". It is ignored if APIBase is set.
+	Region string
+	// APIBase overrides the region, e.g. to point the client to a local mock.
+	APIBase string
+	// Domain is the sending domain used for domain scoped APIs (messages, events, suppressions).
+	Domain string
+	// Timeout bounds every single operation against Mailgun, including retries.
+	Timeout time.Duration
+	// MaxRetries is the number of retries on 429 responses, and on 5xx responses and
+	// connection errors of idempotent requests.
+	MaxRetries int
+}
+
+// ConfigFromEnv reads the client configuration from the MAILGUN_* environment variables.
+func ConfigFromEnv() Config {
+	retries, err := strconv.Atoi(configReader.Value("MAILGUN_MAX_RETRIES"))
+	if err != nil {
+		retries = 3
+	}
+	region := configReader.Value("MAILGUN_REGION")
+	if region == "" {
+		region = "eu"
+	}
+	return Config{
+		APIKey:     configReader.Value("MAILGUN_API_KEY"),
+		Region:     region,
+		APIBase:    configReader.Value("MAILGUN_API_BASE"),
+		Domain:     configReader.Value("MAILGUN_DOMAIN"),
+		Timeout:    configReader.Duration("MAILGUN_TIMEOUT", 30*time.Second),
+		MaxRetries: retries,
+	}
+}
+
+var (
+	clientMu     sync.Mutex
+	sharedClient *mailgun.Client
+	sharedConfig Config
+)
+
+// Setup (re)creates the shared client from cfg. Without a call to Setup the client
+// is lazily created from [ConfigFromEnv] on first use.
+func Setup(c Config) error {
+	base := c.APIBase
+	if base == "" {
+		switch strings.ToLower(c.Region) {
+		case "eu":
+			base = mailgun.APIBaseEU
+		case "us":
+			base = mailgun.APIBaseUS
+		default:
+			return fmt.Errorf("unknown mailgun region %q", c.Region)
+		}
+	}
+
+	client := mailgun.NewMailgun(c.APIKey)
+	err := client.SetAPIBase(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return err
+	}
+	client.SetHTTPClient(&http.Client{Transport: &retryTransport{
+		next:       http.DefaultTransport,
+		maxRetries: c.MaxRetries,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}})
+
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	sharedClient = client
+	sharedConfig = c
+	InvalidateLists()
+	return nil
+}
+
+// client returns the shared client and its configuration.
+func client() (*mailgun.Client, Config, error) {
+	clientMu.Lock()
+	if sharedClient != nil {
+		defer clientMu.Unlock()
+		return sharedClient, sharedConfig, nil
+	}
+	clientMu.Unlock()
+
+	if err := Setup(ConfigFromEnv()); err != nil {
+		return nil, Config{}, err
+	}
+	return client()
+}
+
+// withTimeout bounds ctx by the configured operation timeout.
+func withTimeout(ctx context.Context, c Config) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+// retryTransport retries requests using exponential backoff with full jitter. A
+// Retry-After header sent by Mailgun takes precedence. Responses with 429 were not
+// processed and are retried for every method. 5xx responses and connection errors are
+// only retried for idempotent methods: a POST (e.g. sending a message) may have been
+// processed before it failed and is not repeated.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.maxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		switch {
+		case err != nil:
+			if !idempotent(req.Method) {
+				return nil, err
+			}
+		case resp.StatusCode == http.StatusTooManyRequests:
+		case !retryable(resp.StatusCode) || !idempotent(req.Method):
+			return resp, nil
+		}
+		// The body has to be replayed for the next attempt
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+
+		retryAfter := ""
+		if resp != nil {
+			retryAfter = resp.Header.Get("Retry-After")
+			_ = resp.Body.Close()
+		}
+		wait := t.backoff(attempt, retryAfter)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// backoff returns the wait before the next attempt. Retry-After is either a number of
+// seconds or an HTTP date.
+func (t *retryTransport) backoff(attempt int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return min(time.Duration(seconds)*time.Second, t.maxBackoff)
+	}
+	if at, err := http.ParseTime(retryAfter); err == nil {
+		return min(max(time.Until(at), 0), t.maxBackoff)
+	}
+	ceiling := min(t.minBackoff<<attempt, t.maxBackoff)
+	return time.Duration(rand.Int64N(int64(ceiling)) + 1)
+}
+
+// idempotent reports whether repeating a request with method has no further effect.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
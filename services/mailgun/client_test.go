@@ -0,0 +1,84 @@
+package mailgun
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedTransport answers with the given statuses in turn; a status of 0 is a
+// connection error.
+type scriptedTransport struct {
+	statuses []int
+	calls    int
+	header   http.Header
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := s.statuses[min(s.calls, len(s.statuses)-1)]
+	s.calls++
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}
+	if status == 0 {
+		return nil, errors.New("connection reset")
+	}
+	return &http.Response{StatusCode: status, Header: s.header.Clone(), Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		statuses []int
+		calls    int
+		status   int
+	}{
+		{"POST is retried on 429", http.MethodPost, []int{429, 429, 200}, 3, 200},
+		{"POST is not retried on 5xx", http.MethodPost, []int{503, 200}, 1, 503},
+		{"POST is not retried on connection errors", http.MethodPost, []int{0, 200}, 1, 0},
+		{"GET is retried on 5xx", http.MethodGet, []int{500, 502, 200}, 3, 200},
+		{"DELETE is retried on connection errors", http.MethodDelete, []int{0, 200}, 2, 200},
+		{"retries are limited", http.MethodPut, []int{503}, 3, 503},
+		{"client errors are not retried", http.MethodGet, []int{404}, 1, 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &scriptedTransport{statuses: tt.statuses}
+			rt := &retryTransport{next: next, maxRetries: 2, minBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+			req, _ := http.NewRequest(tt.method, "http://mailgun.test/v3/lists", strings.NewReader("a=b"))
+			resp, err := rt.RoundTrip(req)
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
+				resp.Body.Close()
+			}
+			if next.calls != tt.calls || status != tt.status {
+				t.Fatalf("got %d calls and status %d (%v), want %d calls and status %d", next.calls, status, err, tt.calls, tt.status)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	rt := &retryTransport{minBackoff: time.Millisecond, maxBackoff: time.Minute}
+	if d := rt.backoff(0, "7"); d != 7*time.Second {
+		t.Fatalf("seconds: got %s", d)
+	}
+	at := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if d := rt.backoff(0, at); d < 28*time.Second || d > 30*time.Second {
+		t.Fatalf("HTTP date: got %s", d)
+	}
+	if d := rt.backoff(0, time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)); d != 0 {
+		t.Fatalf("past HTTP date: got %s", d)
+	}
+	if d := rt.backoff(0, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); d != time.Minute {
+		t.Fatalf("HTTP date beyond the maximum: got %s", d)
+	}
+	if d := rt.backoff(0, "soon"); d <= 0 || d > time.Millisecond {
+		t.Fatalf("invalid value: got %s", d)
+	}
+}
@@ -0,0 +1,142 @@
+package mailgun
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5"
+	"github.com/mailgun/mailgun-go/v5/events"
+)
+
+// DeliveryEvent is the part of a Mailgun event needed to attribute it to a list and tag.
+type DeliveryEvent struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"event" example:"delivered"`
+	Timestamp float64 `json:"timestamp"`
+	Recipient string  `json:"recipient" example:"jane@example.com"`
+	// List is the mailing list the message was sent to, if it can be determined.
+	List string   `json:"list,omitempty" example:"news@example.com"`
+	Tags []string `json:"tags,omitempty"`
+	// Severity is set for failed events, "permanent" or "temporary".
+	Severity string `json:"severity,omitempty"`
+}
+
+// deliveryEventNames are the events relevant for delivery statistics.
+var deliveryEventNames = []string{
+	events.EventDelivered,
+	events.EventOpened,
+	events.EventClicked,
+	events.EventFailed,
+	events.EventComplained,
+	events.EventUnsubscribed,
+}
+
+// DeliveryEvents calls fn for every delivery related event of the configured domain
+// between begin and end, oldest first. It requires MAILGUN_DOMAIN.
+func DeliveryEvents(ctx context.Context, begin, end time.Time, fn func(DeliveryEvent) error) error {
+	return listEvents(ctx, begin, end, map[string]string{"event": strings.Join(deliveryEventNames, " OR ")}, fn)
+}
+
+// RecipientEvents returns the delivery related events of recipient between begin and
+// end, oldest first. It requires MAILGUN_DOMAIN.
+func RecipientEvents(ctx context.Context, recipient string, begin, end time.Time) ([]DeliveryEvent, error) {
+	result := []DeliveryEvent{}
+	err := listEvents(ctx, begin, end, map[string]string{"recipient": recipient}, func(e DeliveryEvent) error {
+		result = append(result, e)
+		return nil
+	})
+	return result, err
+}
+
+// listEvents calls fn for every delivery related event matching filter.
+func listEvents(ctx context.Context, begin, end time.Time, filter map[string]string, fn func(DeliveryEvent) error) error {
+	mg, c, err := client()
+	if err != nil {
+		return err
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("MAILGUN_DOMAIN is required to read events")
+	}
+
+	it := mg.ListEvents(c.Domain, &mailgun.ListEventOptions{
+		Begin:          begin,
+		End:            end,
+		ForceAscending: true,
+		Limit:          300,
+		Filter:         filter,
+	})
+	var page []events.Event
+	for {
+		pageCtx, cancel := withTimeout(ctx, c)
+		more := it.Next(pageCtx, &page)
+		cancel()
+		if !more || len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			if de, ok := toDeliveryEvent(e); ok {
+				if err := fn(de); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("failed to read events: %w", mapError(err))
+	}
+	return nil
+}
+
+// toDeliveryEvent extracts the relevant fields of e. The list is taken from the "list"
+// variable set by [SendToList], then from the mailing list of the event and finally
+// from the To header of the message.
+func toDeliveryEvent(e events.Event) (DeliveryEvent, bool) {
+	var (
+		de        DeliveryEvent
+		generic   events.Generic
+		message   events.Message
+		listAddr  string
+		variables any
+	)
+	switch e := e.(type) {
+	case *events.Delivered:
+		generic, message, variables = e.Generic, e.Message, e.UserVariables
+		de.Recipient, de.Tags = e.Recipient, e.Tags
+	case *events.Failed:
+		generic, message, variables = e.Generic, e.Message, e.UserVariables
+		de.Recipient, de.Tags, de.Severity = e.Recipient, e.Tags, e.Severity
+	case *events.Opened:
+		generic, message, variables, listAddr = e.Generic, e.Message, e.UserVariables, e.MailingList.Address
+		de.Recipient, de.Tags = e.Recipient, e.Tags
+	case *events.Clicked:
+		generic, message, variables, listAddr = e.Generic, e.Message, e.UserVariables, e.MailingList.Address
+		de.Recipient, de.Tags = e.Recipient, e.Tags
+	case *events.Unsubscribed:
+		generic, message, variables, listAddr = e.Generic, e.Message, e.UserVariables, e.MailingList.Address
+		de.Recipient, de.Tags = e.Recipient, e.Tags
+	case *events.Complained:
+		generic, message, variables = e.Generic, e.Message, e.UserVariables
+		de.Recipient, de.Tags = e.Recipient, e.Tags
+	default:
+		return DeliveryEvent{}, false
+	}
+	de.ID = generic.ID
+	de.Name = generic.GetName()
+	de.Timestamp = generic.Timestamp
+
+	if vars, ok := variables.(map[string]any); ok {
+		if list, ok := vars["list"].(string); ok {
+			listAddr = list
+		}
+	}
+	if listAddr == "" && message.Headers.To != "" {
+		if addr, err := mail.ParseAddress(message.Headers.To); err == nil {
+			listAddr = addr.Address
+		}
+	}
+	de.List = strings.ToLower(listAddr)
+	return de, true
+}
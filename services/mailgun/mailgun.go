@@ -2,17 +2,19 @@ package mailgun
 
 import (
 	"context"
+	"fmt"
 	"mailinglist-backend-go/services/common"
 	"mailinglist-backend-go/services/configReader"
+	"maps"
+	"net/http"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/mailgun/mailgun-go/v5"
 	"github.com/mailgun/mailgun-go/v5/mtypes"
 )
 
-var apiKey = configReader.Value("MAILGUN_API_KEY")
-
 type MGMailingList struct {
 	*mtypes.MailingList
 	Blocked bool `json:"blocked"`
@@ -42,36 +44,124 @@ type APIMailingList struct {
 	Hidden      bool   `json:"hidden"`
 }
 
-func Lists(includeHidden bool) ([]MGMailingList, error) {
-	mg := mailgun.NewMailgun(apiKey)
-	err := mg.SetAPIBase(mailgun.APIBaseEU)
+// Lists returns all mailing lists from the cached catalog. Hidden lists are only
+// included if includeHidden is set.
+func Lists(ctx context.Context, includeHidden bool) ([]MGMailingList, error) {
+	all, err := listCache.get(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	var lists []MGMailingList
+	for _, list := range all {
+		if includeHidden == true || list.Hidden == false {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// List returns a single mailing list by address from the cached catalog. Hidden lists
+// are reported as not found unless includeHidden is set.
+func List(ctx context.Context, listAddress string, includeHidden bool) (MGMailingList, error) {
+	all, err := Lists(ctx, includeHidden)
+	if err != nil {
+		return MGMailingList{}, err
+	}
+	for _, list := range all {
+		if list.Address == listAddress {
+			return list, nil
+		}
+	}
+	return MGMailingList{}, common.ErrNotFound
+}
+
+// fetchLists pages through all mailing lists of the account.
+func fetchLists(ctx context.Context) ([]MGMailingList, error) {
+	mg, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
 	listIterator := mg.ListMailingLists(&mailgun.ListOptions{Limit: 100})
 
 	var lists []MGMailingList
 
 	var page []mtypes.MailingList
-	// The entire operation should not take longer than 30 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
-
 	for listIterator.Next(ctx, &page) {
 		for _, list := range page {
-			hideElement := isHidden(list.Address)
-			if includeHidden == true || (includeHidden == false && hideElement == false) {
-				lists = append(lists, MGMailingList{&list, !isSubscriptable(list.Address), hideElement})
-			}
+			lists = append(lists, MGMailingList{&list, !isSubscriptable(list.Address), isHidden(list.Address)})
 		}
 	}
+	if err := listIterator.Err(); err != nil {
+		return nil, err
+	}
 	return lists, nil
 }
 
-func Subscribe(listAddress string, memberAddress string) error {
-	mg := mailgun.NewMailgun(apiKey)
-	err := mg.SetAPIBase(mailgun.APIBaseEU)
+// MemberStatus is the delivery status of a member.
+type MemberStatus string
+
+const (
+	StatusSubscribed   MemberStatus = "subscribed"
+	StatusUnsubscribed MemberStatus = "unsubscribed"
+	// StatusPaused is an unsubscribed member that is subscribed again automatically.
+	StatusPaused MemberStatus = "paused"
+	// StatusDigest is a member receiving digests instead of every message. It is
+	// unsubscribed in Mailgun so that list messages skip it.
+	StatusDigest MemberStatus = "digest"
+)
+
+// Delivery is how a member receives the messages of a list.
+type Delivery string
+
+const (
+	DeliveryImmediate Delivery = "immediate"
+	DeliveryDaily     Delivery = "daily"
+	DeliveryWeekly    Delivery = "weekly"
+)
+
+// DeliveryVar is the member var storing the [Delivery] of digest members.
+const DeliveryVar = "delivery"
+
+// ParseDelivery parses a delivery mode.
+func ParseDelivery(d string) (Delivery, error) {
+	switch Delivery(d) {
+	case DeliveryImmediate, DeliveryDaily, DeliveryWeekly:
+		return Delivery(d), nil
+	}
+	return "", fmt.Errorf("%w: delivery must be immediate, daily or weekly", common.ErrBadRequest)
+}
+
+// UnsubscribeMode is what happens to a member that unsubscribes.
+type UnsubscribeMode string
+
+const (
+	// UnsubscribeDelete removes the member from the list.
+	UnsubscribeDelete UnsubscribeMode = "delete"
+	// UnsubscribeMark keeps the member with subscribed=false.
+	UnsubscribeMark UnsubscribeMode = "mark"
+)
+
+// Member is a member of a mailing list.
+type Member struct {
+	Address    string         `json:"address" example:"jane@example.com"`
+	Name       string         `json:"name,omitempty" example:"Jane Doe"`
+	Subscribed bool           `json:"subscribed"`
+	Status     MemberStatus   `json:"status" example:"subscribed"`
+	Delivery   Delivery       `json:"delivery" example:"immediate"`
+	Vars       map[string]any `json:"vars"`
+	// PausedUntil is set for paused members.
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+// Subscribe adds member to the list. An existing member is subscribed again and gets the
+// new name, if one is given, but keeps its vars; member.Vars are only set on new members.
+// Digest members already receive the list and stay in digest mode.
+func Subscribe(ctx context.Context, listAddress string, member Member) error {
+	mg, c, err := client()
 	if err != nil {
 		return err
 	}
@@ -80,19 +170,35 @@ func Subscribe(listAddress string, memberAddress string) error {
 		return common.ErrForbidden
 	}
 
-	// The entire operation should not take longer than 30 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := withTimeout(ctx, c)
 	defer cancel()
 
 	subscribed := true
 
-	err = mg.CreateMember(ctx, true, listAddress, mtypes.Member{Address: memberAddress, Subscribed: &subscribed})
-	return err
+	existing, err := mg.GetMember(ctx, member.Address, listAddress)
+	switch {
+	case err == nil && toMember(existing).Status == StatusDigest:
+		if member.Name != "" {
+			_, err = mg.UpdateMember(ctx, member.Address, listAddress, mtypes.Member{Name: member.Name})
+		}
+	case err == nil:
+		_, err = mg.UpdateMember(ctx, member.Address, listAddress, mtypes.Member{Name: member.Name, Subscribed: &subscribed})
+	case mailgun.GetStatusFromErr(err) == http.StatusNotFound:
+		err = mg.CreateMember(ctx, true, listAddress, mtypes.Member{Address: member.Address, Name: member.Name, Vars: member.Vars, Subscribed: &subscribed})
+	}
+	if err != nil {
+		return mapError(err)
+	}
+	// The member count of the list changed
+	listCache.markStale()
+	return nil
 }
 
-func Unsubscribe(listAddress string, memberAddress string) error {
-	mg := mailgun.NewMailgun(apiKey)
-	err := mg.SetAPIBase(mailgun.APIBaseEU)
+// Unsubscribe removes a member from the list or, if the unsubscribe mode of the list is
+// [UnsubscribeMark], keeps it with subscribed=false so that its name and vars survive.
+// A kept digest member loses its digest mode.
+func Unsubscribe(ctx context.Context, listAddress string, memberAddress string) error {
+	mg, c, err := client()
 	if err != nil {
 		return err
 	}
@@ -101,12 +207,217 @@ func Unsubscribe(listAddress string, memberAddress string) error {
 		return common.ErrForbidden
 	}
 
-	// The entire operation should not take longer than 30 seconds
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	mode, err := UnsubscribeModeOf(listAddress)
+	if err != nil {
+		return err
+	}
+	if mode == UnsubscribeMark {
+		var member mtypes.Member
+		if member, err = mg.GetMember(ctx, memberAddress, listAddress); err == nil {
+			subscribed := false
+			update := mtypes.Member{Subscribed: &subscribed}
+			if _, ok := member.Vars[DeliveryVar]; ok {
+				update.Vars = maps.Clone(member.Vars)
+				delete(update.Vars, DeliveryVar)
+			}
+			_, err = mg.UpdateMember(ctx, memberAddress, listAddress, update)
+		}
+	} else {
+		err = mg.DeleteMember(ctx, memberAddress, listAddress)
+	}
+	if err != nil {
+		return mapError(err)
+	}
+	// The member count of the list changed
+	listCache.markStale()
+	return nil
+}
+
+// DeleteMember removes a member from the list regardless of the unsubscribe mode, e.g. to
+// undo the creation of a member.
+func DeleteMember(ctx context.Context, listAddress string, memberAddress string) error {
+	mg, c, err := client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	if err := mg.DeleteMember(ctx, memberAddress, listAddress); err != nil {
+		return mapError(err)
+	}
+	listCache.markStale()
+	return nil
+}
+
+// SetSubscribed changes the subscription of an existing member without removing it,
+// e.g. to pause and resume deliveries.
+func SetSubscribed(ctx context.Context, listAddress string, memberAddress string, subscribed bool) (Member, error) {
+	mg, c, err := client()
+	if err != nil {
+		return Member{}, err
+	}
+
+	if isSubscriptable(listAddress) == false {
+		return Member{}, common.ErrForbidden
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	member, err := mg.UpdateMember(ctx, memberAddress, listAddress, mtypes.Member{Subscribed: &subscribed})
+	if err != nil {
+		return Member{}, mapError(err)
+	}
+	return toMember(member), nil
+}
+
+// GetMember returns a single member of a list.
+func GetMember(ctx context.Context, listAddress string, memberAddress string) (Member, error) {
+	mg, c, err := client()
+	if err != nil {
+		return Member{}, err
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	member, err := mg.GetMember(ctx, memberAddress, listAddress)
+	if err != nil {
+		return Member{}, mapError(err)
+	}
+	return toMember(member), nil
+}
+
+// UpdateMember changes the name (unless empty) and replaces the vars (unless nil) of a member.
+func UpdateMember(ctx context.Context, listAddress string, memberAddress string, name string, vars map[string]any) (Member, error) {
+	mg, c, err := client()
+	if err != nil {
+		return Member{}, err
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	member, err := mg.UpdateMember(ctx, memberAddress, listAddress, mtypes.Member{Name: name, Vars: vars})
+	if err != nil {
+		return Member{}, mapError(err)
+	}
+	return toMember(member), nil
+}
+
+// SetDelivery switches a subscribed or digest member between immediate delivery and
+// digests. Digest members are unsubscribed in Mailgun and keep the mode in [DeliveryVar].
+func SetDelivery(ctx context.Context, listAddress string, memberAddress string, delivery Delivery) (Member, error) {
+	mg, c, err := client()
+	if err != nil {
+		return Member{}, err
+	}
+
+	if isSubscriptable(listAddress) == false {
+		return Member{}, common.ErrForbidden
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
 	defer cancel()
 
-	err = mg.DeleteMember(ctx, memberAddress, listAddress)
+	existing, err := mg.GetMember(ctx, memberAddress, listAddress)
+	if err != nil {
+		return Member{}, mapError(err)
+	}
+	if toMember(existing).Status == StatusUnsubscribed {
+		return Member{}, fmt.Errorf("%w: member is not subscribed", common.ErrConflict)
+	}
 
+	subscribed := delivery == DeliveryImmediate
+	vars := maps.Clone(existing.Vars)
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	delete(vars, DeliveryVar)
+	if !subscribed {
+		vars[DeliveryVar] = string(delivery)
+	}
+	member, err := mg.UpdateMember(ctx, memberAddress, listAddress, mtypes.Member{Subscribed: &subscribed, Vars: vars})
+	if err != nil {
+		return Member{}, mapError(err)
+	}
+	return toMember(member), nil
+}
+
+// Members returns all members of a list, including unsubscribed ones.
+func Members(ctx context.Context, listAddress string) ([]Member, error) {
+	mg, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	it := mg.ListMembers(listAddress, &mailgun.ListOptions{Limit: 100})
+	var members []Member
+	var page []mtypes.Member
+	for it.Next(ctx, &page) {
+		for _, m := range page {
+			members = append(members, toMember(m))
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, mapError(err)
+	}
+	return members, nil
+}
+
+func toMember(m mtypes.Member) Member {
+	vars := m.Vars
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	member := Member{Address: m.Address, Name: m.Name, Subscribed: m.Subscribed == nil || *m.Subscribed, Vars: vars}
+	member.Status, member.Delivery = StatusUnsubscribed, DeliveryImmediate
+	d, _ := vars[DeliveryVar].(string)
+	switch {
+	case member.Subscribed:
+		member.Status = StatusSubscribed
+	case Delivery(d) == DeliveryDaily || Delivery(d) == DeliveryWeekly:
+		member.Status, member.Delivery = StatusDigest, Delivery(d)
+	}
+	return member
+}
+
+// IsMember reports whether memberAddress is a subscribed (or digest) member of listAddress.
+func IsMember(ctx context.Context, listAddress string, memberAddress string) (bool, error) {
+	mg, c, err := client()
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	member, err := mg.GetMember(ctx, memberAddress, listAddress)
+	if mailgun.GetStatusFromErr(err) == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return toMember(member).Status != StatusUnsubscribed, nil
+}
+
+// mapError translates Mailgun HTTP status codes into the common errors so that
+// handlers can map them to the matching response codes.
+func mapError(err error) error {
+	switch mailgun.GetStatusFromErr(err) {
+	case http.StatusNotFound:
+		return common.ErrNotFound
+	case http.StatusBadRequest:
+		return common.ErrBadRequest
+	}
 	return err
 }
 
@@ -115,6 +426,52 @@ func isSubscriptable(list string) bool {
 	return !slices.Contains(blocked, list)
 }
 
+// UnsubscribeModeOf returns the unsubscribe mode of list: the entry list=mode of
+// MAILGUN_UNSUBSCRIBE_MODES, otherwise MAILGUN_UNSUBSCRIBE_MODE (default delete). A mode
+// other than delete or mark is an error, so that a typo does not silently delete members.
+func UnsubscribeModeOf(list string) (UnsubscribeMode, error) {
+	for _, entry := range configReader.Values("MAILGUN_UNSUBSCRIBE_MODES") {
+		if l, mode, ok := strings.Cut(entry, "="); ok && strings.EqualFold(strings.TrimSpace(l), list) {
+			return parseUnsubscribeMode(strings.TrimSpace(mode))
+		}
+	}
+	if mode := configReader.Value("MAILGUN_UNSUBSCRIBE_MODE"); mode != "" {
+		return parseUnsubscribeMode(mode)
+	}
+	return UnsubscribeDelete, nil
+}
+
+// CheckUnsubscribeModes validates MAILGUN_UNSUBSCRIBE_MODE and MAILGUN_UNSUBSCRIBE_MODES.
+func CheckUnsubscribeModes() error {
+	if mode := configReader.Value("MAILGUN_UNSUBSCRIBE_MODE"); mode != "" {
+		if _, err := parseUnsubscribeMode(mode); err != nil {
+			return err
+		}
+	}
+	for _, entry := range configReader.Values("MAILGUN_UNSUBSCRIBE_MODES") {
+		// Unset, or a trailing comma
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		list, mode, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid unsubscribe mode entry %q, expected list=mode", entry)
+		}
+		if _, err := parseUnsubscribeMode(strings.TrimSpace(mode)); err != nil {
+			return fmt.Errorf("%s: %w", strings.TrimSpace(list), err)
+		}
+	}
+	return nil
+}
+
+func parseUnsubscribeMode(mode string) (UnsubscribeMode, error) {
+	switch m := UnsubscribeMode(mode); m {
+	case UnsubscribeDelete, UnsubscribeMark:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid unsubscribe mode %q, expected delete or mark", mode)
+}
+
 func isHidden(list string) bool {
 	hidden := configReader.Values("MAILGUN_HIDDEN_MAILING_LISTS")
 	return slices.Contains(hidden, list)
@@ -0,0 +1,37 @@
+package mailgun
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckUnsubscribeModes(t *testing.T) {
+	t.Setenv("MAILGUN_UNSUBSCRIBE_MODE", "")
+	t.Setenv("MAILGUN_UNSUBSCRIBE_MODES", "")
+	_ = os.Unsetenv("MAILGUN_UNSUBSCRIBE_MODES")
+	if err := CheckUnsubscribeModes(); err != nil {
+		t.Fatalf("unset: %v", err)
+	}
+
+	for modes, valid := range map[string]bool{
+		"":                      true,
+		"news@lists.test=mark,": true,
+		" news@lists.test=mark , events@lists.test=delete ,": true,
+		"news@lists.test=mark,,events@lists.test=delete":     true,
+		"news@lists.test":        false,
+		"news@lists.test=remove": false,
+	} {
+		t.Setenv("MAILGUN_UNSUBSCRIBE_MODES", modes)
+		if err := CheckUnsubscribeModes(); (err == nil) != valid {
+			t.Errorf("%q: got %v", modes, err)
+		}
+	}
+
+	t.Setenv("MAILGUN_UNSUBSCRIBE_MODES", "news@lists.test=mark,")
+	if mode, err := UnsubscribeModeOf("news@lists.test"); err != nil || mode != UnsubscribeMark {
+		t.Fatalf("mode of news: %s, %v", mode, err)
+	}
+	if mode, err := UnsubscribeModeOf("events@lists.test"); err != nil || mode != UnsubscribeDelete {
+		t.Fatalf("mode of events: %s, %v", mode, err)
+	}
+}
@@ -0,0 +1,212 @@
+package mailgun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"maps"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/mailgun/mailgun-go/v5"
+)
+
+// Attachment is a file sent along with a message. Content is closed after sending.
+type Attachment struct {
+	Filename string
+	Content  io.ReadCloser
+}
+
+// Message is a message sent to all members of a mailing list.
+type Message struct {
+	Subject     string
+	Text        string
+	HTML        string
+	ReplyTo     string
+	Tags        []string
+	Attachments []Attachment
+	// Variables are attached as custom data (v:*) and show up in the Mailgun events.
+	Variables map[string]string
+}
+
+// sentHook is called after every message sent by [SendToList], see [OnSent].
+var sentHook func(ctx context.Context, listAddress string, msg Message, id string)
+
+// OnSent sets a function called after every message successfully sent by [SendToList],
+// e.g. to collect messages for digests. Attachments are already consumed. It must be
+// set before messages are sent; setting it again replaces the previous function.
+func OnSent(fn func(ctx context.Context, listAddress string, msg Message, id string)) {
+	sentHook = fn
+}
+
+// SendToList sends msg to listAddress through Mailgun and returns the message ID.
+// The message carries a List-Unsubscribe header pointing to Mailgun's per recipient unsubscribe link.
+func SendToList(ctx context.Context, listAddress string, msg Message) (string, error) {
+	mg, c, err := client()
+	if err != nil {
+		return "", err
+	}
+
+	if msg.Subject == "" || (msg.Text == "" && msg.HTML == "") {
+		return "", fmt.Errorf("%w: subject and a text or html body are required", common.ErrBadRequest)
+	}
+
+	list, err := List(ctx, listAddress, true)
+	if err != nil {
+		return "", err
+	}
+
+	m := mailgun.NewMessage(sendingDomain(c, list.Address), sender(list), msg.Subject, msg.Text, list.Address)
+	if msg.HTML != "" {
+		m.SetHTML(msg.HTML)
+	}
+	if msg.ReplyTo != "" {
+		if _, err := mail.ParseAddress(msg.ReplyTo); err != nil {
+			return "", fmt.Errorf("%w: invalid reply-to: %w", common.ErrBadRequest, err)
+		}
+		m.SetReplyTo(msg.ReplyTo)
+	}
+	if len(msg.Tags) > 0 {
+		if err := m.AddTag(msg.Tags...); err != nil {
+			return "", fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+		}
+	}
+	for k, v := range msg.Variables {
+		if err := m.AddVariable(k, v); err != nil {
+			return "", err
+		}
+	}
+	// Attributes the Mailgun events of this message to the list, see [DeliveryEvents]
+	if err := m.AddVariable("list", list.Address); err != nil {
+		return "", err
+	}
+	for _, a := range msg.Attachments {
+		m.AddReaderAttachment(a.Filename, a.Content)
+	}
+	m.AddHeader("List-Unsubscribe", "<%mailing_list_unsubscribe_url%>")
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	resp, err := mg.Send(ctx, m)
+	if err != nil {
+		return "", mapError(err)
+	}
+	if sentHook != nil {
+		sentHook(ctx, list.Address, msg, resp.ID)
+	}
+	return resp.ID, nil
+}
+
+// BatchSize is the number of members [SendToMembers] sends one message to.
+const BatchSize = mailgun.MaxNumberOfRecipients
+
+// SendToMembers sends msg individually to members of listAddress, e.g. a digest, and
+// returns the IDs of the batches. Every member gets its name and vars as Mailgun
+// recipient variables, so %recipient.<var>% works as in list messages. Attachments are
+// not supported.
+func SendToMembers(ctx context.Context, listAddress string, msg Message, members []Member) ([]string, error) {
+	mg, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Subject == "" || (msg.Text == "" && msg.HTML == "") {
+		return nil, fmt.Errorf("%w: subject and a text or html body are required", common.ErrBadRequest)
+	}
+
+	list, err := List(ctx, listAddress, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for batch := range slices.Chunk(members, BatchSize) {
+		m := mailgun.NewMessage(sendingDomain(c, list.Address), sender(list), msg.Subject, msg.Text)
+		if msg.HTML != "" {
+			m.SetHTML(msg.HTML)
+		}
+		if msg.ReplyTo != "" {
+			m.SetReplyTo(msg.ReplyTo)
+		}
+		if len(msg.Tags) > 0 {
+			if err := m.AddTag(msg.Tags...); err != nil {
+				return ids, fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+			}
+		}
+		for k, v := range msg.Variables {
+			if err := m.AddVariable(k, v); err != nil {
+				return ids, err
+			}
+		}
+		if err := m.AddVariable("list", list.Address); err != nil {
+			return ids, err
+		}
+		for _, member := range batch {
+			vars := maps.Clone(member.Vars)
+			if vars == nil {
+				vars = map[string]any{}
+			}
+			vars["name"] = member.Name
+			if err := m.AddRecipientAndVariables(member.Address, vars); err != nil {
+				return ids, err
+			}
+		}
+
+		sendCtx, cancel := withTimeout(ctx, c)
+		resp, err := mg.Send(sendCtx, m)
+		cancel()
+		if err != nil {
+			return ids, mapError(err)
+		}
+		ids = append(ids, resp.ID)
+	}
+	return ids, nil
+}
+
+// SendNotification sends a plain text message to a single recipient, e.g. to inform a
+// member about a decision. It is sent from MAILGUN_SENDER or no-reply@<domain>.
+func SendNotification(ctx context.Context, to, subject, text string) (string, error) {
+	mg, c, err := client()
+	if err != nil {
+		return "", err
+	}
+
+	if c.Domain == "" {
+		return "", fmt.Errorf("MAILGUN_DOMAIN is required to send notifications")
+	}
+	from := configReader.Value("MAILGUN_SENDER")
+	if from == "" {
+		from = "no-reply@" + c.Domain
+	}
+	m := mailgun.NewMessage(c.Domain, from, subject, text, to)
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	resp, err := mg.Send(ctx, m)
+	if err != nil {
+		return "", mapError(err)
+	}
+	return resp.ID, nil
+}
+
+// sendingDomain is the configured domain or, as a fallback, the domain of address.
+func sendingDomain(c Config, address string) string {
+	if c.Domain != "" {
+		return c.Domain
+	}
+	_, domain, _ := strings.Cut(address, "@")
+	return domain
+}
+
+// sender is MAILGUN_SENDER if set, otherwise the list itself.
+func sender(list MGMailingList) string {
+	if from := configReader.Value("MAILGUN_SENDER"); from != "" {
+		return from
+	}
+	return (&mail.Address{Name: list.Name, Address: list.Address}).String()
+}
@@ -0,0 +1,78 @@
+package mailgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/scheduler"
+)
+
+// SendJob is the scheduler job type of scheduled list messages.
+const SendJob = "send_message"
+
+// ScheduledMessage is the persisted payload of a [SendJob]. Attachments are stored inline.
+type ScheduledMessage struct {
+	List        string                `json:"list"`
+	Subject     string                `json:"subject"`
+	Text        string                `json:"text,omitempty"`
+	HTML        string                `json:"html,omitempty"`
+	ReplyTo     string                `json:"reply_to,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Attachments []ScheduledAttachment `json:"attachments,omitempty"`
+}
+
+type ScheduledAttachment struct {
+	Filename string `json:"filename"`
+	Content  []byte `json:"content"`
+}
+
+// NewScheduledMessage reads the attachments of msg so that it can be persisted.
+func NewScheduledMessage(listAddress string, msg Message) (ScheduledMessage, error) {
+	scheduled := ScheduledMessage{
+		List:    listAddress,
+		Subject: msg.Subject,
+		Text:    msg.Text,
+		HTML:    msg.HTML,
+		ReplyTo: msg.ReplyTo,
+		Tags:    msg.Tags,
+	}
+	for _, a := range msg.Attachments {
+		content, err := io.ReadAll(a.Content)
+		_ = a.Content.Close()
+		if err != nil {
+			return ScheduledMessage{}, fmt.Errorf("failed to read attachment %s: %w", a.Filename, err)
+		}
+		scheduled.Attachments = append(scheduled.Attachments, ScheduledAttachment{Filename: a.Filename, Content: content})
+	}
+	return scheduled, nil
+}
+
+// RunSendJob is the scheduler handler of [SendJob]. The idempotency key is attached as
+// message variable so that duplicate deliveries can be told apart in the Mailgun events.
+func RunSendJob(ctx context.Context, job scheduler.Job) error {
+	var scheduled ScheduledMessage
+	if err := json.Unmarshal(job.Payload, &scheduled); err != nil {
+		return fmt.Errorf("%w: invalid payload: %w", scheduler.ErrPermanent, err)
+	}
+	msg := Message{
+		Subject:   scheduled.Subject,
+		Text:      scheduled.Text,
+		HTML:      scheduled.HTML,
+		ReplyTo:   scheduled.ReplyTo,
+		Tags:      scheduled.Tags,
+		Variables: map[string]string{"idempotency_key": job.IdempotencyKey},
+	}
+	for _, a := range scheduled.Attachments {
+		msg.Attachments = append(msg.Attachments, Attachment{Filename: a.Filename, Content: io.NopCloser(bytes.NewReader(a.Content))})
+	}
+	_, err := SendToList(ctx, scheduled.List, msg)
+	// Retrying does not help if the list is gone or the message is invalid
+	if errors.Is(err, common.ErrNotFound) || errors.Is(err, common.ErrBadRequest) {
+		return fmt.Errorf("%w: %w", scheduler.ErrPermanent, err)
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package mailgun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5"
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+// SuppressionType is one of Mailgun's suppression lists. Mailgun does not deliver to
+// addresses on these lists, even if they are subscribed members of a mailing list.
+type SuppressionType string
+
+const (
+	Bounces      SuppressionType = "bounces"
+	Complaints   SuppressionType = "complaints"
+	Unsubscribes SuppressionType = "unsubscribes"
+)
+
+// SuppressionTypes are all suppression lists.
+var SuppressionTypes = []SuppressionType{Bounces, Complaints, Unsubscribes}
+
+// Suppression is an entry of a suppression list.
+type Suppression struct {
+	Type    SuppressionType `json:"type" example:"bounces"`
+	Address string          `json:"address" example:"jane@example.com"`
+	// Code and Error are the SMTP response of a bounce.
+	Code  string `json:"code,omitempty" example:"550"`
+	Error string `json:"error,omitempty" example:"No such mailbox"`
+	// Tags of an unsubscribe; "*" means all messages.
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ParseSuppressionType validates t.
+func ParseSuppressionType(t string) (SuppressionType, error) {
+	if !slices.Contains(SuppressionTypes, SuppressionType(t)) {
+		return "", fmt.Errorf("%w: unknown suppression type %q, expected bounces, complaints or unsubscribes", common.ErrBadRequest, t)
+	}
+	return SuppressionType(t), nil
+}
+
+// Suppressions returns the entries of the suppression list t of MAILGUN_DOMAIN whose
+// address contains query (case insensitive). An empty query returns all entries.
+func Suppressions(ctx context.Context, t SuppressionType, query string) ([]Suppression, error) {
+	mg, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+	if c.Domain == "" {
+		return nil, fmt.Errorf("MAILGUN_DOMAIN is required to manage suppressions")
+	}
+
+	var all []Suppression
+	opts := &mailgun.ListOptions{Limit: 1000}
+	switch t {
+	case Bounces:
+		all, err = collect(ctx, c, mg.ListBounces(c.Domain, opts), bounceSuppression)
+	case Complaints:
+		all, err = collect(ctx, c, mg.ListComplaints(c.Domain, opts), complaintSuppression)
+	case Unsubscribes:
+		all, err = collect(ctx, c, mg.ListUnsubscribes(c.Domain, opts), unsubscribeSuppression)
+	default:
+		return nil, fmt.Errorf("%w: unknown suppression type %q", common.ErrBadRequest, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", t, mapError(err))
+	}
+
+	query = strings.ToLower(query)
+	return slices.DeleteFunc(all, func(s Suppression) bool {
+		return !strings.Contains(strings.ToLower(s.Address), query)
+	}), nil
+}
+
+// Suppressed returns the suppression entries of address for the domain listAddress is
+// sent from. An address that is on no suppression list returns an empty slice.
+func Suppressed(ctx context.Context, listAddress, address string) ([]Suppression, error) {
+	_, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+	return suppressedAt(ctx, sendingDomain(c, listAddress), address)
+}
+
+// SuppressedAddress returns the suppression entries of address for MAILGUN_DOMAIN.
+func SuppressedAddress(ctx context.Context, address string) ([]Suppression, error) {
+	_, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+	if c.Domain == "" {
+		return nil, fmt.Errorf("MAILGUN_DOMAIN is required to manage suppressions")
+	}
+	return suppressedAt(ctx, c.Domain, address)
+}
+
+func suppressedAt(ctx context.Context, domain, address string) ([]Suppression, error) {
+	mg, c, err := client()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	result := []Suppression{}
+	for _, t := range SuppressionTypes {
+		var s Suppression
+		switch t {
+		case Bounces:
+			var b mtypes.Bounce
+			b, err = mg.GetBounce(ctx, domain, address)
+			s = bounceSuppression(b)
+		case Complaints:
+			var cp mtypes.Complaint
+			cp, err = mg.GetComplaint(ctx, domain, address)
+			s = complaintSuppression(cp)
+		case Unsubscribes:
+			var u mtypes.Unsubscribe
+			u, err = mg.GetUnsubscribe(ctx, domain, address)
+			s = unsubscribeSuppression(u)
+		}
+		if err = mapError(err); errors.Is(err, common.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", t, err)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// RemoveSuppression removes address from the suppression list t of MAILGUN_DOMAIN so
+// that Mailgun delivers to it again.
+func RemoveSuppression(ctx context.Context, t SuppressionType, address string) error {
+	mg, c, err := client()
+	if err != nil {
+		return err
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("MAILGUN_DOMAIN is required to manage suppressions")
+	}
+
+	ctx, cancel := withTimeout(ctx, c)
+	defer cancel()
+
+	switch t {
+	case Bounces:
+		err = mg.DeleteBounce(ctx, c.Domain, address)
+	case Complaints:
+		err = mg.DeleteComplaint(ctx, c.Domain, address)
+	case Unsubscribes:
+		err = mg.DeleteUnsubscribe(ctx, c.Domain, address)
+	default:
+		return fmt.Errorf("%w: unknown suppression type %q", common.ErrBadRequest, t)
+	}
+	return mapError(err)
+}
+
+// iterator is implemented by the paging iterators of the Mailgun client.
+type iterator[T any] interface {
+	Next(ctx context.Context, items *[]T) bool
+	Err() error
+}
+
+// collect reads all pages of it and converts the items with convert.
+func collect[T any](ctx context.Context, c Config, it iterator[T], convert func(T) Suppression) ([]Suppression, error) {
+	var result []Suppression
+	var page []T
+	for {
+		pageCtx, cancel := withTimeout(ctx, c)
+		more := it.Next(pageCtx, &page)
+		cancel()
+		if !more {
+			break
+		}
+		for _, item := range page {
+			result = append(result, convert(item))
+		}
+	}
+	return result, it.Err()
+}
+
+func bounceSuppression(b mtypes.Bounce) Suppression {
+	return Suppression{Type: Bounces, Address: b.Address, Code: b.Code, Error: b.Error, CreatedAt: time.Time(b.CreatedAt)}
+}
+
+func complaintSuppression(c mtypes.Complaint) Suppression {
+	return Suppression{Type: Complaints, Address: c.Address, CreatedAt: time.Time(c.CreatedAt)}
+}
+
+func unsubscribeSuppression(u mtypes.Unsubscribe) Suppression {
+	return Suppression{Type: Unsubscribes, Address: u.Address, Tags: u.Tags, CreatedAt: time.Time(u.CreatedAt)}
+}
@@ -0,0 +1,862 @@
+// Package mailgunmock implements the subset of the Mailgun HTTP API used by this service
+// (mailing lists, members, bulk members, events, messages and suppressions) with in-memory state.
+// It supports fault injection to exercise retries and timeouts.
+package mailgunmock
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+// Message is a message accepted by the messages endpoint.
+type Message struct {
+	ID          string
+	Domain      string
+	From        string
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string
+	Tags        []string
+	Variables   map[string]string
+	Attachments []string
+	// Form holds all submitted form values, including options (o:*) and recipient variables.
+	Form url.Values
+}
+
+// Fault describes an injected failure. Requests matching Method and Path (prefix) are
+// delayed by Latency and, if Status is set, answered with Status instead of being handled.
+type Fault struct {
+	Method  string
+	Path    string
+	Latency time.Duration
+	Status  int
+	// Times limits the number of affected requests; 0 means unlimited.
+	Times int
+	// After lets that many matching requests pass before the fault applies.
+	After int
+}
+
+type suppression struct {
+	address string
+	item    any
+}
+
+type mailingList struct {
+	list    mtypes.MailingList
+	members []mtypes.Member
+}
+
+// Server is an in-memory Mailgun API.
+type Server struct {
+	srv    *httptest.Server
+	apiKey string
+
+	mu       sync.Mutex
+	lists    []*mailingList
+	events   []map[string]any
+	messages []Message
+	// suppressions are the bounces, complaints and unsubscribes, keyed by type
+	suppressions map[string][]suppression
+	faults       []*Fault
+	requests     int
+}
+
+// Start starts a mock server which accepts any API key. Close it when done.
+func Start() *Server {
+	return StartWithKey("")
+}
+
+// StartWithKey starts a mock server which requires apiKey for basic auth.
+func StartWithKey(apiKey string) *Server {
+	s := &Server{apiKey: apiKey, suppressions: map[string][]suppression{}}
+	s.srv = httptest.NewServer(s.handler())
+	return s
+}
+
+// URL is the API base to configure the Mailgun client with.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddList creates a mailing list with the given members.
+func (s *Server) AddList(list mtypes.MailingList, members ...mtypes.Member) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if list.CreatedAt == (mtypes.RFC2822Time{}) {
+		list.CreatedAt = mtypes.RFC2822Time(time.Now().UTC())
+	}
+	ml := &mailingList{list: list}
+	for _, m := range members {
+		if m.Subscribed == nil {
+			m.Subscribed = ptr(true)
+		}
+		ml.members = append(ml.members, m)
+	}
+	s.lists = append(s.lists, ml)
+}
+
+// Members returns the members of a list, or nil if the list does not exist.
+func (s *Server) Members(listAddress string) []mtypes.Member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ml := s.findList(listAddress)
+	if ml == nil {
+		return nil
+	}
+	return slices.Clone(ml.members)
+}
+
+// Member returns a single member of a list.
+func (s *Server) Member(listAddress, memberAddress string) (mtypes.Member, bool) {
+	for _, m := range s.Members(listAddress) {
+		if strings.EqualFold(m.Address, memberAddress) {
+			return m, true
+		}
+	}
+	return mtypes.Member{}, false
+}
+
+// Messages returns all messages accepted so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.messages)
+}
+
+// AddEvent appends a raw event as returned by the events API, e.g.
+// {"event": "delivered", "recipient": "a@example.com", "timestamp": 1700000000.0}.
+// Missing id and timestamp fields are filled in.
+func (s *Server) AddEvent(event map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addEvent(event)
+}
+
+// AddBounce adds an address to the bounce suppression list.
+func (s *Server) AddBounce(b mtypes.Bounce) {
+	s.addSuppression("bounces", b.Address, b.CreatedAt, func(t mtypes.RFC2822Time) any { b.CreatedAt = t; return b })
+}
+
+// AddComplaint adds an address to the complaint suppression list.
+func (s *Server) AddComplaint(c mtypes.Complaint) {
+	s.addSuppression("complaints", c.Address, c.CreatedAt, func(t mtypes.RFC2822Time) any { c.CreatedAt = t; return c })
+}
+
+// AddUnsubscribe adds an address to the unsubscribe suppression list.
+func (s *Server) AddUnsubscribe(u mtypes.Unsubscribe) {
+	if u.Tags == nil {
+		u.Tags = []string{"*"}
+	}
+	s.addSuppression("unsubscribes", u.Address, u.CreatedAt, func(t mtypes.RFC2822Time) any { u.CreatedAt = t; return u })
+}
+
+// Suppressed reports whether address is on the suppression list of kind
+// ("bounces", "complaints" or "unsubscribes").
+func (s *Server) Suppressed(kind, address string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.findSuppression(kind, address) >= 0
+}
+
+func (s *Server) addSuppression(kind, address string, createdAt mtypes.RFC2822Time, withTime func(mtypes.RFC2822Time) any) {
+	if createdAt == (mtypes.RFC2822Time{}) {
+		createdAt = mtypes.RFC2822Time(time.Now().UTC())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := suppression{address: address, item: withTime(createdAt)}
+	if i := s.findSuppression(kind, address); i >= 0 {
+		s.suppressions[kind][i] = entry
+		return
+	}
+	s.suppressions[kind] = append(s.suppressions[kind], entry)
+}
+
+// Inject registers a fault for subsequent requests.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the number of requests received, including failed ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v3/lists/pages", s.listLists)
+	mux.HandleFunc("POST /v3/lists", s.createList)
+	mux.HandleFunc("GET /v3/lists/{list}", s.getList)
+	mux.HandleFunc("PUT /v3/lists/{list}", s.updateList)
+	mux.HandleFunc("DELETE /v3/lists/{list}", s.deleteList)
+	mux.HandleFunc("GET /v3/lists/{list}/members/pages", s.listMembers)
+	mux.HandleFunc("POST /v3/lists/{list}/members", s.createMember)
+	mux.HandleFunc("POST /v3/lists/{list}/members.json", s.createMembers)
+	mux.HandleFunc("GET /v3/lists/{list}/members/{member}", s.getMember)
+	mux.HandleFunc("PUT /v3/lists/{list}/members/{member}", s.updateMember)
+	mux.HandleFunc("DELETE /v3/lists/{list}/members/{member}", s.deleteMember)
+	// Domain scoped endpoints would overlap with the list patterns above, so they are dispatched by hand
+	mux.HandleFunc("/v3/", s.domainEndpoints)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.apiKey != "" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "api" || pass != s.apiKey {
+				writeJSON(w, http.StatusUnauthorized, message("Forbidden"))
+				return
+			}
+		}
+		if status := s.applyFaults(r); status != 0 {
+			writeJSON(w, status, message(http.StatusText(status)))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// applyFaults sleeps for the latency of matching faults and returns the status of the
+// first matching failing fault, or 0.
+func (s *Server) applyFaults(r *http.Request) int {
+	s.mu.Lock()
+	s.requests++
+	var latency time.Duration
+	status := 0
+	for _, f := range s.faults {
+		if f.Times < 0 || (f.Method != "" && f.Method != r.Method) || !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+		if f.After > 0 {
+			f.After--
+			continue
+		}
+		latency += f.Latency
+		if status == 0 {
+			status = f.Status
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				f.Times = -1
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+		}
+	}
+	return status
+}
+
+func (s *Server) domainEndpoints(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v3/"), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		writeJSON(w, http.StatusNotFound, message("not found"))
+		return
+	}
+	domain, resource := parts[0], parts[1]
+	isSuppression := resource == "bounces" || resource == "complaints" || resource == "unsubscribes"
+	switch {
+	case len(parts) == 2 && resource == "events" && r.Method == http.MethodGet:
+		s.listEvents(w, r)
+	case len(parts) == 2 && resource == "messages" && r.Method == http.MethodPost:
+		s.sendMessage(w, r, domain)
+	case len(parts) == 2 && isSuppression && r.Method == http.MethodGet:
+		s.listSuppressions(w, r, resource)
+	case len(parts) == 3 && isSuppression && r.Method == http.MethodGet:
+		s.getSuppression(w, resource, parts[2])
+	case len(parts) == 3 && isSuppression && r.Method == http.MethodDelete:
+		s.deleteSuppression(w, resource, parts[2])
+	default:
+		writeJSON(w, http.StatusNotFound, message("not found"))
+	}
+}
+
+func (s *Server) listLists(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	var items []mtypes.MailingList
+	for _, ml := range s.lists {
+		list := ml.list
+		list.MembersCount = len(ml.members)
+		keys = append(keys, list.Address)
+		items = append(items, list)
+	}
+	start, end := page(r, keys)
+	items = items[start:end]
+
+	resp := mtypes.ListMailingListsResponse{Items: items}
+	if len(items) > 0 {
+		resp.Paging = paging(r, items[len(items)-1].Address)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) createList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := r.FormValue("address")
+	if address == "" {
+		writeJSON(w, http.StatusBadRequest, message("address is required"))
+		return
+	}
+	if s.findList(address) != nil {
+		writeJSON(w, http.StatusBadRequest, message("Duplicate object"))
+		return
+	}
+	list := mtypes.MailingList{
+		Address:         address,
+		Name:            r.FormValue("name"),
+		Description:     r.FormValue("description"),
+		AccessLevel:     mtypes.AccessLevel(r.FormValue("access_level")),
+		ReplyPreference: mtypes.ReplyPreference(r.FormValue("reply_preference")),
+		CreatedAt:       mtypes.RFC2822Time(time.Now().UTC()),
+	}
+	s.lists = append(s.lists, &mailingList{list: list})
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list has been created", "list": list})
+}
+
+func (s *Server) getList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	list := ml.list
+	list.MembersCount = len(ml.members)
+	writeJSON(w, http.StatusOK, mtypes.GetMailingListResponse{MailingList: list})
+}
+
+func (s *Server) updateList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	if v := r.FormValue("address"); v != "" {
+		ml.list.Address = v
+	}
+	if v := r.FormValue("name"); v != "" {
+		ml.list.Name = v
+	}
+	if v := r.FormValue("description"); v != "" {
+		ml.list.Description = v
+	}
+	if v := r.FormValue("access_level"); v != "" {
+		ml.list.AccessLevel = mtypes.AccessLevel(v)
+	}
+	if v := r.FormValue("reply_preference"); v != "" {
+		ml.list.ReplyPreference = mtypes.ReplyPreference(v)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list has been updated", "list": ml.list})
+}
+
+func (s *Server) deleteList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := r.PathValue("list")
+	i := slices.IndexFunc(s.lists, func(ml *mailingList) bool { return strings.EqualFold(ml.list.Address, address) })
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	s.lists = slices.Delete(s.lists, i, i+1)
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list has been removed", "address": address})
+}
+
+func (s *Server) listMembers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	var keys []string
+	var items []mtypes.Member
+	for _, m := range ml.members {
+		if v := r.FormValue("subscribed"); v != "" && parseBool(v) != *m.Subscribed {
+			continue
+		}
+		keys = append(keys, m.Address)
+		items = append(items, m)
+	}
+	start, end := page(r, keys)
+	items = items[start:end]
+
+	resp := mtypes.MemberListResponse{Lists: items}
+	if len(items) > 0 {
+		resp.Paging = paging(r, items[len(items)-1].Address)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) getMember(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	i := ml.findMember(r.PathValue("member"))
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Member "+r.PathValue("member")+" not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, mtypes.MemberResponse{Member: ml.members[i]})
+}
+
+func (s *Server) createMember(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	member, err := memberFromForm(r, mtypes.Member{Subscribed: ptr(true)})
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, message(err.Error()))
+		return
+	}
+	if member.Address == "" {
+		writeJSON(w, http.StatusBadRequest, message("address is required"))
+		return
+	}
+	if i := ml.findMember(member.Address); i >= 0 {
+		if !parseBool(r.FormValue("upsert")) {
+			writeJSON(w, http.StatusBadRequest, message("Address already exists '"+member.Address+"'"))
+			return
+		}
+		ml.members[i] = member
+	} else {
+		ml.members = append(ml.members, member)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list member has been created", "member": member})
+}
+
+func (s *Server) createMembers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(r.FormValue("members")), &raw); err != nil {
+		writeJSON(w, http.StatusBadRequest, message("invalid members: "+err.Error()))
+		return
+	}
+	upsert := parseBool(r.FormValue("upsert"))
+	for _, item := range raw {
+		// Members may be given as plain addresses or as member objects
+		member := mtypes.Member{Subscribed: ptr(true)}
+		var address string
+		if err := json.Unmarshal(item, &address); err == nil {
+			member.Address = address
+		} else if err := json.Unmarshal(item, &member); err != nil {
+			writeJSON(w, http.StatusBadRequest, message("invalid member: "+err.Error()))
+			return
+		}
+		if member.Subscribed == nil {
+			member.Subscribed = ptr(true)
+		}
+		if i := ml.findMember(member.Address); i >= 0 {
+			if upsert {
+				ml.members[i] = member
+			}
+			continue
+		}
+		ml.members = append(ml.members, member)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list has been updated", "list": ml.list})
+}
+
+func (s *Server) updateMember(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	i := ml.findMember(r.PathValue("member"))
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Member "+r.PathValue("member")+" not found"))
+		return
+	}
+	member, err := memberFromForm(r, ml.members[i])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, message(err.Error()))
+		return
+	}
+	ml.members[i] = member
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list member has been updated", "member": member})
+}
+
+func (s *Server) deleteMember(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ml := s.findList(r.PathValue("list"))
+	if ml == nil {
+		writeJSON(w, http.StatusNotFound, message("Mailing list not found"))
+		return
+	}
+	i := ml.findMember(r.PathValue("member"))
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Member "+r.PathValue("member")+" not found"))
+		return
+	}
+	ml.members = slices.Delete(ml.members, i, i+1)
+	writeJSON(w, http.StatusOK, map[string]any{"message": "Mailing list member has been deleted"})
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request, domain string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeJSON(w, http.StatusBadRequest, message(err.Error()))
+		return
+	}
+	if r.FormValue("from") == "" || len(r.Form["to"]) == 0 {
+		writeJSON(w, http.StatusBadRequest, message("from and to are required"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := Message{
+		ID:        fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), len(s.messages)+1, domain),
+		Domain:    domain,
+		From:      r.FormValue("from"),
+		Subject:   r.FormValue("subject"),
+		Text:      r.FormValue("text"),
+		HTML:      r.FormValue("html"),
+		Headers:   map[string]string{},
+		Variables: map[string]string{},
+		Tags:      r.Form["o:tag"],
+		Form:      r.Form,
+	}
+	for _, to := range r.Form["to"] {
+		for _, addr := range strings.Split(to, ",") {
+			msg.To = append(msg.To, strings.TrimSpace(addr))
+		}
+	}
+	for key, values := range r.Form {
+		switch {
+		case strings.HasPrefix(key, "h:"):
+			msg.Headers[strings.TrimPrefix(key, "h:")] = values[0]
+		case strings.HasPrefix(key, "v:"):
+			msg.Variables[strings.TrimPrefix(key, "v:")] = values[0]
+		}
+	}
+	if r.MultipartForm != nil {
+		for _, files := range r.MultipartForm.File {
+			for _, f := range files {
+				msg.Attachments = append(msg.Attachments, f.Filename)
+			}
+		}
+	}
+	s.messages = append(s.messages, msg)
+
+	for _, to := range msg.To {
+		s.addEvent(map[string]any{
+			"event":          "accepted",
+			"recipient":      to,
+			"tags":           msg.Tags,
+			"user-variables": msg.Variables,
+			"message": map[string]any{
+				"headers": map[string]any{"message-id": strings.Trim(msg.ID, "<>"), "from": msg.From, "to": to, "subject": msg.Subject},
+			},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": msg.ID, "message": "Queued. Thank you."})
+}
+
+func (s *Server) listEvents(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []map[string]any
+	for _, e := range s.events {
+		if matchesEvent(r, e) {
+			items = append(items, e)
+		}
+	}
+	// Events are returned in time order, not in the order they were added
+	slices.SortStableFunc(items, func(a, b map[string]any) int {
+		ta, _ := a["timestamp"].(float64)
+		tb, _ := b["timestamp"].(float64)
+		return cmp.Compare(ta, tb)
+	})
+	if r.FormValue("ascending") == "no" {
+		slices.Reverse(items)
+	}
+	var keys []string
+	for _, e := range items {
+		keys = append(keys, e["id"].(string))
+	}
+	start, end := page(r, keys)
+	items = items[start:end]
+
+	next := r.FormValue("address")
+	if len(items) > 0 {
+		next = keys[end-1]
+	}
+	if items == nil {
+		items = []map[string]any{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": items, "paging": paging(r, next)})
+}
+
+// matchesEvent applies the simple (non expression) filters of the events API.
+func matchesEvent(r *http.Request, e map[string]any) bool {
+	if v := r.FormValue("event"); v != "" && !slices.Contains(strings.Fields(strings.ReplaceAll(v, " OR ", " ")), fmt.Sprint(e["event"])) {
+		return false
+	}
+	if v := r.FormValue("recipient"); v != "" && !strings.EqualFold(v, fmt.Sprint(e["recipient"])) {
+		return false
+	}
+	if v := r.FormValue("tags"); v != "" {
+		if !slices.Contains(eventTags(e), v) {
+			return false
+		}
+	}
+	ts, _ := e["timestamp"].(float64)
+	if v, ok := eventTime(r.FormValue("begin")); ok && ts < v {
+		return false
+	}
+	if v, ok := eventTime(r.FormValue("end")); ok && ts > v {
+		return false
+	}
+	return true
+}
+
+// eventTime parses a begin/end parameter, given as unix timestamp or RFC 2822 date.
+func eventTime(v string) (float64, bool) {
+	if ts, err := strconv.ParseFloat(v, 64); err == nil {
+		return ts, true
+	}
+	if t, err := time.Parse("Mon, 2 Jan 2006 15:04:05 -0700", v); err == nil {
+		return float64(t.UnixMicro()) / 1e6, true
+	}
+	return 0, false
+}
+
+func eventTags(e map[string]any) []string {
+	switch tags := e["tags"].(type) {
+	case []string:
+		return tags
+	case []any:
+		var result []string
+		for _, t := range tags {
+			result = append(result, fmt.Sprint(t))
+		}
+		return result
+	}
+	return nil
+}
+
+// addEvent stores event. s.mu must be held.
+func (s *Server) addEvent(event map[string]any) {
+	if _, ok := event["id"]; !ok {
+		event["id"] = fmt.Sprintf("event-%d", len(s.events)+1)
+	}
+	if _, ok := event["timestamp"]; !ok {
+		event["timestamp"] = float64(time.Now().UnixMicro()) / 1e6
+	}
+	if tags, ok := event["tags"].([]string); ok && tags == nil {
+		event["tags"] = []string{}
+	}
+	s.events = append(s.events, event)
+}
+
+func (s *Server) listSuppressions(w http.ResponseWriter, r *http.Request, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	items := []any{}
+	for _, e := range s.suppressions[kind] {
+		keys = append(keys, e.address)
+		items = append(items, e.item)
+	}
+	start, end := page(r, keys)
+	items = items[start:end]
+
+	next := r.FormValue("address")
+	if len(items) > 0 {
+		next = keys[end-1]
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"items": items, "paging": paging(r, next)})
+}
+
+func (s *Server) getSuppression(w http.ResponseWriter, kind, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findSuppression(kind, address)
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Address not found in "+kind+" table"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.suppressions[kind][i].item)
+}
+
+func (s *Server) deleteSuppression(w http.ResponseWriter, kind, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.findSuppression(kind, address)
+	if i < 0 {
+		writeJSON(w, http.StatusNotFound, message("Address not found in "+kind+" table"))
+		return
+	}
+	s.suppressions[kind] = slices.Delete(s.suppressions[kind], i, i+1)
+	writeJSON(w, http.StatusOK, map[string]any{"address": address, "message": "Suppression has been removed"})
+}
+
+// findSuppression returns the index of address in the suppression list kind. s.mu must be held.
+func (s *Server) findSuppression(kind, address string) int {
+	return slices.IndexFunc(s.suppressions[kind], func(e suppression) bool { return strings.EqualFold(e.address, address) })
+}
+
+// findList returns the list with address. s.mu must be held.
+func (s *Server) findList(address string) *mailingList {
+	for _, ml := range s.lists {
+		if strings.EqualFold(ml.list.Address, address) {
+			return ml
+		}
+	}
+	return nil
+}
+
+func (ml *mailingList) findMember(address string) int {
+	return slices.IndexFunc(ml.members, func(m mtypes.Member) bool { return strings.EqualFold(m.Address, address) })
+}
+
+// memberFromForm applies the member form fields of create/update requests to member.
+func memberFromForm(r *http.Request, member mtypes.Member) (mtypes.Member, error) {
+	if v := r.FormValue("address"); v != "" {
+		member.Address = v
+	}
+	if v := r.FormValue("name"); v != "" {
+		member.Name = v
+	}
+	if v := r.FormValue("vars"); v != "" && v != "null" {
+		vars := map[string]any{}
+		if err := json.Unmarshal([]byte(v), &vars); err != nil {
+			return member, fmt.Errorf("invalid vars: %w", err)
+		}
+		member.Vars = vars
+	}
+	if v := r.FormValue("subscribed"); v != "" {
+		member.Subscribed = ptr(parseBool(v))
+	}
+	return member, nil
+}
+
+// page returns the slice bounds for the page requested with the page/address pivot
+// parameters Mailgun uses in its paging URLs.
+func page(r *http.Request, keys []string) (int, int) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	start := 0
+	if r.FormValue("page") == "next" {
+		start = len(keys)
+		if i := slices.Index(keys, r.FormValue("address")); i >= 0 {
+			start = i + 1
+		}
+	}
+	return start, min(start+limit, len(keys))
+}
+
+func paging(r *http.Request, last string) mtypes.Paging {
+	pageURL := func(params url.Values) string {
+		if v := r.FormValue("limit"); v != "" {
+			params.Set("limit", v)
+		}
+		for _, key := range []string{"event", "recipient", "tags", "begin", "end", "ascending", "subscribed"} {
+			if v := r.FormValue(key); v != "" {
+				params.Set(key, v)
+			}
+		}
+		return "http://" + r.Host + r.URL.EscapedPath() + "?" + params.Encode()
+	}
+	return mtypes.Paging{
+		First: pageURL(url.Values{"page": {"first"}}),
+		Next:  pageURL(url.Values{"page": {"next"}, "address": {last}}),
+	}
+}
+
+func parseBool(v string) bool {
+	switch strings.ToLower(v) {
+	case "yes", "true", "1":
+		return true
+	}
+	return false
+}
+
+func message(msg string) map[string]string {
+	return map[string]string{"message": msg}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
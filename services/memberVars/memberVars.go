@@ -0,0 +1,178 @@
+// Package memberVars defines the custom member variables of a list (e.g. department,
+// language) and validates member vars against them.
+//
+// Mailgun stores arbitrary JSON vars per member and exposes them to messages as
+// %recipient.<name>%. The schema of a list limits which vars members may set and
+// which values they may take. Lists without a schema have no custom vars. Vars managed
+// by the service itself, like the digest delivery, are kept as they are.
+package memberVars
+
+import (
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/store"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const bucket = "member_schemas"
+
+type FieldType string
+
+const (
+	TypeString  FieldType = "string"
+	TypeNumber  FieldType = "number"
+	TypeBoolean FieldType = "boolean"
+)
+
+// Field is a custom member variable.
+type Field struct {
+	Name        string    `json:"name" example:"department"`
+	Description string    `json:"description,omitempty" example:"Department of the member"`
+	Type        FieldType `json:"type" example:"string"`
+	Required    bool      `json:"required"`
+	// Enum restricts string fields to the given values.
+	Enum []string `json:"enum,omitempty" example:"IT,Sales"`
+	// MaxLength limits the length of string fields; 0 means unlimited.
+	MaxLength int `json:"max_length,omitempty"`
+	// Default is set on members created by a subscription.
+	Default any `json:"default,omitempty" swaggertype:"string" example:"IT"`
+}
+
+// Schema are the custom member variables of a list.
+type Schema struct {
+	List   string  `json:"list" example:"news@example.com"`
+	Fields []Field `json:"fields"`
+}
+
+var fieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reserved are the member vars managed by the service. They cannot be schema fields.
+var reserved = []string{mailgun.DeliveryVar}
+
+// Get returns the schema of list. A list without a stored schema has no fields.
+func Get(list string) (Schema, error) {
+	var s Schema
+	err := store.Get(bucket, strings.ToLower(list), &s)
+	if errors.Is(err, common.ErrNotFound) {
+		return Schema{List: list, Fields: []Field{}}, nil
+	}
+	return s, err
+}
+
+// Put validates and stores the schema of list. Existing member vars are not migrated;
+// they are validated against the new schema on their next change.
+func Put(list string, s Schema) (Schema, error) {
+	s.List = list
+	if s.Fields == nil {
+		s.Fields = []Field{}
+	}
+	seen := map[string]bool{}
+	for _, f := range s.Fields {
+		if !fieldName.MatchString(f.Name) {
+			return Schema{}, fmt.Errorf("%w: invalid field name %q", common.ErrBadRequest, f.Name)
+		}
+		if slices.Contains(reserved, f.Name) {
+			return Schema{}, fmt.Errorf("%w: field name %q is reserved", common.ErrBadRequest, f.Name)
+		}
+		if seen[f.Name] {
+			return Schema{}, fmt.Errorf("%w: duplicate field %q", common.ErrBadRequest, f.Name)
+		}
+		seen[f.Name] = true
+		if !slices.Contains([]FieldType{TypeString, TypeNumber, TypeBoolean}, f.Type) {
+			return Schema{}, fmt.Errorf("%w: field %s: type must be string, number or boolean", common.ErrBadRequest, f.Name)
+		}
+		if len(f.Enum) > 0 && f.Type != TypeString {
+			return Schema{}, fmt.Errorf("%w: field %s: enum is only supported for strings", common.ErrBadRequest, f.Name)
+		}
+		if f.Default != nil {
+			if err := f.check(f.Default); err != nil {
+				return Schema{}, fmt.Errorf("%w: default: %w", common.ErrBadRequest, err)
+			}
+		}
+	}
+	return s, store.Put(bucket, strings.ToLower(list), s)
+}
+
+// Defaults returns the default values of the fields that have one.
+func (s Schema) Defaults() map[string]any {
+	defaults := map[string]any{}
+	for _, f := range s.Fields {
+		if f.Default != nil {
+			defaults[f.Name] = f.Default
+		}
+	}
+	return defaults
+}
+
+// Apply merges patch into vars and validates the result. A null value in patch removes
+// the var. Vars that are not part of the schema are rejected if they are set by patch
+// and dropped otherwise, e.g. after a field was removed from the schema. Reserved vars
+// are kept.
+func (s Schema) Apply(vars, patch map[string]any) (map[string]any, error) {
+	result := map[string]any{}
+	for name, v := range vars {
+		if s.field(name) != nil || slices.Contains(reserved, name) {
+			result[name] = v
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(patch)) {
+		f := s.field(name)
+		if f == nil {
+			return nil, fmt.Errorf("%w: unknown member var %q", common.ErrBadRequest, name)
+		}
+		v := patch[name]
+		if v == nil {
+			delete(result, name)
+			continue
+		}
+		if err := f.check(v); err != nil {
+			return nil, fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+		}
+		result[name] = v
+	}
+	for _, f := range s.Fields {
+		if _, ok := result[f.Name]; f.Required && !ok {
+			return nil, fmt.Errorf("%w: member var %s is required", common.ErrBadRequest, f.Name)
+		}
+	}
+	return result, nil
+}
+
+func (s Schema) field(name string) *Field {
+	i := slices.IndexFunc(s.Fields, func(f Field) bool { return f.Name == name })
+	if i < 0 {
+		return nil
+	}
+	return &s.Fields[i]
+}
+
+// check validates a single value. Numbers are float64 as decoded from JSON.
+func (f Field) check(v any) error {
+	switch f.Type {
+	case TypeString:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", f.Name)
+		}
+		if len(f.Enum) > 0 && !slices.Contains(f.Enum, s) {
+			return fmt.Errorf("%s must be one of %s", f.Name, strings.Join(f.Enum, ", "))
+		}
+		if f.MaxLength > 0 && len([]rune(s)) > f.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", f.Name, f.MaxLength)
+		}
+	case TypeNumber:
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s must be a number", f.Name)
+		}
+	case TypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", f.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// Package moderation implements the submission workflow of moderated lists: members
+// submit drafts, moderators approve (which sends the message to the list) or reject them.
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/store"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	bucket = "submissions"
+
+	// approvalTimeout is the time after which an approving submission counts as pending
+	// again: the process stopped while sending it or failed to store the decision.
+	approvalTimeout = 15 * time.Minute
+)
+
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	// StatusApproving is an approved submission that is being sent to its list.
+	StatusApproving Status = "approving"
+	StatusApproved  Status = "approved"
+	StatusRejected  Status = "rejected"
+)
+
+// Submission is a draft message submitted to a moderated list.
+type Submission struct {
+	ID             string     `json:"id"`
+	List           string     `json:"list" example:"news@example.com"`
+	SubmitterEmail string     `json:"submitter_email" example:"jane@example.com"`
+	SubmitterName  string     `json:"submitter_name,omitempty" example:"Jane Doe"`
+	Subject        string     `json:"subject"`
+	Text           string     `json:"text,omitempty"`
+	HTML           string     `json:"html,omitempty"`
+	Status         Status     `json:"status" example:"pending"`
+	Reason         string     `json:"reason,omitempty"`
+	DecidedBy      string     `json:"decided_by,omitempty"`
+	DecidedAt      *time.Time `json:"decided_at,omitempty"`
+	// ApprovalStartedAt is the time the submission became approving.
+	ApprovalStartedAt *time.Time `json:"approval_started_at,omitempty"`
+	MessageID         string     `json:"message_id,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// mu serializes changes of submissions. Approving submissions are not sent twice.
+var mu sync.Mutex
+
+// IsModerated reports whether list accepts submissions (MAILGUN_MODERATED_MAILING_LISTS).
+func IsModerated(list string) bool {
+	return slices.Contains(configReader.Values("MAILGUN_MODERATED_MAILING_LISTS"), list)
+}
+
+// Submit stores a new pending submission. Only subscribed members of moderated lists may submit.
+func Submit(ctx context.Context, s Submission) (Submission, error) {
+	if !IsModerated(s.List) {
+		return Submission{}, fmt.Errorf("%w: list does not accept submissions", common.ErrForbidden)
+	}
+	if strings.TrimSpace(s.SubmitterEmail) == "" {
+		return Submission{}, fmt.Errorf("%w: submissions need a submitter address", common.ErrForbidden)
+	}
+	if strings.TrimSpace(s.Subject) == "" || (s.Text == "" && s.HTML == "") {
+		return Submission{}, fmt.Errorf("%w: subject and a text or html body are required", common.ErrBadRequest)
+	}
+	member, err := mailgun.IsMember(ctx, s.List, s.SubmitterEmail)
+	if err != nil {
+		return Submission{}, err
+	}
+	if !member {
+		return Submission{}, fmt.Errorf("%w: only members can submit to this list", common.ErrForbidden)
+	}
+
+	s.ID = uuid.NewString()
+	s.Status = StatusPending
+	s.Reason, s.DecidedBy, s.DecidedAt, s.ApprovalStartedAt, s.MessageID = "", "", nil, nil, ""
+	s.CreatedAt = time.Now().UTC()
+	return s, store.Put(bucket, s.ID, s)
+}
+
+// List returns submissions ordered by creation time, optionally filtered by list and status.
+func List(list string, status Status) ([]Submission, error) {
+	all, err := loadAll()
+	if err != nil {
+		return nil, err
+	}
+	all = slices.DeleteFunc(all, func(s Submission) bool {
+		return (list != "" && s.List != list) || (status != "" && s.Status != status)
+	})
+	slices.SortFunc(all, func(a, b Submission) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return all, nil
+}
+
+func Get(id string) (Submission, error) {
+	var s Submission
+	if err := store.Get(bucket, id, &s); err != nil {
+		return Submission{}, err
+	}
+	return s.resumed(), nil
+}
+
+// loadAll returns all submissions, see [Submission.resumed].
+func loadAll() ([]Submission, error) {
+	all, err := store.All[Submission](bucket)
+	for i := range all {
+		all[i] = all[i].resumed()
+	}
+	return all, err
+}
+
+// resumed returns s pending again if its approval was interrupted, see [approvalTimeout].
+// Moderators decide again; the sent message carries the submission ID as variable
+// submission_id, so that a message sent twice can be found in the Mailgun events.
+func (s Submission) resumed() Submission {
+	if s.Status == StatusApproving && (s.ApprovalStartedAt == nil || time.Since(*s.ApprovalStartedAt) > approvalTimeout) {
+		s.Status, s.ApprovalStartedAt = StatusPending, nil
+	}
+	return s
+}
+
+// Approve sends the pending submission to its list and marks it approved. Replies go to
+// the submitter. The submission is approving while it is sent, so that other decisions
+// on it fail without waiting for Mailgun; if sending fails, it is pending again.
+// If the approval is interrupted, the submission is pending again after approvalTimeout.
+func Approve(ctx context.Context, id, moderator, reason string) (Submission, error) {
+	s, err := startApproval(id)
+	if err != nil {
+		return Submission{}, err
+	}
+	messageID, sendErr := mailgun.SendToList(ctx, s.List, mailgun.Message{
+		Subject:   s.Subject,
+		Text:      s.Text,
+		HTML:      s.HTML,
+		ReplyTo:   s.SubmitterEmail,
+		Tags:      []string{"moderated"},
+		Variables: map[string]string{"submission_id": s.ID},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The submitter may have been erased in the meantime
+	if s, err = Get(id); err != nil {
+		return Submission{}, err
+	}
+	if sendErr != nil {
+		s.Status, s.ApprovalStartedAt = StatusPending, nil
+		if err := store.Put(bucket, s.ID, s); err != nil {
+			return Submission{}, fmt.Errorf("failed to send submission: %w, and to make it pending again: %w", sendErr, err)
+		}
+		return Submission{}, fmt.Errorf("failed to send submission: %w", sendErr)
+	}
+	s.MessageID = messageID
+	return decide(s, StatusApproved, moderator, reason)
+}
+
+// startApproval marks the pending submission id approving.
+func startApproval(id string) (Submission, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, err := pending(id)
+	if err != nil {
+		return Submission{}, err
+	}
+	now := time.Now().UTC()
+	s.Status = StatusApproving
+	s.ApprovalStartedAt = &now
+	return s, store.Put(bucket, s.ID, s)
+}
+
+// Reject marks the pending submission rejected. A reason is required.
+func Reject(id, moderator, reason string) (Submission, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if strings.TrimSpace(reason) == "" {
+		return Submission{}, fmt.Errorf("%w: a reason is required", common.ErrBadRequest)
+	}
+	s, err := pending(id)
+	if err != nil {
+		return Submission{}, err
+	}
+	return decide(s, StatusRejected, moderator, reason)
+}
+
+// Notify informs the submitter about the decision on s.
+func Notify(ctx context.Context, s Submission) error {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Hello %s,\n\n", s.SubmitterName)
+	switch s.Status {
+	case StatusApproved:
+		fmt.Fprintf(&text, "your message %q has been approved and sent to %s.\n", s.Subject, s.List)
+	case StatusRejected:
+		fmt.Fprintf(&text, "your message %q to %s has been rejected.\n", s.Subject, s.List)
+	default:
+		return nil
+	}
+	if s.Reason != "" {
+		fmt.Fprintf(&text, "\nReason: %s\n", s.Reason)
+	}
+	subject := fmt.Sprintf("Your submission to %s was %s", s.List, s.Status)
+	_, err := mailgun.SendNotification(ctx, s.SubmitterEmail, subject, text.String())
+	return err
+}
+
+// pending loads a submission and ensures it has not been decided yet. mu must be held.
+func pending(id string) (Submission, error) {
+	s, err := Get(id)
+	if err != nil {
+		return Submission{}, err
+	}
+	if s.Status != StatusPending {
+		return Submission{}, fmt.Errorf("%w: submission is already %s", common.ErrConflict, s.Status)
+	}
+	return s, nil
+}
+
+func decide(s Submission, status Status, moderator, reason string) (Submission, error) {
+	now := time.Now().UTC()
+	s.Status = status
+	s.ApprovalStartedAt = nil
+	s.DecidedBy = moderator
+	s.DecidedAt = &now
+	s.Reason = reason
+	return s, store.Put(bucket, s.ID, s)
+}
+
+// Erase removes the submitter address of a right to erasure request: pending submissions
+// of address are deleted, decided ones keep their content but refer to pseudonym instead.
+// It returns the number of changed submissions.
+func Erase(address, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	all, err := loadAll()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, s := range all {
+		submitter, moderator := strings.EqualFold(s.SubmitterEmail, address), strings.EqualFold(s.DecidedBy, address)
+		switch {
+		case submitter && s.Status == StatusPending:
+			err = store.Delete(bucket, s.ID)
+		case submitter || moderator:
+			if submitter {
+				s.SubmitterEmail, s.SubmitterName = pseudonym, ""
+			}
+			if moderator {
+				s.DecidedBy = pseudonym
+			}
+			err = store.Put(bucket, s.ID, s)
+		default:
+			continue
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
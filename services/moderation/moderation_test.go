@@ -0,0 +1,154 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/mailgunmock"
+	"mailinglist-backend-go/services/store"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+const (
+	testList   = "news@lists.test"
+	testMember = "jane@example.test"
+)
+
+func setup(t *testing.T) *mailgunmock.Server {
+	t.Helper()
+	t.Setenv("MAILGUN_MODERATED_MAILING_LISTS", testList)
+	mock := mailgunmock.StartWithKey("test-key")
+	t.Cleanup(mock.Close)
+	mock.AddList(mtypes.MailingList{Address: testList}, mtypes.Member{Address: testMember})
+	err := mailgun.Setup(mailgun.Config{APIKey: "test-key", APIBase: mock.URL(), Domain: "lists.test", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	return mock
+}
+
+func submit(t *testing.T) Submission {
+	t.Helper()
+	s, err := Submit(context.Background(), Submission{List: testList, SubmitterEmail: testMember, Subject: "Meetup", Text: "See you"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSubmitRequiresSubmitter(t *testing.T) {
+	setup(t)
+	_, err := Submit(context.Background(), Submission{List: testList, Subject: "Meetup", Text: "See you"})
+	if !errors.Is(err, common.ErrForbidden) {
+		t.Fatalf("got %v, want ErrForbidden", err)
+	}
+}
+
+func TestDecideWhileApproving(t *testing.T) {
+	mock := setup(t)
+	s := submit(t)
+
+	mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists.test/messages", Latency: 200 * time.Millisecond, Times: 1})
+	done := make(chan error, 1)
+	go func() {
+		_, err := Approve(context.Background(), s.ID, "mod@example.test", "")
+		done <- err
+	}()
+	for {
+		if got, _ := Get(s.ID); got.Status == StatusApproving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Not blocked by the send
+	start := time.Now()
+	if _, err := Reject(s.ID, "mod@example.test", "Off topic"); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("reject while approving: got %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("reject waited for the send")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Get(s.ID); got.Status != StatusApproved || got.MessageID == "" {
+		t.Fatalf("after approval: %+v", got)
+	}
+	if n := len(mock.Messages()); n != 1 {
+		t.Fatalf("sent %d messages", n)
+	}
+}
+
+func TestFailedApprovalIsPendingAgain(t *testing.T) {
+	mock := setup(t)
+	s := submit(t)
+
+	mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists.test/messages", Status: http.StatusBadRequest, Times: 1})
+	if _, err := Approve(context.Background(), s.ID, "mod@example.test", ""); err == nil {
+		t.Fatal("approval did not fail")
+	}
+	if got, _ := Get(s.ID); got.Status != StatusPending {
+		t.Fatalf("after failed approval: %s", got.Status)
+	}
+	if _, err := Approve(context.Background(), s.ID, "mod@example.test", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterruptedApprovalIsPendingAgain(t *testing.T) {
+	mock := setup(t)
+	s := submit(t)
+
+	// The message is sent, but the decision cannot be stored
+	mock.Inject(mailgunmock.Fault{Method: http.MethodPost, Path: "/v3/lists.test/messages", Latency: 100 * time.Millisecond, Times: 1})
+	done := make(chan error, 1)
+	go func() {
+		_, err := Approve(context.Background(), s.ID, "mod@example.test", "")
+		done <- err
+	}()
+	for {
+		if got, _ := Get(s.ID); got.Status == StatusApproving {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.InjectFault(errors.New("disk full"))
+	err := <-done
+	store.InjectFault(nil)
+	if err == nil {
+		t.Fatal("approval did not fail")
+	}
+	if _, err := Reject(s.ID, "mod@example.test", "Off topic"); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("reject within the timeout: got %v", err)
+	}
+
+	var stored Submission
+	if err := store.Get(bucket, s.ID, &stored); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now().Add(-approvalTimeout - time.Second)
+	stored.ApprovalStartedAt = &started
+	if err := store.Put(bucket, s.ID, stored); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := List(testList, StatusPending); len(pending) != 1 {
+		t.Fatalf("interrupted approval not listed as pending: %+v", pending)
+	}
+	if _, err := Reject(s.ID, "mod@example.test", "Sent already"); err != nil {
+		t.Fatal(err)
+	}
+	messages := mock.Messages()
+	if len(messages) != 1 || messages[0].Variables["submission_id"] != s.ID {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+}
@@ -0,0 +1,101 @@
+package rateLimiter
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a manually advanced time source for [Limiter.now].
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(rate Rate) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(rate)
+	l.now = c.now
+	return l, c
+}
+
+func TestBurstAndRefill(t *testing.T) {
+	l, c := newTestLimiter(Rate{Requests: 2, Per: time.Second})
+
+	for i := 0; i < 2; i++ {
+		if res := l.Allow("jane"); !res.Allowed || res.Remaining != 1-i {
+			t.Fatalf("request %d: %+v", i, res)
+		}
+	}
+	res := l.Allow("jane")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter != 500*time.Millisecond || res.Reset != time.Second {
+		t.Fatalf("over the burst: %+v", res)
+	}
+	if res := l.Allow("joe"); !res.Allowed {
+		t.Fatalf("other key: %+v", res)
+	}
+
+	// A token takes half a second
+	c.advance(250 * time.Millisecond)
+	if res := l.Allow("jane"); res.Allowed || res.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("after 250ms: %+v", res)
+	}
+	c.advance(250 * time.Millisecond)
+	if res := l.Allow("jane"); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("after 500ms: %+v", res)
+	}
+
+	// The bucket does not fill up beyond the burst
+	c.advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if res := l.Allow("jane"); !res.Allowed {
+			t.Fatalf("request %d after an hour: %+v", i, res)
+		}
+	}
+	if res := l.Allow("jane"); res.Allowed {
+		t.Fatalf("over the burst after an hour: %+v", res)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l, c := newTestLimiter(Rate{Requests: 10, Per: time.Minute})
+	l.Allow("idle")
+	c.advance(30 * time.Second)
+	l.Allow("active")
+
+	// The idle bucket is full again and dropped, the active one is kept
+	c.advance(40 * time.Second)
+	l.Allow("new")
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("idle bucket was kept")
+	}
+	if _, ok := l.buckets["active"]; !ok {
+		t.Fatal("active bucket was dropped")
+	}
+
+	// Sweeps run at most once per period
+	c.advance(40 * time.Second)
+	l.Allow("new")
+	if _, ok := l.buckets["active"]; !ok {
+		t.Fatal("swept again within the period")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]Rate{
+		"10/s":   {Requests: 10, Per: time.Second},
+		" 60/m ": {Requests: 60, Per: time.Minute},
+		"1000/h": {Requests: 1000, Per: time.Hour},
+	} {
+		if got, err := ParseRate(value); err != nil || got != want {
+			t.Errorf("%q: got %+v, %v", value, got, err)
+		}
+	}
+	for _, value := range []string{"", "10", "0/m", "-1/m", "ten/m", "10/d"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("%q: no error", value)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package requestValidator
+
+import (
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/configReader"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrMissingClaim = errors.New("missing")
+	ErrInvalidClaim = errors.New("invalid")
+)
+
+// ClaimError is returned for a token claim that is missing or has an unexpected type.
+type ClaimError struct {
+	Claim string
+	Err   error
+}
+
+func (e *ClaimError) Error() string {
+	return fmt.Sprintf("claim %s: %v", e.Claim, e.Err)
+}
+
+func (e *ClaimError) Unwrap() error {
+	return e.Err
+}
+
+// ClaimMapping names the claims holding the user attributes. Names are paths with dots
+// between nested objects, e.g. "realm_access.roles".
+type ClaimMapping struct {
+	Email         string
+	EmailVerified string
+	GivenName     string
+	FamilyName    string
+	Groups        string
+	Roles         string
+}
+
+// MappingFromEnv reads the mapping from CLAIM_EMAIL, CLAIM_EMAIL_VERIFIED,
+// CLAIM_GIVEN_NAME, CLAIM_FAMILY_NAME, CLAIM_GROUPS and CLAIM_ROLES. The defaults are the
+// claims of Keycloak tokens.
+func MappingFromEnv() ClaimMapping {
+	value := func(key, def string) string {
+		if v := strings.TrimSpace(configReader.Value(key)); v != "" {
+			return v
+		}
+		return def
+	}
+	return ClaimMapping{
+		Email:         value("CLAIM_EMAIL", "email"),
+		EmailVerified: value("CLAIM_EMAIL_VERIFIED", "email_verified"),
+		GivenName:     value("CLAIM_GIVEN_NAME", "given_name"),
+		FamilyName:    value("CLAIM_FAMILY_NAME", "family_name"),
+		Groups:        value("CLAIM_GROUPS", "groups"),
+		Roles:         value("CLAIM_ROLES", "realm_access.roles"),
+	}
+}
+
+// lookup resolves path in claims. A leading "$." is ignored.
+func lookup(claims jwt.MapClaims, path string) (any, bool) {
+	var v any = map[string]any(claims)
+	for _, key := range strings.Split(strings.TrimPrefix(path, "$."), ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// stringClaim returns the string at path; a missing claim is an error if required.
+func stringClaim(claims jwt.MapClaims, path string, required bool) (string, error) {
+	v, ok := lookup(claims, path)
+	if !ok {
+		if required {
+			return "", &ClaimError{Claim: path, Err: ErrMissingClaim}
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", &ClaimError{Claim: path, Err: fmt.Errorf("%w: expected a string, got %T", ErrInvalidClaim, v)}
+	}
+	if required && strings.TrimSpace(s) == "" {
+		return "", &ClaimError{Claim: path, Err: ErrMissingClaim}
+	}
+	return s, nil
+}
+
+// stringsClaim returns the strings at path, which may be an array or a single string.
+// A missing claim is empty.
+func stringsClaim(claims jwt.MapClaims, path string) ([]string, error) {
+	v, ok := lookup(claims, path)
+	if !ok {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, &ClaimError{Claim: path, Err: fmt.Errorf("%w: expected strings, got %T", ErrInvalidClaim, item)}
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	case []string:
+		return v, nil
+	}
+	return nil, &ClaimError{Claim: path, Err: fmt.Errorf("%w: expected an array of strings, got %T", ErrInvalidClaim, v)}
+}
+
+// boolClaim returns the boolean at path. Some identity providers send "true"/"false"
+// strings. A missing claim is false.
+func boolClaim(claims jwt.MapClaims, path string) (bool, error) {
+	v, ok := lookup(claims, path)
+	if !ok {
+		return false, nil
+	}
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, &ClaimError{Claim: path, Err: fmt.Errorf("%w: expected a boolean, got %v", ErrInvalidClaim, v)}
+}
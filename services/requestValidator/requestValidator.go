@@ -3,19 +3,89 @@ package requestValidator
 import (
 	"context"
 	"fmt"
+	"mailinglist-backend-go/services/apiKeys"
 	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/introspection"
 	"mailinglist-backend-go/services/jwtValidator"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// Scope is a permission of a machine client. Users are not limited by scopes.
+type Scope string
+
+const (
+	// ScopeUser marks routes that act on the authenticated user (/me) and are not
+	// available to machine clients.
+	ScopeUser         Scope = ""
+	ScopeListsRead    Scope = "lists:read"
+	ScopeListsWrite   Scope = "lists:write"
+	ScopeMembersRead  Scope = "members:read"
+	ScopeMembersWrite Scope = "members:write"
+	ScopeMessagesSend Scope = "messages:send"
+	// ScopeAdmin grants the remaining admin routes: suppressions, templates, moderation,
+	// consent policy, webhooks and jobs.
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes are all scopes machine clients can be granted. API keys are granted the same,
+// see [apiKeys.Scopes].
+var Scopes = []Scope{ScopeListsRead, ScopeListsWrite, ScopeMembersRead, ScopeMembersWrite, ScopeMessagesSend, ScopeAdmin}
+
+// User is the authenticated principal: a person with a user token or a machine client
+// with a client credentials token or an API key.
 type User struct {
 	Name     string
 	LastName string
 	Email    string
-	Admin    bool
+	// EmailVerified is the email_verified claim: the identity provider checked that the
+	// user owns Email.
+	EmailVerified bool
+	Admin         bool
+	Groups        []string
+	Roles         []string
+	// Client identifies a machine client; it is empty for users.
+	Client string
+	Scopes []Scope
+	// ImpersonatedBy is the actor of the authenticated user acting as this user with
+	// X-Act-As.
+	ImpersonatedBy string
+}
+
+// Machine reports whether the principal is a machine client.
+func (u User) Machine() bool {
+	return u.Client != ""
+}
+
+// HasScope reports whether a machine client was granted scope.
+func (u User) HasScope(scope Scope) bool {
+	return slices.Contains(u.Scopes, scope)
+}
+
+// Actor identifies the principal in audit entries and events: the email of a user, the
+// client of a machine or the user impersonating this one.
+func (u User) Actor() string {
+	if u.Machine() {
+		return u.Client
+	}
+	if u.ImpersonatedBy != "" {
+		return u.ImpersonatedBy
+	}
+	return u.Email
+}
+
+// ActAs returns the user email as seen by u impersonating it. Only the address is known
+// about it, so it has no groups and no admin permissions.
+func (u User) ActAs(email string) User {
+	return User{Email: email, ImpersonatedBy: u.Actor()}
+}
+
+// FullName is the display name built from the given_name and family_name claims.
+func (u User) FullName() string {
+	return strings.TrimSpace(u.Name + " " + u.LastName)
 }
 
 // normalizePublicKey takes the env value and returns a PEM-formatted public key string.
@@ -45,7 +115,18 @@ func normalizePublicKey(raw string) string {
 	return "-----BEGIN PUBLIC KEY-----\n" + trimmed + "\n-----END PUBLIC KEY-----"
 }
 
+// ValidateRequest authenticates the request with a JWT or an API key (as bearer token or
+// X-API-Key header). API keys are represented by claims like those of a client
+// credentials token. If token introspection is configured, bearer tokens that are not
+// JWTs are validated by the authorization server.
 func ValidateRequest(r *http.Request) (jwt.MapClaims, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return apiKeyClaims(key)
+	}
+	if key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(key, apiKeys.Prefix) {
+		return apiKeyClaims(key)
+	}
+
 	publicKey := configReader.Value("KEYCLOAK_PUBLIC_KEY")
 	publicKeyComplete := normalizePublicKey(publicKey)
 	bearerToken := r.Header.Get("Authorization")
@@ -55,14 +136,29 @@ func ValidateRequest(r *http.Request) (jwt.MapClaims, error) {
 		return nil, fmt.Errorf("No token found in header")
 	}
 
+	if introspection.Enabled() && strings.Count(token[1], ".") != 2 {
+		return introspection.Introspect(r.Context(), token[1])
+	}
 	return jwtValidator.ValidateToken(token[1], publicKeyComplete)
 }
 
+func apiKeyClaims(token string) (jwt.MapClaims, error) {
+	k, err := apiKeys.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	client := "api-key:" + k.Name + ":" + k.ID
+	return jwt.MapClaims{"sub": client, "client_id": client, "scope": strings.Join(k.Scopes, " ")}, nil
+}
+
 // Context helpers for attaching and retrieving claims set by auth middleware
 
 type ctxKey string
 
-var claimsCtxKey ctxKey = "jwtClaims"
+var (
+	claimsCtxKey ctxKey = "jwtClaims"
+	actAsCtxKey  ctxKey = "actAs"
+)
 
 // WithClaims returns a new context with JWT claims stored
 func WithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
@@ -75,6 +171,17 @@ func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
 	return claims, ok
 }
 
+// WithActAs returns a new context in which the /me routes act as email
+func WithActAs(ctx context.Context, email string) context.Context {
+	return context.WithValue(ctx, actAsCtxKey, email)
+}
+
+// ActingAs returns the user the request acts as, or "" without impersonation
+func ActingAs(ctx context.Context) string {
+	email, _ := ctx.Value(actAsCtxKey).(string)
+	return email
+}
+
 // ClaimsFromRequest is a helper to extract claims from the request context
 func ClaimsFromRequest(r *http.Request) (jwt.MapClaims, error) {
 	if claims, ok := ClaimsFromContext(r.Context()); ok {
@@ -83,23 +190,82 @@ func ClaimsFromRequest(r *http.Request) (jwt.MapClaims, error) {
 	return nil, fmt.Errorf("no claims in context")
 }
 
-func isAdmin(claims jwt.MapClaims) bool {
-	var groups []interface{}
-	groups = claims["groups"].([]interface{})
-
-	for _, group := range groups {
-		if group == "Admin" {
-			return true
+// machineClient returns the client of a client credentials token or API key, or "" for
+// user tokens. Keycloak adds client_id to service account tokens; older versions only
+// name the service account user after the client.
+func machineClient(claims jwt.MapClaims) string {
+	if client, _ := claims["client_id"].(string); client != "" {
+		return client
+	}
+	if username, _ := claims["preferred_username"].(string); strings.HasPrefix(username, "service-account-") {
+		if azp, _ := claims["azp"].(string); azp != "" {
+			return azp
 		}
+		return strings.TrimPrefix(username, "service-account-")
 	}
-	return false
+	return ""
 }
 
-func CurrentUser(claims jwt.MapClaims) User {
+// CurrentUser returns the principal of claims. Machine clients are admins within their
+// scopes, which are enforced per route. User claims are read with the mapping of
+// MappingFromEnv; a missing email or a claim of the wrong type is a *ClaimError.
+func CurrentUser(claims jwt.MapClaims) (User, error) {
+	if client := machineClient(claims); client != "" {
+		scope, _ := claims["scope"].(string)
+		var scopes []Scope
+		for _, s := range strings.Fields(scope) {
+			if slices.Contains(Scopes, Scope(s)) {
+				scopes = append(scopes, Scope(s))
+			}
+		}
+		return User{Client: client, Admin: true, Scopes: scopes}, nil
+	}
+	mapping := MappingFromEnv()
+	email, err := stringClaim(claims, mapping.Email, true)
+	if err != nil {
+		return User{}, err
+	}
+	verified, err := boolClaim(claims, mapping.EmailVerified)
+	if err != nil {
+		return User{}, err
+	}
+	name, err := stringClaim(claims, mapping.GivenName, false)
+	if err != nil {
+		return User{}, err
+	}
+	lastName, err := stringClaim(claims, mapping.FamilyName, false)
+	if err != nil {
+		return User{}, err
+	}
+	groups, err := stringsClaim(claims, mapping.Groups)
+	if err != nil {
+		return User{}, err
+	}
+	roles, err := stringsClaim(claims, mapping.Roles)
+	if err != nil {
+		return User{}, err
+	}
 	return User{
-		Name:     claims["given_name"].(string),
-		LastName: claims["family_name"].(string),
-		Email:    claims["email"].(string),
-		Admin:    isAdmin(claims),
+		Name:          name,
+		LastName:      lastName,
+		Email:         email,
+		EmailVerified: verified,
+		Admin:         isAdmin(groups, roles),
+		Groups:        groups,
+		Roles:         roles,
+	}, nil
+}
+
+// isAdmin reports whether the user is in ADMIN_GROUP (default "Admin") or has ADMIN_ROLE
+// (not checked unless set).
+func isAdmin(groups, roles []string) bool {
+	group := configReader.Value("ADMIN_GROUP")
+	if group == "" {
+		group = "Admin"
+	}
+	if slices.Contains(groups, group) {
+		return true
 	}
+	role := configReader.Value("ADMIN_ROLE")
+	return role != "" && slices.Contains(roles, role)
 }
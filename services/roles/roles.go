@@ -0,0 +1,276 @@
+// Package roles decides what users may do with a list. Users have one role per list,
+// granted locally or derived from Keycloak groups, and admins have every permission on
+// every list:
+//
+//	viewer          sees members and statistics of the list
+//	list-moderator  also moderates submissions to the list
+//	list-owner      also manages members, sends messages and edits the member vars schema
+//	admin           everything, including the settings that are not bound to a list
+package roles
+
+import (
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/requestValidator"
+	"mailinglist-backend-go/services/store"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bucket = "role_grants"
+
+type Role string
+
+const (
+	RoleNone      Role = ""
+	RoleViewer    Role = "viewer"
+	RoleModerator Role = "list-moderator"
+	RoleOwner     Role = "list-owner"
+	RoleAdmin     Role = "admin"
+)
+
+// ListRoles are the roles that can be granted per list, lowest first. Admins are the
+// users of the Keycloak admin group.
+var ListRoles = []Role{RoleViewer, RoleModerator, RoleOwner}
+
+// ParseRole validates the name of a list role.
+func ParseRole(s string) (Role, error) {
+	if r := Role(s); slices.Contains(ListRoles, r) {
+		return r, nil
+	}
+	return RoleNone, fmt.Errorf("%w: unknown role %q", common.ErrBadRequest, s)
+}
+
+// rank orders the roles; a role has the permissions of all lower ones.
+func (r Role) rank() int {
+	if r == RoleAdmin {
+		return len(ListRoles) + 1
+	}
+	return slices.Index(ListRoles, r) + 1
+}
+
+type Permission string
+
+const (
+	ViewMembers   Permission = "view_members"
+	Moderate      Permission = "moderate"
+	ManageMembers Permission = "manage_members"
+	SendMessages  Permission = "send_messages"
+	ManageList    Permission = "manage_list"
+	// ManageRoles grants and revokes list roles.
+	ManageRoles Permission = "manage_roles"
+	// Impersonate lets support staff use the /me routes as another user. Besides admins,
+	// the users of the Keycloak group IMPERSONATION_GROUP (default "Support") have it.
+	Impersonate Permission = "impersonate"
+	// Administer covers everything not bound to a list: suppressions, templates, jobs,
+	// webhooks, API keys, consent policy and the data of arbitrary addresses.
+	Administer Permission = "administer"
+)
+
+// required is the lowest role having a permission.
+var required = map[Permission]Role{
+	ViewMembers:   RoleViewer,
+	Moderate:      RoleModerator,
+	ManageMembers: RoleOwner,
+	SendMessages:  RoleOwner,
+	ManageList:    RoleOwner,
+	ManageRoles:   RoleAdmin,
+	Impersonate:   RoleAdmin,
+	Administer:    RoleAdmin,
+}
+
+// Grant is a role of a user in a list stored by this service.
+type Grant struct {
+	List      string    `json:"list" example:"news@example.com"`
+	Member    string    `json:"member" example:"jane@example.com"`
+	Role      Role      `json:"role" example:"list-moderator"`
+	GrantedBy string    `json:"granted_by" example:"admin@example.com"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// mu serializes changes of grants.
+var mu sync.Mutex
+
+func key(list, member string) string {
+	return strings.ToLower(list) + "|" + strings.ToLower(member)
+}
+
+// Put grants role in list to member, replacing its previous grant there.
+func Put(list, member string, role Role, grantedBy string) (Grant, error) {
+	if _, err := ParseRole(string(role)); err != nil {
+		return Grant{}, err
+	}
+	if _, err := mail.ParseAddress(member); err != nil {
+		return Grant{}, fmt.Errorf("%w: invalid member: %w", common.ErrBadRequest, err)
+	}
+	g := Grant{List: list, Member: member, Role: role, GrantedBy: grantedBy, GrantedAt: time.Now().UTC()}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := store.Put(bucket, key(list, member), g); err != nil {
+		return Grant{}, err
+	}
+	return g, nil
+}
+
+// Delete revokes the grant of member in list.
+func Delete(list, member string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return store.Delete(bucket, key(list, member))
+}
+
+// ForList returns the grants of list.
+func ForList(list string) ([]Grant, error) {
+	return filter(func(g Grant) bool { return strings.EqualFold(g.List, list) })
+}
+
+// ForMember returns the grants of member in all lists.
+func ForMember(member string) ([]Grant, error) {
+	return filter(func(g Grant) bool { return strings.EqualFold(g.Member, member) })
+}
+
+func filter(match func(Grant) bool) ([]Grant, error) {
+	all, err := store.All[Grant](bucket)
+	if err != nil {
+		return nil, err
+	}
+	result := []Grant{}
+	for _, g := range all {
+		if match(g) {
+			result = append(result, g)
+		}
+	}
+	return result, nil
+}
+
+// Erase revokes all grants of member and replaces member by pseudonym where it granted a
+// role. It returns the number of changed grants.
+func Erase(member, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	changed := 0
+	for _, k := range store.Keys(bucket) {
+		var g Grant
+		if err := store.Get(bucket, k, &g); err != nil {
+			return changed, err
+		}
+		switch {
+		case strings.EqualFold(g.Member, member):
+			if err := store.Delete(bucket, k); err != nil {
+				return changed, err
+			}
+		case strings.EqualFold(g.GrantedBy, member):
+			g.GrantedBy = pseudonym
+			if err := store.Put(bucket, k, g); err != nil {
+				return changed, err
+			}
+		default:
+			continue
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// groupPrefixes map the Keycloak groups "<prefix><list>" to list roles. The prefixes are
+// read from VIEWER_GROUP_PREFIX, MODERATOR_GROUP_PREFIX and OWNER_GROUP_PREFIX.
+func groupPrefixes() map[Role]string {
+	value := func(key, def string) string {
+		if v := configReader.Value(key); v != "" {
+			return v
+		}
+		return def
+	}
+	return map[Role]string{
+		RoleViewer:    value("VIEWER_GROUP_PREFIX", "Viewer:"),
+		RoleModerator: value("MODERATOR_GROUP_PREFIX", "Moderator:"),
+		RoleOwner:     value("OWNER_GROUP_PREFIX", "Owner:"),
+	}
+}
+
+// Of returns the highest role of user in list: admin, the role of a group or the stored
+// grant. A grant that cannot be read counts as none, and so does the grant of an email the
+// identity provider did not verify: anybody could register an account with it.
+func Of(user requestValidator.User, list string) Role {
+	if user.Admin {
+		return RoleAdmin
+	}
+	role := RoleNone
+	if list == "" || user.Email == "" {
+		return role
+	}
+	for r, prefix := range groupPrefixes() {
+		for _, group := range user.Groups {
+			if strings.EqualFold(strings.TrimPrefix(group, "/"), prefix+list) && r.rank() > role.rank() {
+				role = r
+			}
+		}
+	}
+	if !user.EmailVerified && !user.Machine() && user.ImpersonatedBy == "" {
+		return role
+	}
+	var g Grant
+	if err := store.Get(bucket, key(list, user.Email), &g); err == nil && g.Role.rank() > role.rank() {
+		role = g.Role
+	}
+	return role
+}
+
+// Can reports whether user has perm in list. Permissions not bound to a list are checked
+// with list "".
+func Can(user requestValidator.User, list string, perm Permission) bool {
+	if perm == Impersonate && !user.Machine() && user.ImpersonatedBy == "" {
+		group := configReader.Value("IMPERSONATION_GROUP")
+		if group == "" {
+			group = "Support"
+		}
+		if slices.ContainsFunc(user.Groups, func(g string) bool { return strings.EqualFold(strings.TrimPrefix(g, "/"), group) }) {
+			return true
+		}
+	}
+	need, ok := required[perm]
+	return ok && Of(user, list).rank() >= need.rank()
+}
+
+// Effective returns the roles of user per list, from groups and grants. Admins have
+// every role and are not listed per list.
+func Effective(user requestValidator.User) (map[string]Role, error) {
+	result := map[string]Role{}
+	if user.Admin {
+		return result, nil
+	}
+	grants, err := ForMember(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	lists := map[string]bool{}
+	for _, g := range grants {
+		lists[strings.ToLower(g.List)] = true
+	}
+	for _, prefix := range groupPrefixes() {
+		for _, group := range user.Groups {
+			if list, ok := cutPrefixFold(strings.TrimPrefix(group, "/"), prefix); ok && list != "" {
+				lists[strings.ToLower(list)] = true
+			}
+		}
+	}
+	for list := range lists {
+		if role := Of(user, list); role != RoleNone {
+			result[list] = role
+		}
+	}
+	return result, nil
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
@@ -0,0 +1,419 @@
+// Package scheduler runs deferred jobs (scheduled sends, background maintenance, ...).
+//
+// Jobs are persisted in the local store before they are acknowledged and survive restarts.
+// Execution is at-least-once: a job that was running when the process stopped is run
+// again on the next start, so handlers have to be idempotent. Every job carries an
+// idempotency key; scheduling a second job with the same key returns the first one.
+// Callers passing on keys of clients namespace them, since all job types share the keys.
+//
+// Done and cancelled jobs are removed with their idempotency keys SCHEDULER_RETENTION
+// (default 720h) after they finished; failed jobs are kept until they are rescheduled
+// or cancelled.
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/store"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	jobsBucket = "jobs"
+	keysBucket = "job_keys"
+
+	// maxAttempts is the number of executions before a job is marked failed.
+	maxAttempts = 5
+
+	// purgeInterval is the time between two purges of finished jobs by [Start].
+	purgeInterval = time.Hour
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// ErrPermanent marks handler errors that must not be retried.
+var ErrPermanent = errors.New("permanent failure")
+
+// Job is a persisted unit of deferred work.
+type Job struct {
+	ID             string `json:"id"`
+	Type           string `json:"type" example:"send_message"`
+	IdempotencyKey string `json:"idempotency_key"`
+	// ScheduledAt is the time the job was scheduled for. RunAt is the time of the next
+	// attempt, which moves on with every retry.
+	ScheduledAt time.Time       `json:"scheduled_at"`
+	RunAt       time.Time       `json:"run_at"`
+	Status      Status          `json:"status" example:"pending"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	Payload     json.RawMessage `json:"payload" swaggertype:"object"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// Handler executes a job. Returning an error schedules a retry with backoff.
+type Handler func(ctx context.Context, job Job) error
+
+var (
+	// mu serializes all read-modify-write cycles on jobs
+	mu       sync.Mutex
+	handlers = map[string]Handler{}
+	wake     = make(chan struct{}, 1)
+)
+
+// Register sets the handler for jobType. It must be called before [Start].
+func Register(jobType string, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[jobType] = h
+}
+
+// Schedule persists a new job running at runAt with the JSON encoded payload. If a job
+// with idempotencyKey already exists, that job is returned instead; if it has another type
+// or payload, the key was reused and Schedule returns ErrConflict. An empty key defaults
+// to the job ID.
+func Schedule(jobType string, runAt time.Time, payload any, idempotencyKey string) (Job, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := handlers[jobType]; !ok {
+		return Job{}, fmt.Errorf("unknown job type %q", jobType)
+	}
+	if idempotencyKey != "" {
+		var id string
+		if err := store.Get(keysBucket, idempotencyKey, &id); err == nil {
+			job, err := get(id)
+			if err != nil {
+				return Job{}, err
+			}
+			if job.Type != jobType || !bytes.Equal(job.Payload, raw) {
+				return Job{}, fmt.Errorf("%w: idempotency key %q was used for another job", common.ErrConflict, idempotencyKey)
+			}
+			return job, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	job := Job{
+		ID:             uuid.NewString(),
+		Type:           jobType,
+		IdempotencyKey: idempotencyKey,
+		ScheduledAt:    runAt.UTC(),
+		RunAt:          runAt.UTC(),
+		Status:         StatusPending,
+		Payload:        raw,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if job.IdempotencyKey == "" {
+		job.IdempotencyKey = job.ID
+	}
+	err = store.Apply(store.Op{Bucket: jobsBucket, Key: job.ID, Value: job}, store.Op{Bucket: keysBucket, Key: job.IdempotencyKey, Value: job.ID})
+	if err != nil {
+		return Job{}, err
+	}
+	notify()
+	return job, nil
+}
+
+// List returns all jobs ordered by their scheduled time. An empty status returns all jobs.
+func List(status Status) ([]Job, error) {
+	jobs, err := store.All[Job](jobsBucket)
+	if err != nil {
+		return nil, err
+	}
+	jobs = slices.DeleteFunc(jobs, func(j Job) bool { return status != "" && j.Status != status })
+	slices.SortFunc(jobs, func(a, b Job) int { return a.RunAt.Compare(b.RunAt) })
+	return jobs, nil
+}
+
+func Get(id string) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return get(id)
+}
+
+// Reschedule moves a pending or failed job to runAt. Failed jobs get a fresh set of attempts.
+func Reschedule(id string, runAt time.Time) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, err := get(id)
+	if err != nil {
+		return Job{}, err
+	}
+	if job.Status != StatusPending && job.Status != StatusFailed {
+		return Job{}, fmt.Errorf("%w: job is %s", common.ErrConflict, job.Status)
+	}
+	job.ScheduledAt = runAt.UTC()
+	job.RunAt = runAt.UTC()
+	job.Status = StatusPending
+	job.Attempts = 0
+	job.UpdatedAt = time.Now().UTC()
+	if err := store.Put(jobsBucket, job.ID, job); err != nil {
+		return Job{}, err
+	}
+	notify()
+	return job, nil
+}
+
+// Cancel cancels a pending or failed job.
+func Cancel(id string) (Job, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, err := get(id)
+	if err != nil {
+		return Job{}, err
+	}
+	if job.Status != StatusPending && job.Status != StatusFailed {
+		return Job{}, fmt.Errorf("%w: job is %s", common.ErrConflict, job.Status)
+	}
+	job.Status = StatusCancelled
+	job.UpdatedAt = time.Now().UTC()
+	return job, store.Put(jobsBucket, job.ID, job)
+}
+
+// Purge removes the done and cancelled jobs that finished before before, together with
+// their idempotency keys. It returns the number of removed jobs.
+func Purge(before time.Time) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	jobs, err := store.All[Job](jobsBucket)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, job := range jobs {
+		if (job.Status != StatusDone && job.Status != StatusCancelled) || !job.UpdatedAt.Before(before) {
+			continue
+		}
+		var id string
+		if err := store.Get(keysBucket, job.IdempotencyKey, &id); err == nil && id == job.ID {
+			if err := store.Delete(keysBucket, job.IdempotencyKey); err != nil {
+				return removed, err
+			}
+		}
+		if err := store.Delete(jobsBucket, job.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Pseudonymize replaces address by pseudonym in the payloads and idempotency keys of jobs,
+// for right to erasure requests. Pending and failed jobs for address are cancelled, since
+// they would run without it; running jobs are left alone. It returns the number of
+// changed jobs.
+func Pseudonymize(address, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	jobs, err := store.All[Job](jobsBucket)
+	if err != nil {
+		return 0, err
+	}
+	pattern := regexp.MustCompile(`(?i)` + regexp.QuoteMeta(address))
+	changed := 0
+	for _, job := range jobs {
+		if job.Status == StatusRunning || (!pattern.Match(job.Payload) && !pattern.MatchString(job.IdempotencyKey)) {
+			continue
+		}
+		if job.Status == StatusPending || job.Status == StatusFailed {
+			job.Status = StatusCancelled
+		}
+		job.Payload = pattern.ReplaceAllLiteral(job.Payload, []byte(pseudonym))
+		job.UpdatedAt = time.Now().UTC()
+		var ops []store.Op
+		if key := pattern.ReplaceAllLiteralString(job.IdempotencyKey, pseudonym); key != job.IdempotencyKey {
+			var id string
+			if err := store.Get(keysBucket, job.IdempotencyKey, &id); err == nil && id == job.ID {
+				ops = append(ops, store.Op{Bucket: keysBucket, Key: job.IdempotencyKey, Delete: true}, store.Op{Bucket: keysBucket, Key: key, Value: job.ID})
+			}
+			job.IdempotencyKey = key
+		}
+		ops = append(ops, store.Op{Bucket: jobsBucket, Key: job.ID, Value: job})
+		if err := store.Apply(ops...); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Start recovers jobs interrupted by a previous shutdown and runs due jobs until ctx is done.
+func Start(ctx context.Context, lg *slog.Logger) error {
+	if err := recoverInterrupted(); err != nil {
+		return err
+	}
+	interval := configReader.Duration("SCHEDULER_POLL_INTERVAL", 5*time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var lastPurge time.Time
+		for {
+			if time.Since(lastPurge) >= purgeInterval {
+				lastPurge = time.Now()
+				if n, err := Purge(time.Now().Add(-configReader.Duration("SCHEDULER_RETENTION", 30*24*time.Hour))); err != nil {
+					lg.ErrorContext(ctx, "failed to purge finished jobs", "error", err)
+				} else if n > 0 {
+					lg.InfoContext(ctx, "purged finished jobs", "count", n)
+				}
+			}
+			RunDue(ctx, lg)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+	return nil
+}
+
+// RunDue runs all pending jobs whose time has come, one after another.
+func RunDue(ctx context.Context, lg *slog.Logger) {
+	for ctx.Err() == nil {
+		job, h, ok := claimNext()
+		if !ok {
+			return
+		}
+		lg.InfoContext(ctx, "running job", "job", job.ID, "type", job.Type, "attempt", job.Attempts)
+		err := runSafely(ctx, h, job)
+		if err != nil {
+			lg.ErrorContext(ctx, "job failed", "job", job.ID, "type", job.Type, "attempt", job.Attempts, "error", err)
+		}
+		if err := finish(job.ID, err); err != nil {
+			lg.ErrorContext(ctx, "failed to store job result", "job", job.ID, "error", err)
+		}
+	}
+}
+
+// claimNext marks the earliest due pending job as running.
+func claimNext() (Job, Handler, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	jobs, err := List(StatusPending)
+	if err != nil {
+		return Job{}, nil, false
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		if job.RunAt.After(now) {
+			break
+		}
+		job.UpdatedAt = now.UTC()
+		h, ok := handlers[job.Type]
+		if !ok {
+			// Unknown types (e.g. from a newer version) are failed instead of blocking the queue
+			job.Status = StatusFailed
+			job.LastError = "no handler registered for job type " + job.Type
+			_ = store.Put(jobsBucket, job.ID, job)
+			continue
+		}
+		job.Status = StatusRunning
+		job.Attempts++
+		if err := store.Put(jobsBucket, job.ID, job); err != nil {
+			return Job{}, nil, false
+		}
+		return job, h, true
+	}
+	return Job{}, nil, false
+}
+
+func finish(id string, runErr error) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, err := get(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	job.UpdatedAt = now
+	switch {
+	case runErr == nil:
+		job.Status = StatusDone
+		job.LastError = ""
+		job.CompletedAt = &now
+	case job.Attempts >= maxAttempts || errors.Is(runErr, ErrPermanent):
+		job.Status = StatusFailed
+		job.LastError = runErr.Error()
+	default:
+		job.Status = StatusPending
+		job.LastError = runErr.Error()
+		job.RunAt = now.Add(time.Minute << (job.Attempts - 1))
+	}
+	return store.Put(jobsBucket, job.ID, job)
+}
+
+func runSafely(ctx context.Context, h Handler, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// recoverInterrupted requeues jobs that were running when the process stopped.
+func recoverInterrupted() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	jobs, err := List(StatusRunning)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		job.Status = StatusPending
+		job.UpdatedAt = time.Now().UTC()
+		if err := store.Put(jobsBucket, job.ID, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get loads a job. mu must be held.
+func get(id string) (Job, error) {
+	var job Job
+	err := store.Get(jobsBucket, id, &job)
+	return job, err
+}
+
+func notify() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
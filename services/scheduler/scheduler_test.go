@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var lg = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func openStore(t *testing.T) {
+	t.Helper()
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryKeepsScheduledTime(t *testing.T) {
+	openStore(t)
+	Register("flaky", func(context.Context, Job) error { return errors.New("unavailable") })
+	scheduledAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	job, err := Schedule("flaky", scheduledAt, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RunDue(context.Background(), lg)
+	job, _ = Get(job.ID)
+	if job.Status != StatusPending || job.Attempts != 1 || !job.RunAt.After(time.Now()) {
+		t.Fatalf("unexpected job after failed attempt: %+v", job)
+	}
+	if !job.ScheduledAt.Equal(scheduledAt) {
+		t.Fatalf("scheduled_at changed to %s", job.ScheduledAt)
+	}
+}
+
+func TestScheduleIsIdempotent(t *testing.T) {
+	openStore(t)
+	Register("noop", func(context.Context, Job) error { return nil })
+	first, err := Schedule("noop", time.Now().Add(time.Hour), nil, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Schedule("noop", time.Now().Add(2*time.Hour), nil, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID || !second.RunAt.Equal(first.RunAt) {
+		t.Fatalf("second schedule returned %+v, want %+v", second, first)
+	}
+}
+
+func TestScheduleRejectsReusedKey(t *testing.T) {
+	openStore(t)
+	Register("noop", func(context.Context, Job) error { return nil })
+	Register("other", func(context.Context, Job) error { return nil })
+	if _, err := Schedule("noop", time.Now().Add(time.Hour), map[string]string{"subject": "Hello"}, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Schedule("noop", time.Now().Add(time.Hour), map[string]string{"subject": "Bye"}, "key"); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("other payload: got %v", err)
+	}
+	if _, err := Schedule("other", time.Now().Add(time.Hour), map[string]string{"subject": "Hello"}, "key"); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("other type: got %v", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	openStore(t)
+	Register("noop", func(context.Context, Job) error { return nil })
+	Register("broken", func(context.Context, Job) error { return ErrPermanent })
+	ctx := context.Background()
+
+	done, _ := Schedule("noop", time.Now(), nil, "done")
+	failed, _ := Schedule("broken", time.Now(), nil, "failed")
+	RunDue(ctx, lg)
+	cancelled, _ := Schedule("noop", time.Now().Add(time.Hour), nil, "cancelled")
+	if _, err := Cancel(cancelled.ID); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := Schedule("noop", time.Now().Add(time.Hour), nil, "pending")
+
+	if n, err := Purge(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("purged %d (%v) jobs within retention", n, err)
+	}
+	n, err := Purge(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("purged %d jobs, want 2", n)
+	}
+	for _, id := range []string{done.ID, cancelled.ID} {
+		if _, err := Get(id); err == nil {
+			t.Fatalf("job %s was kept", id)
+		}
+	}
+	for _, id := range []string{failed.ID, pending.ID} {
+		if _, err := Get(id); err != nil {
+			t.Fatalf("job %s was removed", id)
+		}
+	}
+	// The key of a purged job can be used again
+	again, err := Schedule("noop", time.Now().Add(time.Hour), nil, "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID == done.ID || again.Status != StatusPending {
+		t.Fatalf("unexpected job for a purged key: %+v", again)
+	}
+}
+
+func TestPseudonymize(t *testing.T) {
+	openStore(t)
+	Register("noop", func(context.Context, Job) error { return nil })
+	done, _ := Schedule("noop", time.Now(), map[string]string{"member": "Jane@example.test"}, "noop:jane@example.test")
+	RunDue(context.Background(), lg)
+	pending, _ := Schedule("noop", time.Now().Add(time.Hour), map[string]string{"member": "jane@example.test"}, "")
+	other, _ := Schedule("noop", time.Now().Add(time.Hour), map[string]string{"member": "joe@example.test"}, "")
+
+	n, err := Pseudonymize("jane@example.test", "erased:1")
+	if err != nil || n != 2 {
+		t.Fatalf("changed %d jobs, %v", n, err)
+	}
+	done, _ = Get(done.ID)
+	if done.Status != StatusDone || string(done.Payload) != `{"member":"erased:1"}` || done.IdempotencyKey != "noop:erased:1" {
+		t.Fatalf("unexpected done job: %+v", done)
+	}
+	if again, err := Schedule("noop", time.Now(), map[string]string{"member": "erased:1"}, "noop:erased:1"); err != nil || again.ID != done.ID {
+		t.Fatalf("idempotency key was not moved: %+v, %v", again, err)
+	}
+	if pending, _ = Get(pending.ID); pending.Status != StatusCancelled || string(pending.Payload) != `{"member":"erased:1"}` {
+		t.Fatalf("unexpected pending job: %+v", pending)
+	}
+	if other, _ = Get(other.ID); other.Status != StatusPending {
+		t.Fatalf("other job changed: %+v", other)
+	}
+}
@@ -0,0 +1,334 @@
+// Package store persists the local application state (templates, jobs, ...) as JSON.
+//
+// Values are grouped in buckets and addressed by key. The whole state is kept in memory.
+// Changes are appended to a log next to the state file (<path>.log) and synced, so a
+// write costs one small append regardless of the size of the state. When the log has
+// grown to compactAfter changes, and whenever the store is opened, the state is written
+// to the file and the log starts over. Without a path the store only lives in memory.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/common"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// compactAfter is the number of logged changes after which the state file is rewritten.
+const compactAfter = 10000
+
+// Op is one change of a batch applied with [Apply]: Value is stored under Bucket/Key,
+// or Bucket/Key is removed if Delete is set.
+type Op struct {
+	Bucket string
+	Key    string
+	Value  any
+	Delete bool
+}
+
+// logOp is an Op as written to the log.
+type logOp struct {
+	Bucket string          `json:"b"`
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"`
+	Delete bool            `json:"d,omitempty"`
+}
+
+var (
+	mu   sync.Mutex
+	path string
+	data = map[string]map[string]json.RawMessage{}
+	// logFile is the open change log, nil until the first write
+	logFile *os.File
+	// logSize is the size of the complete entries in logFile
+	logSize int64
+	// logged is the number of entries in logFile
+	logged int
+	// fault fails all writes, see [InjectFault]
+	fault error
+)
+
+// Open loads the store from file p and the changes in its log and writes them back to p.
+// An empty p keeps the state in memory only. Open replaces any previously opened state.
+func Open(p string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if logFile != nil {
+		_ = logFile.Close()
+		logFile = nil
+	}
+	path, data, fault = "", map[string]map[string]json.RawMessage{}, nil
+	if p == "" {
+		return nil
+	}
+
+	loaded := map[string]map[string]json.RawMessage{}
+	raw, err := os.ReadFile(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to read store: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &loaded); err != nil {
+			return fmt.Errorf("failed to parse store %s: %w", p, err)
+		}
+	}
+	if err := replay(p+".log", loaded); err != nil {
+		return err
+	}
+	path, data = p, loaded
+	// Fold the replayed changes into the state file and start a fresh log
+	return compact()
+}
+
+// replay applies the complete entries of the log file p to state. An incomplete last
+// entry is the remainder of an interrupted write and is ignored.
+func replay(p string, state map[string]map[string]json.RawMessage) error {
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read store log: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read store log: %w", err)
+		}
+		var ops []logOp
+		if err := json.Unmarshal(line, &ops); err != nil {
+			return fmt.Errorf("failed to parse store log %s: %w", p, err)
+		}
+		for _, op := range ops {
+			if op.Delete {
+				delete(state[op.Bucket], op.Key)
+				continue
+			}
+			if state[op.Bucket] == nil {
+				state[op.Bucket] = map[string]json.RawMessage{}
+			}
+			state[op.Bucket][op.Key] = op.Value
+		}
+	}
+}
+
+// Get decodes the value stored under bucket/key into v. It returns
+// [common.ErrNotFound] if there is no such value.
+func Get(bucket, key string, v any) error {
+	mu.Lock()
+	raw, ok := data[bucket][key]
+	mu.Unlock()
+	if !ok {
+		return common.ErrNotFound
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Put stores v under bucket/key.
+func Put(bucket, key string, v any) error {
+	return Apply(Op{Bucket: bucket, Key: key, Value: v})
+}
+
+// Delete removes bucket/key. It returns [common.ErrNotFound] if there is no such value.
+func Delete(bucket, key string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := data[bucket][key]; !ok {
+		return common.ErrNotFound
+	}
+	return apply([]logOp{{Bucket: bucket, Key: key, Delete: true}})
+}
+
+// Apply applies ops in order with a single write: either all of them are stored or,
+// if the write fails, none. Deleting a missing key is not an error.
+func Apply(ops ...Op) error {
+	entry := make([]logOp, len(ops))
+	for i, op := range ops {
+		entry[i] = logOp{Bucket: op.Bucket, Key: op.Key, Delete: op.Delete}
+		if op.Delete {
+			continue
+		}
+		raw, err := json.Marshal(op.Value)
+		if err != nil {
+			return err
+		}
+		entry[i].Value = raw
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return apply(entry)
+}
+
+// apply logs entry and applies it to the state. mu must be held.
+func apply(entry []logOp) error {
+	if fault != nil {
+		return fault
+	}
+	if err := appendLog(entry); err != nil {
+		return err
+	}
+	for _, op := range entry {
+		if op.Delete {
+			delete(data[op.Bucket], op.Key)
+			continue
+		}
+		if data[op.Bucket] == nil {
+			data[op.Bucket] = map[string]json.RawMessage{}
+		}
+		data[op.Bucket][op.Key] = op.Value
+	}
+	if logged >= compactAfter {
+		// The changes are safe in the log; a failed compaction is retried with the next write
+		_ = compact()
+	}
+	return nil
+}
+
+// Keys returns the sorted keys of bucket.
+func Keys(bucket string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	keys := make([]string, 0, len(data[bucket]))
+	for k := range data[bucket] {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// All decodes all values of bucket ordered by key.
+func All[T any](bucket string) ([]T, error) {
+	var result []T
+	for _, key := range Keys(bucket) {
+		var v T
+		err := Get(bucket, key, &v)
+		if errors.Is(err, common.ErrNotFound) {
+			// Deleted concurrently
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s/%s: %w", bucket, key, err)
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// InjectFault makes all following writes fail with err until it is called with nil. It
+// lets tests exercise failures to store state.
+func InjectFault(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	fault = err
+}
+
+// appendLog writes entry as one line to the log and syncs it. A partially written line
+// is cut off again, so that the next entry starts on a line of its own. mu must be held.
+func appendLog(entry []logOp) error {
+	if path == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if logFile == nil {
+		if err := openLog(); err != nil {
+			return err
+		}
+	}
+	if _, err := logFile.Write(line); err != nil {
+		_ = logFile.Truncate(logSize)
+		return fmt.Errorf("failed to write store log: %w", err)
+	}
+	if err := logFile.Sync(); err != nil {
+		_ = logFile.Truncate(logSize)
+		return fmt.Errorf("failed to write store log: %w", err)
+	}
+	logSize += int64(len(line))
+	logged++
+	return nil
+}
+
+// openLog opens the log for appending. mu must be held.
+func openLog() error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+	f, err := os.OpenFile(path+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open store log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open store log: %w", err)
+	}
+	logFile, logSize = f, info.Size()
+	return nil
+}
+
+// compact writes the state atomically to path and empties the log. mu must be held.
+func compact() error {
+	if path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create store directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+
+	// Replaying the old log over the new state would be harmless, so a crash before the
+	// log is emptied loses nothing
+	if logFile == nil {
+		if err := openLog(); err != nil {
+			return err
+		}
+	}
+	if err := logFile.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate store log: %w", err)
+	}
+	if err := logFile.Sync(); err != nil {
+		return fmt.Errorf("failed to truncate store log: %w", err)
+	}
+	logSize, logged = 0, 0
+	return nil
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"errors"
+	"mailinglist-backend-go/services/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestReopenReplaysLog(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	_ = Put("templates", "a", "first")
+	_ = Put("templates", "b", "second")
+	_ = Put("templates", "a", "changed")
+	_ = Delete("templates", "b")
+
+	// The changes are only in the log until the store is opened again
+	raw, _ := os.ReadFile(p)
+	if string(raw) != "{}" {
+		t.Fatalf("state file was rewritten: %s", raw)
+	}
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := Get("templates", "a", &v); err != nil || v != "changed" {
+		t.Fatalf("a: %q %v", v, err)
+	}
+	if err := Get("templates", "b", &v); !errors.Is(err, common.ErrNotFound) {
+		t.Fatalf("b: %v", err)
+	}
+	if info, err := os.Stat(p + ".log"); err != nil || info.Size() != 0 {
+		t.Fatalf("log was not emptied when opening: %v", err)
+	}
+}
+
+func TestIncompleteLogEntryIsIgnored(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	_ = Put("jobs", "1", "done")
+	// A write interrupted by a crash
+	f, err := os.OpenFile(p+".log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`[{"b":"jobs","k":"2","v":"pen`)
+	f.Close()
+
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	if keys := Keys("jobs"); len(keys) != 1 || keys[0] != "1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestApplyIsAtomic(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	_ = Put("events", "1", "old")
+
+	InjectFault(errors.New("disk full"))
+	err := Apply(Op{Bucket: "events", Key: "2", Value: "new"}, Op{Bucket: "events", Key: "1", Delete: true})
+	InjectFault(nil)
+	if err == nil {
+		t.Fatal("write succeeded despite the fault")
+	}
+	if keys := Keys("events"); len(keys) != 1 || keys[0] != "1" {
+		t.Fatalf("failed batch was partly applied: %v", keys)
+	}
+
+	if err := Apply(Op{Bucket: "events", Key: "2", Value: "new"}, Op{Bucket: "events", Key: "1", Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	if keys := Keys("events"); len(keys) != 1 || keys[0] != "2" {
+		t.Fatalf("unexpected keys after reopening: %v", keys)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "store.json")
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	for i := range compactAfter + 1 {
+		if err := Put("counter", "value", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(p + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 100 {
+		t.Fatalf("log has %d bytes after compaction", info.Size())
+	}
+	raw, _ := os.ReadFile(p)
+	if want := `{"counter":{"value":` + strconv.Itoa(compactAfter-1) + `}}`; string(raw) != want {
+		t.Fatalf("state file is %s, want %s", raw, want)
+	}
+	if err := Open(p); err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if err := Get("counter", "value", &v); err != nil || v != compactAfter {
+		t.Fatalf("value after reopening: %d %v", v, err)
+	}
+}
@@ -0,0 +1,271 @@
+package subscriptions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/mailgun"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupConcurrency limits the parallel member lookups of [Preferences].
+const lookupConcurrency = 8
+
+// rollbackTimeout bounds undoing the changes of a failed [SavePreferences], which runs
+// even if the request was cancelled.
+const rollbackTimeout = 30 * time.Second
+
+// ListPreference is the membership of a user in a visible list.
+type ListPreference struct {
+	List        string `json:"list" example:"news@example.com"`
+	Name        string `json:"name,omitempty" example:"News"`
+	Description string `json:"description,omitempty"`
+	// Subscribed is true for subscribed and paused memberships.
+	Subscribed  bool                 `json:"subscribed"`
+	Status      mailgun.MemberStatus `json:"status" example:"subscribed"`
+	Delivery    mailgun.Delivery     `json:"delivery" example:"immediate"`
+	PausedUntil *time.Time           `json:"paused_until,omitempty"`
+	// Blocked lists cannot be changed.
+	Blocked bool `json:"blocked"`
+}
+
+type Outcome string
+
+const (
+	OutcomeUnchanged Outcome = "unchanged"
+	OutcomeApplied   Outcome = "applied"
+	// OutcomeRolledBack is a change that was applied and undone after another change failed.
+	OutcomeRolledBack Outcome = "rolled_back"
+	OutcomeFailed     Outcome = "failed"
+	// OutcomeSkipped is a change that was not attempted after another change failed.
+	OutcomeSkipped Outcome = "skipped"
+)
+
+// ListResult is the outcome of saving the preferences for one list.
+type ListResult struct {
+	List    string  `json:"list" example:"news@example.com"`
+	Action  string  `json:"action,omitempty" example:"subscribe"`
+	Outcome Outcome `json:"outcome" example:"applied"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Membership is the membership of a user in a list, including hidden lists.
+type Membership struct {
+	List     string         `json:"list" example:"news@example.com"`
+	ListName string         `json:"list_name,omitempty" example:"News"`
+	Member   mailgun.Member `json:"member"`
+}
+
+// ErrNotApplied is returned by [SavePreferences] if a change failed. The results tell
+// which changes were rolled back.
+var ErrNotApplied = errors.New("preferences were not applied")
+
+// membership is the state of a user in a list before saving preferences.
+type membership struct {
+	list   mailgun.MGMailingList
+	member *mailgun.Member
+	paused bool
+}
+
+func (m membership) subscribed() bool {
+	return m.member != nil && (m.member.Subscribed || m.member.Status == mailgun.StatusDigest || m.paused)
+}
+
+// Memberships returns the lists, including hidden ones, email is a member of. Members
+// carry their pause.
+func Memberships(ctx context.Context, email string) ([]Membership, error) {
+	memberships, err := lookup(ctx, email, true)
+	if err != nil {
+		return nil, err
+	}
+	result := []Membership{}
+	for _, m := range memberships {
+		if m.member != nil {
+			result = append(result, Membership{List: m.list.Address, ListName: m.list.Name, Member: WithStatus(m.list.Address, *m.member)})
+		}
+	}
+	return result, nil
+}
+
+// Preferences returns the memberships of email in all visible lists.
+func Preferences(ctx context.Context, email string) ([]ListPreference, error) {
+	memberships, err := lookup(ctx, email, false)
+	if err != nil {
+		return nil, err
+	}
+	result := []ListPreference{}
+	for _, m := range memberships {
+		p := ListPreference{
+			List:        m.list.Address,
+			Name:        m.list.Name,
+			Description: m.list.Description,
+			Subscribed:  m.subscribed(),
+			Status:      mailgun.StatusUnsubscribed,
+			Delivery:    mailgun.DeliveryImmediate,
+			Blocked:     m.list.Blocked,
+		}
+		if m.member != nil {
+			member := WithStatus(m.list.Address, *m.member)
+			p.Status, p.Delivery, p.PausedUntil = member.Status, member.Delivery, member.PausedUntil
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// SavePreferences makes email a member of exactly the visible lists in subscribed. The
+// changes are applied one after another; if one fails, the changes applied so far are
+// undone, also if ctx is cancelled, and [ErrNotApplied] is returned with the outcome of
+// every list. Memberships of hidden lists are left alone. name is used for new members.
+// beforeSubscribe, if set, runs before a list is subscribed, e.g. to record consent; an
+// error fails that change like a Mailgun error.
+func SavePreferences(ctx context.Context, email, name string, subscribed []string, beforeSubscribe func(list string) error) ([]ListResult, error) {
+	memberships, err := lookup(ctx, email, false)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := map[string]bool{}
+	for _, list := range subscribed {
+		desired[strings.ToLower(list)] = true
+	}
+	results := make([]ListResult, len(memberships))
+	for i, m := range memberships {
+		want := desired[strings.ToLower(m.list.Address)]
+		delete(desired, strings.ToLower(m.list.Address))
+		results[i] = ListResult{List: m.list.Address, Outcome: OutcomeUnchanged}
+		if want == m.subscribed() {
+			continue
+		}
+		if m.list.Blocked {
+			return nil, fmt.Errorf("%w: list %s cannot be changed", common.ErrBadRequest, m.list.Address)
+		}
+		results[i].Action = "unsubscribe"
+		if want {
+			results[i].Action = "subscribe"
+		}
+	}
+	if len(desired) > 0 {
+		return nil, fmt.Errorf("%w: unknown lists %s", common.ErrBadRequest, strings.Join(slices.Sorted(maps.Keys(desired)), ", "))
+	}
+
+	var applied []int
+	for i, m := range memberships {
+		r := &results[i]
+		if r.Action == "" {
+			continue
+		}
+		if r.Action == "subscribe" && beforeSubscribe != nil {
+			if err = beforeSubscribe(m.list.Address); err != nil {
+				r.Outcome, r.Error = OutcomeFailed, err.Error()
+				break
+			}
+		}
+		if err = apply(ctx, m, email, name, r.Action); err != nil {
+			r.Outcome, r.Error = OutcomeFailed, err.Error()
+			break
+		}
+		r.Outcome = OutcomeApplied
+		applied = append(applied, i)
+	}
+
+	if err != nil {
+		// A cancelled request must not leave the changes applied so far behind
+		rbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		for _, i := range slices.Backward(applied) {
+			if rbErr := restore(rbCtx, memberships[i], email); rbErr != nil {
+				results[i].Outcome, results[i].Error = OutcomeFailed, "rollback failed: "+rbErr.Error()
+				continue
+			}
+			results[i].Outcome = OutcomeRolledBack
+		}
+		for i := range results {
+			if results[i].Action != "" && results[i].Outcome == OutcomeUnchanged {
+				results[i].Outcome = OutcomeSkipped
+			}
+		}
+		return results, fmt.Errorf("%w: %w", ErrNotApplied, err)
+	}
+
+	// An explicit change ends a pause
+	for _, i := range applied {
+		if err := Clear(memberships[i].list.Address, email); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+func apply(ctx context.Context, m membership, email, name, action string) error {
+	if action == "subscribe" {
+		return Subscribe(ctx, m.list.Address, email, name)
+	}
+	return mailgun.Unsubscribe(ctx, m.list.Address, email)
+}
+
+// restore brings the membership back to the state before saving.
+func restore(ctx context.Context, m membership, email string) error {
+	list := m.list.Address
+	if m.member == nil {
+		return mailgun.DeleteMember(ctx, list, email)
+	}
+	_, err := mailgun.SetSubscribed(ctx, list, email, m.member.Subscribed)
+	if errors.Is(err, common.ErrNotFound) {
+		// The member was deleted by the unsubscribe, create it again with its profile
+		if err := mailgun.Subscribe(ctx, list, *m.member); err != nil {
+			return err
+		}
+		if m.member.Subscribed {
+			return nil
+		}
+		_, err = mailgun.SetSubscribed(ctx, list, email, false)
+	}
+	if err != nil || m.member.Status != mailgun.StatusDigest {
+		return err
+	}
+	// A kept digest member lost its delivery mode when it was unsubscribed
+	_, err = mailgun.UpdateMember(ctx, list, email, "", m.member.Vars)
+	return err
+}
+
+// lookup returns the membership of email in every visible (or every, if includeHidden is
+// set) list, ordered by list address.
+func lookup(ctx context.Context, email string, includeHidden bool) ([]membership, error) {
+	lists, err := mailgun.Lists(ctx, includeHidden)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(lists, func(a, b mailgun.MGMailingList) int { return strings.Compare(a.Address, b.Address) })
+
+	memberships := make([]membership, len(lists))
+	errs := make([]error, len(lists))
+	sem := make(chan struct{}, lookupConcurrency)
+	var wg sync.WaitGroup
+	for i, list := range lists {
+		memberships[i].list = list
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			member, err := mailgun.GetMember(ctx, list.Address, email)
+			if errors.Is(err, common.ErrNotFound) {
+				return
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to get membership of %s: %w", list.Address, err)
+				return
+			}
+			memberships[i].member = &member
+			_, err = Get(list.Address, email)
+			memberships[i].paused = err == nil && !member.Subscribed
+		})
+	}
+	wg.Wait()
+	return memberships, errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package subscriptions
+
+import (
+	"context"
+	"errors"
+	"mailinglist-backend-go/services/mailgun"
+	"testing"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+func TestSavePreferencesRollsBackWhenBeforeSubscribeFails(t *testing.T) {
+	mock := setup(t)
+	mock.AddList(mtypes.MailingList{Address: "events@lists.test"})
+	mock.AddList(mtypes.MailingList{Address: "sports@lists.test"})
+	mailgun.InvalidateLists()
+
+	var called []string
+	results, err := SavePreferences(context.Background(), testMember, "", []string{"events@lists.test", "sports@lists.test"}, func(list string) error {
+		called = append(called, list)
+		if list == "sports@lists.test" {
+			return errors.New("no consent")
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrNotApplied) {
+		t.Fatalf("got %v, want ErrNotApplied", err)
+	}
+	want := map[string]Outcome{"events@lists.test": OutcomeRolledBack, testList: OutcomeRolledBack, "sports@lists.test": OutcomeFailed}
+	for _, r := range results {
+		if r.Outcome != want[r.List] {
+			t.Fatalf("%s: got %s, want %s", r.List, r.Outcome, want[r.List])
+		}
+	}
+	if len(called) != 2 {
+		t.Fatalf("beforeSubscribe called for %v", called)
+	}
+	if _, ok := mock.Member("events@lists.test", testMember); ok {
+		t.Fatal("subscription was not rolled back")
+	}
+	if m, _ := mock.Member(testList, testMember); m.Subscribed == nil || !*m.Subscribed {
+		t.Fatal("unsubscribe was not rolled back")
+	}
+}
+
+func TestSavePreferencesRollsBackAfterCancellation(t *testing.T) {
+	mock := setup(t)
+	mock.AddList(mtypes.MailingList{Address: "events@lists.test"})
+	mock.AddList(mtypes.MailingList{Address: "sports@lists.test"})
+	mailgun.InvalidateLists()
+
+	// The client goes away while the preferences are saved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err := SavePreferences(ctx, testMember, "", []string{"events@lists.test", "sports@lists.test"}, func(list string) error {
+		if list == "sports@lists.test" {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrNotApplied) {
+		t.Fatalf("got %v, want ErrNotApplied", err)
+	}
+	for _, r := range results {
+		if r.List != "sports@lists.test" && r.Outcome != OutcomeRolledBack {
+			t.Fatalf("%s: got %s %q, want rolled_back", r.List, r.Outcome, r.Error)
+		}
+	}
+	if _, ok := mock.Member("events@lists.test", testMember); ok {
+		t.Fatal("subscription was not rolled back")
+	}
+	if m, _ := mock.Member(testList, testMember); m.Subscribed == nil || !*m.Subscribed {
+		t.Fatal("unsubscribe was not rolled back")
+	}
+}
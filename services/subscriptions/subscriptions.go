@@ -0,0 +1,198 @@
+// Package subscriptions manages the list memberships of members: subscribing with the
+// defaults of the list, pausing memberships until a date and the preference center.
+//
+// A paused member stays on the list with subscribed=false. The pause is recorded locally
+// and a scheduler job subscribes the member again when it ends. Subscribing or
+// unsubscribing explicitly ends the pause early.
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/memberVars"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	bucket = "pauses"
+
+	// ResumeJob is the scheduler job type ending a pause.
+	ResumeJob = "resume_member"
+
+	// maxPause is the longest possible pause.
+	maxPause = 366 * 24 * time.Hour
+)
+
+// Pause is a paused membership.
+type Pause struct {
+	// ID identifies this pause. Every call of [PauseUntil] starts a new one, so that its
+	// resume job is not mistaken for the job of an earlier pause with the same end.
+	ID     string    `json:"id"`
+	List   string    `json:"list"`
+	Member string    `json:"member"`
+	Until  time.Time `json:"until"`
+	JobID  string    `json:"job_id"`
+}
+
+// mu serializes changes of pauses so that a resume job never races a new pause.
+var mu sync.Mutex
+
+func key(list, member string) string {
+	return strings.ToLower(list) + "|" + strings.ToLower(member)
+}
+
+// Subscribe adds member to list with the default vars of the list schema. name is
+// optional and replaces the name of an existing member.
+func Subscribe(ctx context.Context, list, member, name string) error {
+	schema, err := memberVars.Get(list)
+	if err != nil {
+		return err
+	}
+	return mailgun.Subscribe(ctx, list, mailgun.Member{Address: member, Name: name, Vars: schema.Defaults()})
+}
+
+// Get returns the pause of a member or [common.ErrNotFound].
+func Get(list, member string) (Pause, error) {
+	var p Pause
+	err := store.Get(bucket, key(list, member), &p)
+	return p, err
+}
+
+// WithStatus marks m as paused if it has an active pause.
+func WithStatus(list string, m mailgun.Member) mailgun.Member {
+	if p, err := Get(list, m.Address); err == nil && !m.Subscribed {
+		m.Status = mailgun.StatusPaused
+		m.PausedUntil = &p.Until
+	}
+	return m
+}
+
+// PauseUntil unsubscribes a subscribed (or already paused) member until the given time.
+func PauseUntil(ctx context.Context, list, member string, until time.Time) (mailgun.Member, error) {
+	until = until.UTC()
+	if !until.After(time.Now()) || until.After(time.Now().Add(maxPause)) {
+		return mailgun.Member{}, fmt.Errorf("%w: until must be in the future and at most a year ahead", common.ErrBadRequest)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	m, err := mailgun.GetMember(ctx, list, member)
+	if err != nil {
+		return mailgun.Member{}, err
+	}
+	previous, err := Get(list, member)
+	paused := err == nil
+	if !m.Subscribed && !paused {
+		return mailgun.Member{}, fmt.Errorf("%w: member is not subscribed", common.ErrConflict)
+	}
+
+	id := uuid.NewString()
+	job, err := scheduler.Schedule(ResumeJob, until, Pause{ID: id, List: list, Member: member, Until: until}, fmt.Sprintf("%s:%s:%s", ResumeJob, key(list, member), id))
+	if err != nil {
+		return mailgun.Member{}, err
+	}
+	p := Pause{ID: id, List: list, Member: member, Until: until, JobID: job.ID}
+	if err := store.Put(bucket, key(list, member), p); err != nil {
+		cancelJob(job.ID)
+		return mailgun.Member{}, err
+	}
+	if m.Subscribed {
+		if m, err = mailgun.SetSubscribed(ctx, list, member, false); err != nil {
+			// Keep the previous state: the member stays subscribed or paused as before
+			if paused {
+				_ = store.Put(bucket, key(list, member), previous)
+			} else {
+				_ = store.Delete(bucket, key(list, member))
+			}
+			cancelJob(job.ID)
+			return mailgun.Member{}, err
+		}
+	}
+	if paused {
+		cancelJob(previous.JobID)
+	}
+	return WithStatus(list, m), nil
+}
+
+// Resume ends the pause of a member now and subscribes it again.
+func Resume(ctx context.Context, list, member string) (mailgun.Member, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p, err := Get(list, member)
+	if err != nil {
+		return mailgun.Member{}, err
+	}
+	cancelJob(p.JobID)
+	return resume(ctx, p)
+}
+
+// Clear forgets the pause of a member, e.g. because it subscribed or unsubscribed explicitly.
+func Clear(list, member string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p, err := Get(list, member)
+	if errors.Is(err, common.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cancelJob(p.JobID)
+	return store.Delete(bucket, key(list, member))
+}
+
+// RunResumeJob is the scheduler handler of [ResumeJob]. Jobs of pauses that were changed
+// or ended in the meantime do nothing.
+func RunResumeJob(ctx context.Context, job scheduler.Job) error {
+	var payload Pause
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("%w: invalid payload: %w", scheduler.ErrPermanent, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	p, err := Get(payload.List, payload.Member)
+	if errors.Is(err, common.ErrNotFound) || (err == nil && p.JobID != job.ID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = resume(ctx, p)
+	if errors.Is(err, common.ErrNotFound) {
+		// The member was removed in the meantime
+		return nil
+	}
+	return err
+}
+
+// resume subscribes the member of p and deletes p. mu must be held.
+func resume(ctx context.Context, p Pause) (mailgun.Member, error) {
+	m, err := mailgun.SetSubscribed(ctx, p.List, p.Member, true)
+	if errors.Is(err, common.ErrNotFound) {
+		_ = store.Delete(bucket, key(p.List, p.Member))
+	}
+	if err != nil {
+		return mailgun.Member{}, err
+	}
+	return m, store.Delete(bucket, key(p.List, p.Member))
+}
+
+// cancelJob cancels the resume job of a replaced pause. It may already be done.
+func cancelJob(id string) {
+	_, _ = scheduler.Cancel(id)
+}
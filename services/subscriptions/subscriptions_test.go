@@ -0,0 +1,128 @@
+package subscriptions
+
+import (
+	"context"
+	"mailinglist-backend-go/services/mailgun"
+	"mailinglist-backend-go/services/mailgunmock"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v5/mtypes"
+)
+
+const (
+	testList   = "news@lists.test"
+	testMember = "jane@example.com"
+)
+
+// setup starts a Mailgun mock with testList and testMember and opens an empty store.
+func setup(t *testing.T) *mailgunmock.Server {
+	t.Helper()
+	mock := mailgunmock.Start()
+	t.Cleanup(mock.Close)
+	mock.AddList(mtypes.MailingList{Address: testList}, mtypes.Member{Address: testMember})
+	err := mailgun.Setup(mailgun.Config{APIBase: mock.URL(), Domain: "lists.test", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Register(ResumeJob, RunResumeJob)
+	return mock
+}
+
+func TestPauseAgainWithSameUntil(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	until := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	if _, err := PauseUntil(ctx, testList, testMember, until); err != nil {
+		t.Fatal(err)
+	}
+	first, err := Get(testList, testMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Resume(ctx, testList, testMember); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PauseUntil(ctx, testList, testMember, until); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := Get(testList, testMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.JobID == first.JobID {
+		t.Fatal("second pause reused the cancelled resume job of the first one")
+	}
+	job, err := scheduler.Get(second.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != scheduler.StatusPending || !job.RunAt.Equal(until.UTC()) {
+		t.Fatalf("resume job is %s at %s, want pending at %s", job.Status, job.RunAt, until.UTC())
+	}
+	if job, _ := scheduler.Get(first.JobID); job.Status != scheduler.StatusCancelled {
+		t.Fatalf("first resume job is %s, want cancelled", job.Status)
+	}
+}
+
+func TestPauseRollsBackWhenUnsubscribeFails(t *testing.T) {
+	mock := setup(t)
+	mock.Inject(mailgunmock.Fault{Method: http.MethodPut, Path: "/v3/lists/" + testList + "/members/", Status: http.StatusBadRequest})
+
+	_, err := PauseUntil(context.Background(), testList, testMember, time.Now().Add(time.Hour))
+	if err == nil {
+		t.Fatal("pause succeeded although the member could not be unsubscribed")
+	}
+	if _, err := Get(testList, testMember); err == nil {
+		t.Fatal("pause of a still subscribed member was kept")
+	}
+	jobs, err := scheduler.List(scheduler.StatusPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("%d resume jobs are pending, want none", len(jobs))
+	}
+	if m, _ := mock.Member(testList, testMember); m.Subscribed == nil || !*m.Subscribed {
+		t.Fatal("member is no longer subscribed")
+	}
+}
+
+func TestResumeJobOfEndedPause(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+
+	if _, err := PauseUntil(ctx, testList, testMember, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Get(testList, testMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Clear(testList, testMember); err != nil {
+		t.Fatal(err)
+	}
+	job, err := scheduler.Get(p.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunResumeJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	m, err := mailgun.GetMember(ctx, testList, testMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subscribed {
+		t.Fatal("resume job of a cleared pause subscribed the member")
+	}
+}
@@ -0,0 +1,218 @@
+// Package templates manages stored message templates. Subjects and text bodies are
+// rendered with text/template, HTML bodies with html/template.
+//
+// Besides the named variables passed at render time, templates can reference member
+// specific values with {{recipient "name"}}. When sending to a list this renders the
+// Mailgun recipient variable %recipient.name%, which Mailgun fills per member from the
+// member vars. When previewing, the value is taken from the sample recipient instead.
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/store"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const bucket = "templates"
+
+// Variable is a named value a template expects at render time.
+type Variable struct {
+	Name        string `json:"name" example:"month"`
+	Description string `json:"description,omitempty" example:"Month of the newsletter"`
+	Required    bool   `json:"required"`
+	// Sample is used for previews if no value is given.
+	Sample string `json:"sample,omitempty" example:"October"`
+}
+
+// Template is a stored message template.
+type Template struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name" example:"Monthly newsletter"`
+	Subject   string     `json:"subject" example:"News for {{.month}}"`
+	Text      string     `json:"text,omitempty" example:"Hello {{recipient \"name\"}}, here is the news for {{.month}}."`
+	HTML      string     `json:"html,omitempty" example:"<p>Hello {{recipient \"name\"}}</p>"`
+	Variables []Variable `json:"variables"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Rendered is the result of rendering a template.
+type Rendered struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text,omitempty"`
+	HTML    string `json:"html,omitempty"`
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func List() ([]Template, error) {
+	return store.All[Template](bucket)
+}
+
+func Get(id string) (Template, error) {
+	var t Template
+	err := store.Get(bucket, id, &t)
+	return t, err
+}
+
+// Create validates and stores a new template.
+func Create(t Template) (Template, error) {
+	if err := validate(t); err != nil {
+		return Template{}, err
+	}
+	t.ID = uuid.NewString()
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+	return t, store.Put(bucket, t.ID, t)
+}
+
+// Update validates and replaces the template with id.
+func Update(id string, t Template) (Template, error) {
+	existing, err := Get(id)
+	if err != nil {
+		return Template{}, err
+	}
+	if err := validate(t); err != nil {
+		return Template{}, err
+	}
+	t.ID = existing.ID
+	t.CreatedAt = existing.CreatedAt
+	t.UpdatedAt = time.Now().UTC()
+	return t, store.Put(bucket, t.ID, t)
+}
+
+func Delete(id string) error {
+	return store.Delete(bucket, id)
+}
+
+// Render renders t for sending. Values for missing optional variables are empty and
+// {{recipient}} references are turned into Mailgun recipient variables.
+func Render(t Template, vars map[string]string) (Rendered, error) {
+	return render(t, vars, nil)
+}
+
+// Preview renders t with vars, falling back to the variable samples, and replaces
+// {{recipient}} references with the values of recipient.
+func Preview(t Template, vars map[string]string, recipient map[string]string) (Rendered, error) {
+	merged := map[string]string{}
+	for _, v := range t.Variables {
+		if v.Sample != "" {
+			merged[v.Name] = v.Sample
+		}
+	}
+	for k, v := range vars {
+		merged[k] = v
+	}
+	if recipient == nil {
+		recipient = map[string]string{}
+	}
+	return render(t, merged, recipient)
+}
+
+func render(t Template, vars map[string]string, recipient map[string]string) (Rendered, error) {
+	data := map[string]string{}
+	for _, v := range t.Variables {
+		value, ok := vars[v.Name]
+		if v.Required && (!ok || value == "") {
+			return Rendered{}, fmt.Errorf("%w: variable %q is required", common.ErrBadRequest, v.Name)
+		}
+		data[v.Name] = value
+	}
+	fn := funcs(recipient)
+
+	var out Rendered
+	var err error
+	if out.Subject, err = executeText("subject", t.Subject, fn, data); err != nil {
+		return Rendered{}, err
+	}
+	// Subjects are single line headers
+	out.Subject = strings.Join(strings.Fields(out.Subject), " ")
+	if out.Text, err = executeText("text", t.Text, fn, data); err != nil {
+		return Rendered{}, err
+	}
+	if t.HTML != "" {
+		tpl, err := htmltemplate.New("html").Funcs(htmltemplate.FuncMap(fn)).Option("missingkey=error").Parse(t.HTML)
+		if err != nil {
+			return Rendered{}, fmt.Errorf("%w: html: %w", common.ErrBadRequest, err)
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, data); err != nil {
+			return Rendered{}, fmt.Errorf("%w: html: %w", common.ErrBadRequest, err)
+		}
+		out.HTML = buf.String()
+	}
+	return out, nil
+}
+
+func executeText(name, source string, fn texttemplate.FuncMap, data map[string]string) (string, error) {
+	tpl, err := texttemplate.New(name).Funcs(fn).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", common.ErrBadRequest, name, err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", common.ErrBadRequest, name, err)
+	}
+	return buf.String(), nil
+}
+
+// funcs returns the template functions. A nil recipient renders Mailgun recipient variables.
+func funcs(recipient map[string]string) texttemplate.FuncMap {
+	return texttemplate.FuncMap{
+		"recipient": func(name string) (string, error) {
+			if !variableName.MatchString(name) {
+				return "", fmt.Errorf("invalid recipient variable %q", name)
+			}
+			if recipient == nil {
+				return "%recipient." + name + "%", nil
+			}
+			return recipient[name], nil
+		},
+	}
+}
+
+func validate(t Template) error {
+	var errs []error
+	if strings.TrimSpace(t.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if strings.TrimSpace(t.Subject) == "" {
+		errs = append(errs, errors.New("subject is required"))
+	}
+	if t.Text == "" && t.HTML == "" {
+		errs = append(errs, errors.New("a text or html body is required"))
+	}
+	seen := map[string]bool{}
+	for _, v := range t.Variables {
+		if !variableName.MatchString(v.Name) {
+			errs = append(errs, fmt.Errorf("invalid variable name %q", v.Name))
+		}
+		if seen[v.Name] {
+			errs = append(errs, fmt.Errorf("duplicate variable %q", v.Name))
+		}
+		seen[v.Name] = true
+	}
+	fn := funcs(nil)
+	if _, err := texttemplate.New("subject").Funcs(fn).Parse(t.Subject); err != nil {
+		errs = append(errs, fmt.Errorf("subject: %w", err))
+	}
+	if _, err := texttemplate.New("text").Funcs(fn).Parse(t.Text); err != nil {
+		errs = append(errs, fmt.Errorf("text: %w", err))
+	}
+	if _, err := htmltemplate.New("html").Funcs(htmltemplate.FuncMap(fn)).Parse(t.HTML); err != nil {
+		errs = append(errs, fmt.Errorf("html: %w", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", common.ErrBadRequest, errors.Join(errs...))
+	}
+	return nil
+}
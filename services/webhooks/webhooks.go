@@ -0,0 +1,446 @@
+// Package webhooks delivers domain events to URLs registered by admins.
+//
+// Every matching event becomes a delivery that is POSTed as JSON by a scheduler job. The
+// body is signed with the secret of the webhook: the X-Webhook-Signature header is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">". Failed attempts are
+// retried with exponential backoff starting at WEBHOOK_RETRY_BASE (default 30s); after
+// WEBHOOK_MAX_ATTEMPTS (default 8) the delivery is dead-lettered. Delivered and dead
+// deliveries are removed WEBHOOK_DELIVERY_RETENTION (default 720h) after their last
+// attempt.
+//
+// Deliveries are at least once: an attempt is stored before the event is sent, so that
+// a failure to store it sends nothing, but if its outcome cannot be stored the attempt is
+// repeated. Receivers recognize repeats by the X-Webhook-ID header.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mailinglist-backend-go/services/common"
+	"mailinglist-backend-go/services/configReader"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	bucket           = "webhooks"
+	deliveriesBucket = "webhook_deliveries"
+
+	// Job is the scheduler job type running one delivery attempt.
+	Job = "deliver_webhook"
+)
+
+// Webhook is a URL that receives events. Secret is only returned when it is created.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url" example:"https://crm.example.com/hooks/mailinglists"`
+	// Events are the event types sent to the URL, all if empty.
+	Events    []events.Type `json:"events" example:"member.subscribed"`
+	Secret    string        `json:"secret,omitempty"`
+	CreatedBy string        `json:"created_by" example:"admin@example.com"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	// StatusDead is a delivery that failed all attempts.
+	StatusDead Status = "dead"
+)
+
+// Delivery is an event to be sent to a webhook.
+type Delivery struct {
+	ID      string       `json:"id"`
+	Webhook string       `json:"webhook"`
+	Event   events.Event `json:"event"`
+	Status  Status       `json:"status" example:"pending"`
+	// Attempts counts the attempts since the delivery was created or redelivered.
+	Attempts     int `json:"attempts"`
+	Redeliveries int `json:"redeliveries"`
+	// JobID is the scheduler job of the last attempt.
+	JobID string `json:"job_id,omitempty"`
+	// StatusCode is the HTTP status of the last attempt, 0 if there was no response.
+	StatusCode    int        `json:"status_code,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+type payload struct {
+	ID string `json:"id"`
+}
+
+var (
+	// mu serializes changes of webhooks and deliveries.
+	mu     sync.Mutex
+	client = &http.Client{}
+	// lastPurge is when finished deliveries were last purged by [Enqueue].
+	lastPurge time.Time
+)
+
+// purgeInterval is the minimum time between two purges of finished deliveries.
+const purgeInterval = time.Hour
+
+// Create registers a webhook for eventTypes (all if empty). A secret is generated if
+// none is given.
+func Create(rawURL string, eventTypes []events.Type, secret, createdBy string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http(s) URL", common.ErrBadRequest)
+	}
+	for _, t := range eventTypes {
+		if !slices.Contains(events.Types, t) {
+			return Webhook{}, fmt.Errorf("%w: unknown event type %q", common.ErrBadRequest, t)
+		}
+	}
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return Webhook{}, err
+		}
+		secret = "whsec_" + hex.EncodeToString(b)
+	}
+	if eventTypes == nil {
+		eventTypes = []events.Type{}
+	}
+	w := Webhook{
+		ID:        uuid.NewString(),
+		URL:       u.String(),
+		Events:    eventTypes,
+		Secret:    secret,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	return w, store.Put(bucket, w.ID, w)
+}
+
+// List returns the webhooks without their secrets, oldest first.
+func List() ([]Webhook, error) {
+	all, err := store.All[Webhook](bucket)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(all, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	for i := range all {
+		all[i].Secret = ""
+	}
+	if all == nil {
+		all = []Webhook{}
+	}
+	return all, nil
+}
+
+// Get returns a webhook without its secret.
+func Get(id string) (Webhook, error) {
+	w, err := get(id)
+	w.Secret = ""
+	return w, err
+}
+
+// Delete removes a webhook. Its pending deliveries are dead-lettered when they run.
+func Delete(id string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := get(id); err != nil {
+		return err
+	}
+	return store.Delete(bucket, id)
+}
+
+// Enqueue creates a delivery of e for every webhook subscribed to its type and schedules
+// the first attempts.
+func Enqueue(e events.Event) error {
+	hooks, err := store.All[Webhook](bucket)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, w := range hooks {
+		if len(w.Events) > 0 && !slices.Contains(w.Events, e.Type) {
+			continue
+		}
+		now := time.Now().UTC()
+		d := Delivery{
+			ID:        uuid.NewString(),
+			Webhook:   w.ID,
+			Event:     e,
+			Status:    StatusPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := store.Put(deliveriesBucket, d.ID, d); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := scheduler.Schedule(Job, now, payload{ID: d.ID}, jobKey(d)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	mu.Lock()
+	purge := time.Since(lastPurge) >= purgeInterval
+	if purge {
+		lastPurge = time.Now()
+	}
+	mu.Unlock()
+	if purge {
+		if _, err := Purge(time.Now().Add(-configReader.Duration("WEBHOOK_DELIVERY_RETENTION", 30*24*time.Hour))); err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge deliveries: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Purge removes the delivered and dead deliveries last attempted before before. It
+// returns the number of removed deliveries.
+func Purge(before time.Time) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	removed := 0
+	for _, k := range store.Keys(deliveriesBucket) {
+		var d Delivery
+		if err := store.Get(deliveriesBucket, k, &d); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				continue
+			}
+			return removed, err
+		}
+		if d.Status == StatusPending || !d.UpdatedAt.Before(before) {
+			continue
+		}
+		if err := store.Delete(deliveriesBucket, k); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Pseudonymize replaces address by pseudonym as member and actor in the events of all
+// deliveries, including pending ones, for right to erasure requests. It returns the
+// number of changed deliveries.
+func Pseudonymize(address, pseudonym string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	changed := 0
+	for _, k := range store.Keys(deliveriesBucket) {
+		var d Delivery
+		if err := store.Get(deliveriesBucket, k, &d); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				continue
+			}
+			return changed, err
+		}
+		member, actor := strings.EqualFold(d.Event.Member, address), strings.EqualFold(d.Event.Actor, address)
+		if !member && !actor {
+			continue
+		}
+		if member {
+			d.Event.Member = pseudonym
+		}
+		if actor {
+			d.Event.Actor = pseudonym
+		}
+		if err := store.Put(deliveriesBucket, k, d); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Deliveries returns the deliveries of a webhook with status (all if empty), newest first.
+func Deliveries(webhook string, status Status) ([]Delivery, error) {
+	if _, err := get(webhook); err != nil {
+		return nil, err
+	}
+	all, err := store.All[Delivery](deliveriesBucket)
+	if err != nil {
+		return nil, err
+	}
+	all = slices.DeleteFunc(all, func(d Delivery) bool {
+		return d.Webhook != webhook || (status != "" && d.Status != status)
+	})
+	slices.SortFunc(all, func(a, b Delivery) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	if all == nil {
+		all = []Delivery{}
+	}
+	return all, nil
+}
+
+// Redeliver sends a delivered or dead delivery of webhook again, with a fresh set of
+// attempts.
+func Redeliver(webhook, id string) (Delivery, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var d Delivery
+	if err := store.Get(deliveriesBucket, id, &d); err != nil {
+		return Delivery{}, err
+	}
+	if d.Webhook != webhook {
+		return Delivery{}, common.ErrNotFound
+	}
+	if _, err := get(webhook); err != nil {
+		return Delivery{}, err
+	}
+	if d.Status == StatusPending {
+		return Delivery{}, fmt.Errorf("%w: delivery is pending", common.ErrConflict)
+	}
+	now := time.Now().UTC()
+	d.Status, d.Attempts, d.NextAttemptAt, d.UpdatedAt = StatusPending, 0, &now, now
+	d.Redeliveries++
+	if err := store.Put(deliveriesBucket, d.ID, d); err != nil {
+		return Delivery{}, err
+	}
+	if _, err := scheduler.Schedule(Job, now, payload{ID: d.ID}, jobKey(d)); err != nil {
+		return Delivery{}, err
+	}
+	return d, nil
+}
+
+// RunJob is the scheduler handler of [Job]. It makes one attempt and schedules the next
+// one or dead-letters the delivery; only failures to store the attempt or its outcome are
+// retried by the scheduler. A retry of the same job repeats the attempt without counting
+// it again.
+func RunJob(ctx context.Context, job scheduler.Job) error {
+	var p payload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("%w: invalid payload: %w", scheduler.ErrPermanent, err)
+	}
+
+	var d Delivery
+	err := store.Get(deliveriesBucket, p.ID, &d)
+	if errors.Is(err, common.ErrNotFound) {
+		return fmt.Errorf("%w: delivery %s not found", scheduler.ErrPermanent, p.ID)
+	}
+	if err != nil || d.Status != StatusPending {
+		return err
+	}
+
+	w, err := get(d.Webhook)
+	deleted := errors.Is(err, common.ErrNotFound)
+	if err != nil && !deleted {
+		return err
+	}
+	if d.JobID != job.ID {
+		if err := startAttempt(&d, job.ID); err != nil {
+			return err
+		}
+	}
+	var status int
+	if deleted {
+		err = errors.New("webhook was deleted")
+	} else {
+		status, err = send(ctx, w, d)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().UTC()
+	d.StatusCode, d.UpdatedAt, d.NextAttemptAt = status, now, nil
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.DeliveredAt = StatusDelivered, "", &now
+	case d.Attempts >= maxAttempts() || deleted:
+		d.Status, d.LastError = StatusDead, err.Error()
+	default:
+		next := now.Add(configReader.Duration("WEBHOOK_RETRY_BASE", 30*time.Second) << (d.Attempts - 1))
+		d.LastError, d.NextAttemptAt = err.Error(), &next
+		if _, err := scheduler.Schedule(Job, next, payload{ID: d.ID}, jobKey(d)); err != nil {
+			return err
+		}
+	}
+	return store.Put(deliveriesBucket, d.ID, d)
+}
+
+// startAttempt counts an attempt of d made by the job jobID and stores it.
+func startAttempt(d *Delivery, jobID string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	d.Attempts++
+	d.JobID, d.UpdatedAt = jobID, time.Now().UTC()
+	return store.Put(deliveriesBucket, d.ID, *d)
+}
+
+// Sign returns the X-Webhook-Signature header of body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send POSTs the event of d to w and returns the response status.
+func send(ctx context.Context, w Webhook, d Delivery) (int, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, configReader.Duration("WEBHOOK_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mailinglist-backend-go")
+	req.Header.Set("X-Webhook-ID", d.ID)
+	req.Header.Set("X-Webhook-Event", string(d.Event.Type))
+	req.Header.Set("X-Webhook-Signature", Sign(w.Secret, time.Now(), body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func maxAttempts() int {
+	n, err := strconv.Atoi(configReader.Value("WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || n < 1 {
+		return 8
+	}
+	return n
+}
+
+// jobKey identifies the job of the next attempt, so that an event is not sent twice when
+// storing the outcome of an attempt is retried.
+func jobKey(d Delivery) string {
+	return Job + ":" + d.ID + ":" + strconv.Itoa(d.Redeliveries) + ":" + strconv.Itoa(d.Attempts+1)
+}
+
+func get(id string) (Webhook, error) {
+	var w Webhook
+	err := store.Get(bucket, id, &w)
+	return w, err
+}
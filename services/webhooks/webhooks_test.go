@@ -0,0 +1,183 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mailinglist-backend-go/services/events"
+	"mailinglist-backend-go/services/scheduler"
+	"mailinglist-backend-go/services/store"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// onReceive, if set, is called by the server of [setup] for every request.
+var onReceive func()
+
+// setup opens an empty store and registers a webhook for all events at a server
+// counting the requests it receives.
+func setup(t *testing.T) (Webhook, *atomic.Int32) {
+	t.Helper()
+	if err := store.Open(filepath.Join(t.TempDir(), "store.json")); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Register(Job, RunJob)
+	lastPurge = time.Time{}
+	onReceive = nil
+
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		received.Add(1)
+		if onReceive != nil {
+			onReceive()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	w, err := Create(srv.URL, nil, "secret", "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, &received
+}
+
+func deliveries(t *testing.T, w Webhook) []Delivery {
+	t.Helper()
+	all, err := Deliveries(w.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+func TestPurgeFinishedDeliveries(t *testing.T) {
+	w, _ := setup(t)
+	for _, status := range []Status{StatusDelivered, StatusDead, StatusPending} {
+		if err := Enqueue(events.Event{ID: string(status), Type: events.MemberSubscribed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range deliveries(t, w) {
+		d.Status, d.UpdatedAt = Status(d.Event.ID), time.Now().Add(-48*time.Hour)
+		if err := store.Put(deliveriesBucket, d.ID, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := Purge(time.Now().Add(-72 * time.Hour)); err != nil || n != 0 {
+		t.Fatalf("purged %d (%v) deliveries within retention", n, err)
+	}
+	n, err := Purge(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := deliveries(t, w)
+	if n != 2 || len(left) != 1 || left[0].Status != StatusPending {
+		t.Fatalf("purged %d, left %+v", n, left)
+	}
+}
+
+func TestPseudonymizeDeliveries(t *testing.T) {
+	w, _ := setup(t)
+	_ = Enqueue(events.Event{ID: "1", Type: events.MemberSubscribed, Actor: "jane@example.com", Member: "jane@example.com"})
+	_ = Enqueue(events.Event{ID: "2", Type: events.MemberSubscribed, Actor: "admin@example.com", Member: "john@example.com"})
+
+	n, err := Pseudonymize("Jane@example.com", "erased:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("changed %d deliveries, want 1", n)
+	}
+	for _, d := range deliveries(t, w) {
+		if d.Event.Member == "jane@example.com" || d.Event.Actor == "jane@example.com" {
+			t.Fatalf("address is still stored: %+v", d.Event)
+		}
+	}
+}
+
+func TestRunJobDelivers(t *testing.T) {
+	w, received := setup(t)
+	if err := Enqueue(events.Event{ID: "1", Type: events.MemberSubscribed}); err != nil {
+		t.Fatal(err)
+	}
+	jobs, _ := scheduler.List(scheduler.StatusPending)
+	if len(jobs) != 1 {
+		t.Fatalf("%d jobs scheduled", len(jobs))
+	}
+	if err := RunJob(context.Background(), jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	d := deliveries(t, w)[0]
+	if received.Load() != 1 || d.Status != StatusDelivered || d.Attempts != 1 || d.DeliveredAt == nil {
+		t.Fatalf("received %d, delivery %+v", received.Load(), d)
+	}
+	// A repeated job does not send a delivered event again
+	if err := RunJob(context.Background(), jobs[0]); err != nil || received.Load() != 1 {
+		t.Fatalf("repeated job: %v, received %d", err, received.Load())
+	}
+}
+
+// enqueue enqueues an event for w and returns the job of its delivery.
+func enqueue(t *testing.T) scheduler.Job {
+	t.Helper()
+	if err := Enqueue(events.Event{ID: "1", Type: events.MemberSubscribed}); err != nil {
+		t.Fatal(err)
+	}
+	jobs, _ := scheduler.List(scheduler.StatusPending)
+	if len(jobs) != 1 {
+		t.Fatalf("%d jobs scheduled", len(jobs))
+	}
+	return jobs[0]
+}
+
+func TestRetryAfterFailingToStoreAttempt(t *testing.T) {
+	w, received := setup(t)
+	job := enqueue(t)
+
+	store.InjectFault(errors.New("disk full"))
+	err := RunJob(context.Background(), job)
+	store.InjectFault(nil)
+	if err == nil {
+		t.Fatal("failure to store the attempt was not reported")
+	}
+	if d := deliveries(t, w)[0]; received.Load() != 0 || d.Attempts != 0 {
+		t.Fatalf("attempt that was not stored: received %d, delivery %+v", received.Load(), d)
+	}
+
+	if err := RunJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if d := deliveries(t, w)[0]; received.Load() != 1 || d.Status != StatusDelivered || d.Attempts != 1 {
+		t.Fatalf("retry: received %d, delivery %+v", received.Load(), d)
+	}
+}
+
+func TestRetryAfterFailingToStoreOutcome(t *testing.T) {
+	w, received := setup(t)
+	job := enqueue(t)
+
+	// The store fails while the event is sent
+	onReceive = func() { store.InjectFault(errors.New("disk full")) }
+	err := RunJob(context.Background(), job)
+	onReceive = nil
+	store.InjectFault(nil)
+	if err == nil {
+		t.Fatal("failure to store the outcome was not reported")
+	}
+	if d := deliveries(t, w)[0]; received.Load() != 1 || d.Status != StatusPending || d.Attempts != 1 {
+		t.Fatalf("outcome that was not stored: received %d, delivery %+v", received.Load(), d)
+	}
+
+	// At least once: the attempt is repeated, but not counted again
+	if err := RunJob(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	if d := deliveries(t, w)[0]; received.Load() != 2 || d.Status != StatusDelivered || d.Attempts != 1 {
+		t.Fatalf("retry: received %d, delivery %+v", received.Load(), d)
+	}
+}